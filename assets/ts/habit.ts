@@ -9,6 +9,37 @@ export interface Habit {
   logs: HabitLogs;
   sort?: number | undefined;
   weekly_goal?: number | undefined;
+  // unix ms of the last change to each field. used by the server to merge devices
+  logs_updated_at?: { [date: string]: number };
+  weekly_goal_updated_at?: number;
+  sort_updated_at?: number;
+  deleted_at?: number;
+}
+
+export function newHabit(): Habit {
+  const now = new Date().getTime();
+  return { logs: {}, weekly_goal_updated_at: now, sort_updated_at: now };
+}
+
+// deleted habits are kept as tombstones so other devices learn about the deletion
+export function isDeleted(habit: Habit): boolean {
+  const deletedAt = habit.deleted_at;
+  if (!deletedAt) {
+    return false;
+  }
+  const changes = [
+    habit.weekly_goal_updated_at ?? 0,
+    habit.sort_updated_at ?? 0,
+    ...Object.values(habit.logs_updated_at ?? {}),
+  ];
+  return changes.every((updated) => updated <= deletedAt);
+}
+
+function touchLog(habit: Habit, day: string) {
+  habit.logs_updated_at = {
+    ...habit.logs_updated_at,
+    [day]: new Date().getTime(),
+  };
 }
 
 export interface HabitMap {
@@ -29,6 +60,7 @@ export function logHabit(habitName: string, habitData: HabitMap, date?: Date) {
     habitData[habitName].logs[day] = 0;
   }
   habitData[habitName].logs[day]++;
+  touchLog(habitData[habitName], day);
   saveData(habitData);
   // TODO: put request to /habits/id
   updateHeatmap(habitName, habitData[habitName]);
@@ -45,6 +77,7 @@ function clearLog(habitName: string, habitData: HabitMap, date?: Date) {
     habitData[habitName].logs[day] = 0;
   }
   habitData[habitName].logs[day]--;
+  touchLog(habitData[habitName], day);
   saveData(habitData);
   // TODO: put request to /habits/id
   updateHeatmap(habitName, habitData[habitName]);
@@ -58,9 +91,18 @@ function editHabit(
   habitData: HabitMap,
   newHabit: Habit
 ) {
+  if (newName != oldName) {
+    // a rename starts a new habit, so its fields win over any old tombstone
+    const now = new Date().getTime();
+    newHabit.weekly_goal_updated_at = now;
+    newHabit.sort_updated_at = now;
+    newHabit.logs_updated_at = Object.fromEntries(
+      Object.keys(newHabit.logs).map((day) => [day, now])
+    );
+  }
   habitData[newName] = newHabit;
   if (newName != oldName) {
-    delete habitData[oldName];
+    habitData[oldName] = { logs: {}, deleted_at: new Date().getTime() };
   }
   saveData(habitData);
   // TODO: edit request to /habits/id
@@ -77,7 +119,8 @@ function deleteHabit(habitName: string, habitData: HabitMap) {
     return;
   }
 
-  delete habitData[habitName]; // Remove habit from data object
+  // Keep a tombstone so the deletion syncs
+  habitData[habitName] = { logs: {}, deleted_at: new Date().getTime() };
   saveData(habitData);
   // TODO: delete request to /habits/id
   renderAllHabits(habitData); // Re-render the UI
@@ -300,13 +343,16 @@ function setupEditPopover(habitName: string, allHabits: HabitMap) {
     .on("click", function () {
       $('[data-bs-toggle="popover"]').popover("hide");
       const newLog = allHabits[habitName];
+      const now = new Date().getTime();
       const newGoal = parseInt(weeklyGoalInput.val(), 10);
       if (newGoal) {
         newLog.weekly_goal = newGoal;
+        newLog.weekly_goal_updated_at = now;
       }
       const newSort = parseInt(sortInput.val(), 10);
       if (newSort) {
         newLog.sort = newSort;
+        newLog.sort_updated_at = now;
       }
       editHabit(renameInput.val(), habitName, allHabits, newLog);
     });
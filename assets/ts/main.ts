@@ -1,6 +1,12 @@
-import { HabitMap, logHabit, setupHabit } from "./habit.ts";
+import {
+  HabitMap,
+  isDeleted,
+  logHabit,
+  newHabit,
+  setupHabit,
+} from "./habit.ts";
 import { authToken, setupSession } from "./auth.ts";
-import { sync } from "./sync.ts";
+import { syncChanges } from "./sync.ts";
 const HABIT_STORAGE_KEY = "habitData";
 
 export let heatmapInstances: Record<string, CalHeatmap> = {};
@@ -50,19 +56,25 @@ function filterHabits(searchText: string) {
   });
 }
 
-const debouncedSync = debounce(
-  (token: string, habits: HabitMap, timestamp: number) => {
-    sync(token, habits, timestamp);
-  },
-  300
-);
+const debouncedSync = debounce((token: string, habits: HabitMap) => {
+  syncChanges(token, habits)
+    .then((changed) => {
+      if (!changed) {
+        return;
+      }
+      // not saveData, that would sync again
+      localStorage.setItem(HABIT_STORAGE_KEY, JSON.stringify(habits));
+      renderAllHabits(habits);
+    })
+    .catch(console.error);
+}, 300);
 
 // --- Data Functions ---
 export function saveData(data: HabitMap) {
   try {
     localStorage.setItem(HABIT_STORAGE_KEY, JSON.stringify(data));
     if (authToken) {
-      debouncedSync(authToken, data, new Date().getTime());
+      debouncedSync(authToken, data);
     }
   } catch (error) {
     console.error("Error saving data to localStorage:", error);
@@ -77,14 +89,15 @@ export function loadData(): HabitMap {
 
 // --- Event Handlers ---
 function addNewHabit(habitName: string, habitData: HabitMap) {
-  if (habitName && !habitData[habitName]) {
-    habitData[habitName] = { logs: {} };
+  const existing = habitData[habitName];
+  if (habitName && (!existing || isDeleted(existing))) {
+    habitData[habitName] = newHabit();
     saveData(habitData);
     // TODO: post request to /habits
     renderAllHabits(habitData);
     return;
   }
-  if (habitData[habitName]) {
+  if (existing) {
     // add log
     logHabit(habitName, habitData);
     return;
@@ -109,6 +122,7 @@ export function renderAllHabits(habitMap: HabitMap) {
   heatmapInstances = {};
 
   const sortedHabits = Object.entries(habitMap)
+    .filter(([_, data]) => !isDeleted(data))
     .map(([name, data]) => ({
       name,
       sort: data?.sort ?? 0,
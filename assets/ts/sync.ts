@@ -1,4 +1,8 @@
-import { HabitMap } from "./habit.ts";
+import { Habit, HabitMap } from "./habit.ts";
+
+const SYNC_CURSOR_KEY = "syncCursor";
+const SYNCED_AT_KEY = "syncedAt";
+const SYNC_VERSION_KEY = "syncVersion";
 
 export async function sync(
   token: string | null,
@@ -9,6 +13,7 @@ export async function sync(
     return;
   }
   try {
+    const startedAt = new Date().getTime();
     const body = {
       habit_data: data,
       client_timestamp: last_update,
@@ -27,9 +32,184 @@ export async function sync(
       throw new Error(`HTTP error! status: ${response.status}`);
     }
 
-    return await response.json();
+    const result = await response.json();
+    saveCursor(result.data.Cursor, result.data.Version, startedAt);
+    return result;
   } catch (error) {
     console.error("Sync failed:", error);
     throw error;
   }
 }
+
+// Sends only what changed since the last sync and applies what other devices changed.
+// Returns true if data was modified
+export async function syncChanges(
+  token: string | null,
+  data: HabitMap
+): Promise<boolean> {
+  if (!token) {
+    return false;
+  }
+  let changed = false;
+  try {
+    // a conflict means another device synced first. rebase on its changes and retry once
+    for (let attempt = 0; attempt < 2; attempt++) {
+      const startedAt = new Date().getTime();
+      const cursor = Number(localStorage.getItem(SYNC_CURSOR_KEY) ?? 0);
+      const since = Number(localStorage.getItem(SYNCED_AT_KEY) ?? 0);
+      const version = localStorage.getItem(SYNC_VERSION_KEY);
+      const body = {
+        cursor,
+        changes: changesSince(data, since),
+        client_timestamp: startedAt,
+        base_version: version === null ? undefined : Number(version),
+      };
+      const response = await fetch("/api/sync/changes", {
+        method: "POST",
+        headers: {
+          "Content-Type": "application/json",
+          Authorization: token,
+        },
+        body: JSON.stringify(body),
+      });
+
+      if (response.status === 409) {
+        const result = await response.json();
+        changed = applyChanges(data, result.data.changes ?? {}) || changed;
+        localStorage.setItem(SYNC_CURSOR_KEY, String(result.data.cursor));
+        localStorage.setItem(SYNC_VERSION_KEY, String(result.data.version));
+        continue;
+      }
+      if (!response.ok) {
+        throw new Error(`HTTP error! status: ${response.status}`);
+      }
+
+      const result = await response.json();
+      changed = applyChanges(data, result.data.changes ?? {}) || changed;
+      saveCursor(result.data.cursor, result.data.version, startedAt);
+      return changed;
+    }
+    return changed;
+  } catch (error) {
+    console.error("Sync failed:", error);
+    throw error;
+  }
+}
+
+function saveCursor(
+  cursor: number | undefined,
+  version: number | undefined,
+  syncedAt: number
+) {
+  if (cursor === undefined) {
+    return;
+  }
+  localStorage.setItem(SYNC_CURSOR_KEY, String(cursor));
+  localStorage.setItem(SYNCED_AT_KEY, String(syncedAt));
+  if (version !== undefined) {
+    localStorage.setItem(SYNC_VERSION_KEY, String(version));
+  }
+}
+
+// fields changed at or after since. unstamped fields are left to the full sync
+function changesSince(data: HabitMap, since: number): HabitMap {
+  const changes: HabitMap = {};
+  for (const [name, habit] of Object.entries(data)) {
+    const change: Habit = { logs: {}, logs_updated_at: {} };
+    let changed = false;
+    for (const [day, updated] of Object.entries(habit.logs_updated_at ?? {})) {
+      if (isSince(updated, since)) {
+        change.logs[day] = habit.logs[day] ?? 0;
+        change.logs_updated_at![day] = updated;
+        changed = true;
+      }
+    }
+    if (isSince(habit.weekly_goal_updated_at, since)) {
+      change.weekly_goal = habit.weekly_goal ?? 0;
+      change.weekly_goal_updated_at = habit.weekly_goal_updated_at;
+      changed = true;
+    }
+    if (isSince(habit.sort_updated_at, since)) {
+      change.sort = habit.sort ?? 0;
+      change.sort_updated_at = habit.sort_updated_at;
+      changed = true;
+    }
+    if (isSince(habit.deleted_at, since)) {
+      change.deleted_at = habit.deleted_at;
+      changed = true;
+    }
+    if (changed) {
+      changes[name] = change;
+    }
+  }
+  return changes;
+}
+
+function isSince(updated: number | undefined, since: number): boolean {
+  return !!updated && updated >= since;
+}
+
+// newest timestamp wins, same as the server merge
+function applyChanges(data: HabitMap, changes: HabitMap): boolean {
+  let changed = false;
+  for (const [name, remote] of Object.entries(changes)) {
+    const local: Habit = data[name] ?? { logs: {} };
+    let habitChanged = false;
+    for (const [day, count] of Object.entries(remote.logs ?? {})) {
+      const remoteAt = remote.logs_updated_at?.[day] ?? 0;
+      const localAt = local.logs_updated_at?.[day] ?? 0;
+      if (isNewer(count, remoteAt, local.logs[day] ?? 0, localAt)) {
+        local.logs[day] = count;
+        local.logs_updated_at = { ...local.logs_updated_at, [day]: remoteAt };
+        habitChanged = true;
+      }
+    }
+    if (
+      isNewer(
+        remote.weekly_goal ?? 0,
+        remote.weekly_goal_updated_at ?? 0,
+        local.weekly_goal ?? 0,
+        local.weekly_goal_updated_at ?? 0
+      )
+    ) {
+      local.weekly_goal = remote.weekly_goal;
+      local.weekly_goal_updated_at = remote.weekly_goal_updated_at;
+      habitChanged = true;
+    }
+    if (
+      isNewer(
+        remote.sort ?? 0,
+        remote.sort_updated_at ?? 0,
+        local.sort ?? 0,
+        local.sort_updated_at ?? 0
+      )
+    ) {
+      local.sort = remote.sort;
+      local.sort_updated_at = remote.sort_updated_at;
+      habitChanged = true;
+    }
+    if ((remote.deleted_at ?? 0) > (local.deleted_at ?? 0)) {
+      local.deleted_at = remote.deleted_at;
+      habitChanged = true;
+    }
+    if (habitChanged) {
+      data[name] = local;
+      changed = true;
+    }
+  }
+  return changed;
+}
+
+function isNewer(
+  value: number,
+  updated: number,
+  current: number,
+  currentUpdated: number
+): boolean {
+  if (!updated) {
+    return false;
+  }
+  return (
+    updated > currentUpdated || (updated === currentUpdated && value > current)
+  );
+}
@@ -0,0 +1,23 @@
+//
+// Code generated by go-jet DO NOT EDIT.
+//
+// WARNING: Changes to this file may cause incorrect behavior
+// and will be lost if the code is regenerated
+//
+
+package model
+
+import (
+	"time"
+)
+
+type APITokens struct {
+	TokenID    *int32 `sql:"primary_key"`
+	UserID     string
+	Name       string
+	TokenHash  string
+	Scopes     string
+	CreatedAt  *time.Time
+	LastUsedAt *time.Time
+	ExpiresAt  *time.Time
+}
@@ -0,0 +1,22 @@
+//
+// Code generated by go-jet DO NOT EDIT.
+//
+// WARNING: Changes to this file may cause incorrect behavior
+// and will be lost if the code is regenerated
+//
+
+package model
+
+import (
+	"time"
+)
+
+type AuthTokens struct {
+	TokenID   *int32 `sql:"primary_key"`
+	UserID    string
+	Purpose   string
+	TokenHash string
+	CreatedAt *time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
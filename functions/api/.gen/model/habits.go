@@ -12,8 +12,10 @@ import (
 )
 
 type Habits struct {
-	HabitID   *int32 `sql:"primary_key"`
-	UserID    string
-	Name      string
-	CreatedAt *time.Time
+	HabitID      *int32 `sql:"primary_key"`
+	UserID       string
+	Name         string
+	CreatedAt    *time.Time
+	Sort         int32
+	WeeklyTarget *int32
 }
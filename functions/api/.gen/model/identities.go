@@ -0,0 +1,20 @@
+//
+// Code generated by go-jet DO NOT EDIT.
+//
+// WARNING: Changes to this file may cause incorrect behavior
+// and will be lost if the code is regenerated
+//
+
+package model
+
+import (
+	"time"
+)
+
+type Identities struct {
+	Provider  string `sql:"primary_key"`
+	Subject   string `sql:"primary_key"`
+	UserID    string
+	Email     *string
+	CreatedAt *time.Time
+}
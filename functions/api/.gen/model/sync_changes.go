@@ -0,0 +1,20 @@
+//
+// Code generated by go-jet DO NOT EDIT.
+//
+// WARNING: Changes to this file may cause incorrect behavior
+// and will be lost if the code is regenerated
+//
+
+package model
+
+import (
+	"time"
+)
+
+type SyncChanges struct {
+	ChangeID  *int32 `sql:"primary_key"`
+	UserID    string
+	Habit     string
+	Data      string
+	CreatedAt *time.Time
+}
@@ -10,5 +10,6 @@ package model
 type UserSyncState struct {
 	UserID      *string `sql:"primary_key"`
 	Data        string
-	LastUpdated int32
+	LastUpdated int64
+	Version     int64
 }
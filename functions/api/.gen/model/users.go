@@ -12,6 +12,13 @@ import (
 )
 
 type Users struct {
-	UserID    *string `sql:"primary_key"`
-	CreatedAt *time.Time
+	UserID          *string `sql:"primary_key"`
+	CreatedAt       *time.Time
+	Email           *string
+	PasswordHash    *string
+	EmailVerifiedAt *time.Time
+	SessionVersion  int64
+	IsAnonymous     bool
+	MergedInto      *string
+	DeletedAt       *time.Time
 }
@@ -0,0 +1,99 @@
+//
+// Code generated by go-jet DO NOT EDIT.
+//
+// WARNING: Changes to this file may cause incorrect behavior
+// and will be lost if the code is regenerated
+//
+
+package table
+
+import (
+	"github.com/go-jet/jet/v2/sqlite"
+)
+
+var APITokens = newAPITokensTable("", "api_tokens", "")
+
+type aPITokensTable struct {
+	sqlite.Table
+
+	// Columns
+	TokenID    sqlite.ColumnInteger
+	UserID     sqlite.ColumnString
+	Name       sqlite.ColumnString
+	TokenHash  sqlite.ColumnString
+	Scopes     sqlite.ColumnString
+	CreatedAt  sqlite.ColumnTimestamp
+	LastUsedAt sqlite.ColumnTimestamp
+	ExpiresAt  sqlite.ColumnTimestamp
+
+	AllColumns     sqlite.ColumnList
+	MutableColumns sqlite.ColumnList
+	DefaultColumns sqlite.ColumnList
+}
+
+type APITokensTable struct {
+	aPITokensTable
+
+	EXCLUDED aPITokensTable
+}
+
+// AS creates new APITokensTable with assigned alias
+func (a APITokensTable) AS(alias string) *APITokensTable {
+	return newAPITokensTable(a.SchemaName(), a.TableName(), alias)
+}
+
+// Schema creates new APITokensTable with assigned schema name
+func (a APITokensTable) FromSchema(schemaName string) *APITokensTable {
+	return newAPITokensTable(schemaName, a.TableName(), a.Alias())
+}
+
+// WithPrefix creates new APITokensTable with assigned table prefix
+func (a APITokensTable) WithPrefix(prefix string) *APITokensTable {
+	return newAPITokensTable(a.SchemaName(), prefix+a.TableName(), a.TableName())
+}
+
+// WithSuffix creates new APITokensTable with assigned table suffix
+func (a APITokensTable) WithSuffix(suffix string) *APITokensTable {
+	return newAPITokensTable(a.SchemaName(), a.TableName()+suffix, a.TableName())
+}
+
+func newAPITokensTable(schemaName, tableName, alias string) *APITokensTable {
+	return &APITokensTable{
+		aPITokensTable: newAPITokensTableImpl(schemaName, tableName, alias),
+		EXCLUDED:       newAPITokensTableImpl("", "excluded", ""),
+	}
+}
+
+func newAPITokensTableImpl(schemaName, tableName, alias string) aPITokensTable {
+	var (
+		TokenIDColumn    = sqlite.IntegerColumn("token_id")
+		UserIDColumn     = sqlite.StringColumn("user_id")
+		NameColumn       = sqlite.StringColumn("name")
+		TokenHashColumn  = sqlite.StringColumn("token_hash")
+		ScopesColumn     = sqlite.StringColumn("scopes")
+		CreatedAtColumn  = sqlite.TimestampColumn("created_at")
+		LastUsedAtColumn = sqlite.TimestampColumn("last_used_at")
+		ExpiresAtColumn  = sqlite.TimestampColumn("expires_at")
+		allColumns       = sqlite.ColumnList{TokenIDColumn, UserIDColumn, NameColumn, TokenHashColumn, ScopesColumn, CreatedAtColumn, LastUsedAtColumn, ExpiresAtColumn}
+		mutableColumns   = sqlite.ColumnList{UserIDColumn, NameColumn, TokenHashColumn, ScopesColumn, CreatedAtColumn, LastUsedAtColumn, ExpiresAtColumn}
+		defaultColumns   = sqlite.ColumnList{CreatedAtColumn}
+	)
+
+	return aPITokensTable{
+		Table: sqlite.NewTable(schemaName, tableName, alias, allColumns...),
+
+		//Columns
+		TokenID:    TokenIDColumn,
+		UserID:     UserIDColumn,
+		Name:       NameColumn,
+		TokenHash:  TokenHashColumn,
+		Scopes:     ScopesColumn,
+		CreatedAt:  CreatedAtColumn,
+		LastUsedAt: LastUsedAtColumn,
+		ExpiresAt:  ExpiresAtColumn,
+
+		AllColumns:     allColumns,
+		MutableColumns: mutableColumns,
+		DefaultColumns: defaultColumns,
+	}
+}
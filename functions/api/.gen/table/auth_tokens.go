@@ -0,0 +1,96 @@
+//
+// Code generated by go-jet DO NOT EDIT.
+//
+// WARNING: Changes to this file may cause incorrect behavior
+// and will be lost if the code is regenerated
+//
+
+package table
+
+import (
+	"github.com/go-jet/jet/v2/sqlite"
+)
+
+var AuthTokens = newAuthTokensTable("", "auth_tokens", "")
+
+type authTokensTable struct {
+	sqlite.Table
+
+	// Columns
+	TokenID   sqlite.ColumnInteger
+	UserID    sqlite.ColumnString
+	Purpose   sqlite.ColumnString
+	TokenHash sqlite.ColumnString
+	CreatedAt sqlite.ColumnTimestamp
+	ExpiresAt sqlite.ColumnTimestamp
+	UsedAt    sqlite.ColumnTimestamp
+
+	AllColumns     sqlite.ColumnList
+	MutableColumns sqlite.ColumnList
+	DefaultColumns sqlite.ColumnList
+}
+
+type AuthTokensTable struct {
+	authTokensTable
+
+	EXCLUDED authTokensTable
+}
+
+// AS creates new AuthTokensTable with assigned alias
+func (a AuthTokensTable) AS(alias string) *AuthTokensTable {
+	return newAuthTokensTable(a.SchemaName(), a.TableName(), alias)
+}
+
+// Schema creates new AuthTokensTable with assigned schema name
+func (a AuthTokensTable) FromSchema(schemaName string) *AuthTokensTable {
+	return newAuthTokensTable(schemaName, a.TableName(), a.Alias())
+}
+
+// WithPrefix creates new AuthTokensTable with assigned table prefix
+func (a AuthTokensTable) WithPrefix(prefix string) *AuthTokensTable {
+	return newAuthTokensTable(a.SchemaName(), prefix+a.TableName(), a.TableName())
+}
+
+// WithSuffix creates new AuthTokensTable with assigned table suffix
+func (a AuthTokensTable) WithSuffix(suffix string) *AuthTokensTable {
+	return newAuthTokensTable(a.SchemaName(), a.TableName()+suffix, a.TableName())
+}
+
+func newAuthTokensTable(schemaName, tableName, alias string) *AuthTokensTable {
+	return &AuthTokensTable{
+		authTokensTable: newAuthTokensTableImpl(schemaName, tableName, alias),
+		EXCLUDED:        newAuthTokensTableImpl("", "excluded", ""),
+	}
+}
+
+func newAuthTokensTableImpl(schemaName, tableName, alias string) authTokensTable {
+	var (
+		TokenIDColumn   = sqlite.IntegerColumn("token_id")
+		UserIDColumn    = sqlite.StringColumn("user_id")
+		PurposeColumn   = sqlite.StringColumn("purpose")
+		TokenHashColumn = sqlite.StringColumn("token_hash")
+		CreatedAtColumn = sqlite.TimestampColumn("created_at")
+		ExpiresAtColumn = sqlite.TimestampColumn("expires_at")
+		UsedAtColumn    = sqlite.TimestampColumn("used_at")
+		allColumns      = sqlite.ColumnList{TokenIDColumn, UserIDColumn, PurposeColumn, TokenHashColumn, CreatedAtColumn, ExpiresAtColumn, UsedAtColumn}
+		mutableColumns  = sqlite.ColumnList{UserIDColumn, PurposeColumn, TokenHashColumn, CreatedAtColumn, ExpiresAtColumn, UsedAtColumn}
+		defaultColumns  = sqlite.ColumnList{CreatedAtColumn}
+	)
+
+	return authTokensTable{
+		Table: sqlite.NewTable(schemaName, tableName, alias, allColumns...),
+
+		//Columns
+		TokenID:   TokenIDColumn,
+		UserID:    UserIDColumn,
+		Purpose:   PurposeColumn,
+		TokenHash: TokenHashColumn,
+		CreatedAt: CreatedAtColumn,
+		ExpiresAt: ExpiresAtColumn,
+		UsedAt:    UsedAtColumn,
+
+		AllColumns:     allColumns,
+		MutableColumns: mutableColumns,
+		DefaultColumns: defaultColumns,
+	}
+}
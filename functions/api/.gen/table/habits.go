@@ -17,10 +17,12 @@ type habitsTable struct {
 	sqlite.Table
 
 	// Columns
-	HabitID   sqlite.ColumnInteger
-	UserID    sqlite.ColumnString
-	Name      sqlite.ColumnString
-	CreatedAt sqlite.ColumnTimestamp
+	HabitID      sqlite.ColumnInteger
+	UserID       sqlite.ColumnString
+	Name         sqlite.ColumnString
+	CreatedAt    sqlite.ColumnTimestamp
+	Sort         sqlite.ColumnInteger
+	WeeklyTarget sqlite.ColumnInteger
 
 	AllColumns     sqlite.ColumnList
 	MutableColumns sqlite.ColumnList
@@ -62,23 +64,27 @@ func newHabitsTable(schemaName, tableName, alias string) *HabitsTable {
 
 func newHabitsTableImpl(schemaName, tableName, alias string) habitsTable {
 	var (
-		HabitIDColumn   = sqlite.IntegerColumn("habit_id")
-		UserIDColumn    = sqlite.StringColumn("user_id")
-		NameColumn      = sqlite.StringColumn("name")
-		CreatedAtColumn = sqlite.TimestampColumn("created_at")
-		allColumns      = sqlite.ColumnList{HabitIDColumn, UserIDColumn, NameColumn, CreatedAtColumn}
-		mutableColumns  = sqlite.ColumnList{UserIDColumn, NameColumn, CreatedAtColumn}
-		defaultColumns  = sqlite.ColumnList{CreatedAtColumn}
+		HabitIDColumn      = sqlite.IntegerColumn("habit_id")
+		UserIDColumn       = sqlite.StringColumn("user_id")
+		NameColumn         = sqlite.StringColumn("name")
+		CreatedAtColumn    = sqlite.TimestampColumn("created_at")
+		SortColumn         = sqlite.IntegerColumn("sort")
+		WeeklyTargetColumn = sqlite.IntegerColumn("weekly_target")
+		allColumns         = sqlite.ColumnList{HabitIDColumn, UserIDColumn, NameColumn, CreatedAtColumn, SortColumn, WeeklyTargetColumn}
+		mutableColumns     = sqlite.ColumnList{UserIDColumn, NameColumn, CreatedAtColumn, SortColumn, WeeklyTargetColumn}
+		defaultColumns     = sqlite.ColumnList{CreatedAtColumn, SortColumn}
 	)
 
 	return habitsTable{
 		Table: sqlite.NewTable(schemaName, tableName, alias, allColumns...),
 
 		//Columns
-		HabitID:   HabitIDColumn,
-		UserID:    UserIDColumn,
-		Name:      NameColumn,
-		CreatedAt: CreatedAtColumn,
+		HabitID:      HabitIDColumn,
+		UserID:       UserIDColumn,
+		Name:         NameColumn,
+		CreatedAt:    CreatedAtColumn,
+		Sort:         SortColumn,
+		WeeklyTarget: WeeklyTargetColumn,
 
 		AllColumns:     allColumns,
 		MutableColumns: mutableColumns,
@@ -0,0 +1,90 @@
+//
+// Code generated by go-jet DO NOT EDIT.
+//
+// WARNING: Changes to this file may cause incorrect behavior
+// and will be lost if the code is regenerated
+//
+
+package table
+
+import (
+	"github.com/go-jet/jet/v2/sqlite"
+)
+
+var Identities = newIdentitiesTable("", "identities", "")
+
+type identitiesTable struct {
+	sqlite.Table
+
+	// Columns
+	Provider  sqlite.ColumnString
+	Subject   sqlite.ColumnString
+	UserID    sqlite.ColumnString
+	Email     sqlite.ColumnString
+	CreatedAt sqlite.ColumnTimestamp
+
+	AllColumns     sqlite.ColumnList
+	MutableColumns sqlite.ColumnList
+	DefaultColumns sqlite.ColumnList
+}
+
+type IdentitiesTable struct {
+	identitiesTable
+
+	EXCLUDED identitiesTable
+}
+
+// AS creates new IdentitiesTable with assigned alias
+func (a IdentitiesTable) AS(alias string) *IdentitiesTable {
+	return newIdentitiesTable(a.SchemaName(), a.TableName(), alias)
+}
+
+// Schema creates new IdentitiesTable with assigned schema name
+func (a IdentitiesTable) FromSchema(schemaName string) *IdentitiesTable {
+	return newIdentitiesTable(schemaName, a.TableName(), a.Alias())
+}
+
+// WithPrefix creates new IdentitiesTable with assigned table prefix
+func (a IdentitiesTable) WithPrefix(prefix string) *IdentitiesTable {
+	return newIdentitiesTable(a.SchemaName(), prefix+a.TableName(), a.TableName())
+}
+
+// WithSuffix creates new IdentitiesTable with assigned table suffix
+func (a IdentitiesTable) WithSuffix(suffix string) *IdentitiesTable {
+	return newIdentitiesTable(a.SchemaName(), a.TableName()+suffix, a.TableName())
+}
+
+func newIdentitiesTable(schemaName, tableName, alias string) *IdentitiesTable {
+	return &IdentitiesTable{
+		identitiesTable: newIdentitiesTableImpl(schemaName, tableName, alias),
+		EXCLUDED:        newIdentitiesTableImpl("", "excluded", ""),
+	}
+}
+
+func newIdentitiesTableImpl(schemaName, tableName, alias string) identitiesTable {
+	var (
+		ProviderColumn  = sqlite.StringColumn("provider")
+		SubjectColumn   = sqlite.StringColumn("subject")
+		UserIDColumn    = sqlite.StringColumn("user_id")
+		EmailColumn     = sqlite.StringColumn("email")
+		CreatedAtColumn = sqlite.TimestampColumn("created_at")
+		allColumns      = sqlite.ColumnList{ProviderColumn, SubjectColumn, UserIDColumn, EmailColumn, CreatedAtColumn}
+		mutableColumns  = sqlite.ColumnList{UserIDColumn, EmailColumn, CreatedAtColumn}
+		defaultColumns  = sqlite.ColumnList{CreatedAtColumn}
+	)
+
+	return identitiesTable{
+		Table: sqlite.NewTable(schemaName, tableName, alias, allColumns...),
+
+		//Columns
+		Provider:  ProviderColumn,
+		Subject:   SubjectColumn,
+		UserID:    UserIDColumn,
+		Email:     EmailColumn,
+		CreatedAt: CreatedAtColumn,
+
+		AllColumns:     allColumns,
+		MutableColumns: mutableColumns,
+		DefaultColumns: defaultColumns,
+	}
+}
@@ -0,0 +1,90 @@
+//
+// Code generated by go-jet DO NOT EDIT.
+//
+// WARNING: Changes to this file may cause incorrect behavior
+// and will be lost if the code is regenerated
+//
+
+package table
+
+import (
+	"github.com/go-jet/jet/v2/sqlite"
+)
+
+var SyncChanges = newSyncChangesTable("", "sync_changes", "")
+
+type syncChangesTable struct {
+	sqlite.Table
+
+	// Columns
+	ChangeID  sqlite.ColumnInteger
+	UserID    sqlite.ColumnString
+	Habit     sqlite.ColumnString
+	Data      sqlite.ColumnString
+	CreatedAt sqlite.ColumnTimestamp
+
+	AllColumns     sqlite.ColumnList
+	MutableColumns sqlite.ColumnList
+	DefaultColumns sqlite.ColumnList
+}
+
+type SyncChangesTable struct {
+	syncChangesTable
+
+	EXCLUDED syncChangesTable
+}
+
+// AS creates new SyncChangesTable with assigned alias
+func (a SyncChangesTable) AS(alias string) *SyncChangesTable {
+	return newSyncChangesTable(a.SchemaName(), a.TableName(), alias)
+}
+
+// Schema creates new SyncChangesTable with assigned schema name
+func (a SyncChangesTable) FromSchema(schemaName string) *SyncChangesTable {
+	return newSyncChangesTable(schemaName, a.TableName(), a.Alias())
+}
+
+// WithPrefix creates new SyncChangesTable with assigned table prefix
+func (a SyncChangesTable) WithPrefix(prefix string) *SyncChangesTable {
+	return newSyncChangesTable(a.SchemaName(), prefix+a.TableName(), a.TableName())
+}
+
+// WithSuffix creates new SyncChangesTable with assigned table suffix
+func (a SyncChangesTable) WithSuffix(suffix string) *SyncChangesTable {
+	return newSyncChangesTable(a.SchemaName(), a.TableName()+suffix, a.TableName())
+}
+
+func newSyncChangesTable(schemaName, tableName, alias string) *SyncChangesTable {
+	return &SyncChangesTable{
+		syncChangesTable: newSyncChangesTableImpl(schemaName, tableName, alias),
+		EXCLUDED:         newSyncChangesTableImpl("", "excluded", ""),
+	}
+}
+
+func newSyncChangesTableImpl(schemaName, tableName, alias string) syncChangesTable {
+	var (
+		ChangeIDColumn  = sqlite.IntegerColumn("change_id")
+		UserIDColumn    = sqlite.StringColumn("user_id")
+		HabitColumn     = sqlite.StringColumn("habit")
+		DataColumn      = sqlite.StringColumn("data")
+		CreatedAtColumn = sqlite.TimestampColumn("created_at")
+		allColumns      = sqlite.ColumnList{ChangeIDColumn, UserIDColumn, HabitColumn, DataColumn, CreatedAtColumn}
+		mutableColumns  = sqlite.ColumnList{UserIDColumn, HabitColumn, DataColumn, CreatedAtColumn}
+		defaultColumns  = sqlite.ColumnList{CreatedAtColumn}
+	)
+
+	return syncChangesTable{
+		Table: sqlite.NewTable(schemaName, tableName, alias, allColumns...),
+
+		//Columns
+		ChangeID:  ChangeIDColumn,
+		UserID:    UserIDColumn,
+		Habit:     HabitColumn,
+		Data:      DataColumn,
+		CreatedAt: CreatedAtColumn,
+
+		AllColumns:     allColumns,
+		MutableColumns: mutableColumns,
+		DefaultColumns: defaultColumns,
+	}
+}
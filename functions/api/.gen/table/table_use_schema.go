@@ -10,8 +10,12 @@ package table
 // UseSchema sets a new schema name for all generated table SQL builder types. It is recommended to invoke
 // this method only once at the beginning of the program.
 func UseSchema(schema string) {
+	APITokens = APITokens.FromSchema(schema)
+	AuthTokens = AuthTokens.FromSchema(schema)
 	HabitLogs = HabitLogs.FromSchema(schema)
 	Habits = Habits.FromSchema(schema)
+	Identities = Identities.FromSchema(schema)
+	SyncChanges = SyncChanges.FromSchema(schema)
 	UserSyncState = UserSyncState.FromSchema(schema)
 	Users = Users.FromSchema(schema)
 }
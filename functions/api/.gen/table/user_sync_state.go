@@ -20,6 +20,7 @@ type userSyncStateTable struct {
 	UserID      sqlite.ColumnString
 	Data        sqlite.ColumnString
 	LastUpdated sqlite.ColumnInteger
+	Version     sqlite.ColumnInteger
 
 	AllColumns     sqlite.ColumnList
 	MutableColumns sqlite.ColumnList
@@ -64,9 +65,10 @@ func newUserSyncStateTableImpl(schemaName, tableName, alias string) userSyncStat
 		UserIDColumn      = sqlite.StringColumn("user_id")
 		DataColumn        = sqlite.StringColumn("data")
 		LastUpdatedColumn = sqlite.IntegerColumn("last_updated")
-		allColumns        = sqlite.ColumnList{UserIDColumn, DataColumn, LastUpdatedColumn}
-		mutableColumns    = sqlite.ColumnList{DataColumn, LastUpdatedColumn}
-		defaultColumns    = sqlite.ColumnList{}
+		VersionColumn     = sqlite.IntegerColumn("version")
+		allColumns        = sqlite.ColumnList{UserIDColumn, DataColumn, LastUpdatedColumn, VersionColumn}
+		mutableColumns    = sqlite.ColumnList{DataColumn, LastUpdatedColumn, VersionColumn}
+		defaultColumns    = sqlite.ColumnList{VersionColumn}
 	)
 
 	return userSyncStateTable{
@@ -76,6 +78,7 @@ func newUserSyncStateTableImpl(schemaName, tableName, alias string) userSyncStat
 		UserID:      UserIDColumn,
 		Data:        DataColumn,
 		LastUpdated: LastUpdatedColumn,
+		Version:     VersionColumn,
 
 		AllColumns:     allColumns,
 		MutableColumns: mutableColumns,
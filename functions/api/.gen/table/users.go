@@ -17,8 +17,15 @@ type usersTable struct {
 	sqlite.Table
 
 	// Columns
-	UserID    sqlite.ColumnString
-	CreatedAt sqlite.ColumnTimestamp
+	UserID          sqlite.ColumnString
+	CreatedAt       sqlite.ColumnTimestamp
+	Email           sqlite.ColumnString
+	PasswordHash    sqlite.ColumnString
+	EmailVerifiedAt sqlite.ColumnTimestamp
+	SessionVersion  sqlite.ColumnInteger
+	IsAnonymous     sqlite.ColumnBool
+	MergedInto      sqlite.ColumnString
+	DeletedAt       sqlite.ColumnTimestamp
 
 	AllColumns     sqlite.ColumnList
 	MutableColumns sqlite.ColumnList
@@ -60,19 +67,33 @@ func newUsersTable(schemaName, tableName, alias string) *UsersTable {
 
 func newUsersTableImpl(schemaName, tableName, alias string) usersTable {
 	var (
-		UserIDColumn    = sqlite.StringColumn("user_id")
-		CreatedAtColumn = sqlite.TimestampColumn("created_at")
-		allColumns      = sqlite.ColumnList{UserIDColumn, CreatedAtColumn}
-		mutableColumns  = sqlite.ColumnList{CreatedAtColumn}
-		defaultColumns  = sqlite.ColumnList{CreatedAtColumn}
+		UserIDColumn          = sqlite.StringColumn("user_id")
+		CreatedAtColumn       = sqlite.TimestampColumn("created_at")
+		EmailColumn           = sqlite.StringColumn("email")
+		PasswordHashColumn    = sqlite.StringColumn("password_hash")
+		EmailVerifiedAtColumn = sqlite.TimestampColumn("email_verified_at")
+		SessionVersionColumn  = sqlite.IntegerColumn("session_version")
+		IsAnonymousColumn     = sqlite.BoolColumn("is_anonymous")
+		MergedIntoColumn      = sqlite.StringColumn("merged_into")
+		DeletedAtColumn       = sqlite.TimestampColumn("deleted_at")
+		allColumns            = sqlite.ColumnList{UserIDColumn, CreatedAtColumn, EmailColumn, PasswordHashColumn, EmailVerifiedAtColumn, SessionVersionColumn, IsAnonymousColumn, MergedIntoColumn, DeletedAtColumn}
+		mutableColumns        = sqlite.ColumnList{CreatedAtColumn, EmailColumn, PasswordHashColumn, EmailVerifiedAtColumn, SessionVersionColumn, IsAnonymousColumn, MergedIntoColumn, DeletedAtColumn}
+		defaultColumns        = sqlite.ColumnList{CreatedAtColumn, SessionVersionColumn, IsAnonymousColumn}
 	)
 
 	return usersTable{
 		Table: sqlite.NewTable(schemaName, tableName, alias, allColumns...),
 
 		//Columns
-		UserID:    UserIDColumn,
-		CreatedAt: CreatedAtColumn,
+		UserID:          UserIDColumn,
+		CreatedAt:       CreatedAtColumn,
+		Email:           EmailColumn,
+		PasswordHash:    PasswordHashColumn,
+		EmailVerifiedAt: EmailVerifiedAtColumn,
+		SessionVersion:  SessionVersionColumn,
+		IsAnonymous:     IsAnonymousColumn,
+		MergedInto:      MergedIntoColumn,
+		DeletedAt:       DeletedAtColumn,
 
 		AllColumns:     allColumns,
 		MutableColumns: mutableColumns,
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/joho/godotenv"
+
+	"tabit-serverless/tabit"
+)
+
+// Fills the habits and habit_logs tables from the sync state of existing users
+func main() {
+	err := godotenv.Load()
+	if err != nil {
+		slog.Warn("Failed to load env", "err", err)
+	}
+
+	user := flag.String("user", "", "only backfill this user id")
+	flag.Parse()
+
+	cfg, err := tabit.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(tabit.NewLogger(os.Stderr, cfg.Log))
+	ds, err := tabit.NewDataStoreFromConfig(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer ds.Close()
+
+	ctx := context.Background()
+	users := []string{*user}
+	if *user == "" {
+		var db_err *tabit.HTTPError
+		users, db_err = ds.SyncedUsers(ctx)
+		if db_err != nil {
+			log.Fatalf("Failed to list users: %v", db_err)
+		}
+	}
+
+	failed := 0
+	for _, user_id := range users {
+		// each user is projected in its own transaction so one bad document does not stop the rest
+		if db_err := ds.ProjectSyncState(ctx, user_id); db_err != nil {
+			slog.Error("Failed to backfill user", "user", user_id, "err", db_err)
+			failed++
+		}
+	}
+	slog.Info("Backfill finished", "users", len(users), "failed", failed)
+	if failed > 0 {
+		log.Fatalf("%d of %d users failed", failed, len(users))
+	}
+}
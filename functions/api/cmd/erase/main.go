@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/joho/godotenv"
+
+	"tabit-serverless/tabit"
+)
+
+// Erases a user the same way as DELETE /api/account, for privacy requests
+func main() {
+	err := godotenv.Load()
+	if err != nil {
+		slog.Warn("Failed to load env", "err", err)
+	}
+
+	user := flag.String("user", "", "id of the user to erase")
+	flag.Parse()
+	if *user == "" {
+		log.Fatal("-user is required")
+	}
+
+	cfg, err := tabit.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(tabit.NewLogger(os.Stderr, cfg.Log))
+	ds, err := tabit.NewDataStoreFromConfig(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer ds.Close()
+
+	if db_err := ds.DeleteUser(context.Background(), *user); db_err != nil {
+		log.Fatalf("Failed to erase user %s: %v", *user, db_err)
+	}
+	slog.Info("Erased user", "user", *user)
+}
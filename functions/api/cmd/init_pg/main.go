@@ -4,10 +4,13 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+
+	"tabit-serverless/tabit"
 )
 
 const (
@@ -15,6 +18,7 @@ const (
 )
 
 func main() {
+	slog.SetDefault(tabit.NewLogger(os.Stderr, tabit.LogConfig{}))
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatalf("Error loading .env file: %v", err)
@@ -37,7 +41,7 @@ func initDB() (*sql.DB, error) {
 		os.Getenv("DB_PASSWORD"),
 		os.Getenv("DB_NAME"),
 	)
-	fmt.Println(connStr)
+	log.Printf("Connecting to %s/%s as %s", os.Getenv("DB_HOST"), os.Getenv("DB_NAME"), os.Getenv("DB_USER"))
 
 	// Open database connection
 	db, err := sql.Open("postgres", connStr)
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+
+	"tabit-serverless/tabit"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+// Serves the API over plain net/http for hosts without lambda
+func main() {
+	err := godotenv.Load()
+	if err != nil {
+		slog.Warn("Failed to load env", "err", err)
+	}
+
+	cfg, err := tabit.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(tabit.NewLogger(os.Stderr, cfg.Log))
+	tracing, err := tabit.SetupTracing(context.Background(), cfg.Tracing)
+	if err != nil {
+		log.Fatalf("Failed to initialize tracing: %v", err)
+	}
+	addr := flag.String("addr", cfg.ListenAddr, "address to listen on")
+	flag.Parse()
+
+	ds, err := tabit.NewDataStoreFromConfig(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	auth, err := tabit.NewAuth(cfg, ds)
+	if err != nil {
+		log.Fatalf("Failed to initialize auth: %v", err)
+	}
+	defer ds.Close()
+
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           tabit.NewRouter(cfg, ds, auth),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	go func() {
+		slog.Info("Listening", "addr", *addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	slog.Info("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to shut down cleanly", "err", err)
+	}
+	if err := tabit.PushMetrics(shutdownCtx, cfg.Metrics); err != nil {
+		slog.Error("Failed to push metrics", "err", err)
+	}
+	if err := tracing.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to shut down tracing", "err", err)
+	}
+}
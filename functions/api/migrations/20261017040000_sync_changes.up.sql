@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS sync_changes (
+    change_id BIGSERIAL PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    habit TEXT NOT NULL,
+    data jsonb NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sync_changes_user_id ON sync_changes(user_id, change_id);
@@ -0,0 +1,2 @@
+ALTER TABLE user_sync_state
+    DROP COLUMN version;
@@ -0,0 +1,2 @@
+ALTER TABLE user_sync_state
+ADD COLUMN version BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+ALTER TABLE users
+ADD COLUMN email TEXT UNIQUE,
+ADD COLUMN password_hash TEXT;
@@ -0,0 +1,16 @@
+ALTER TABLE users
+ADD COLUMN email_verified_at TIMESTAMP,
+ADD COLUMN session_version BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS auth_tokens (
+    token_id SERIAL PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    purpose TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_auth_tokens_user_id ON auth_tokens(user_id, purpose);
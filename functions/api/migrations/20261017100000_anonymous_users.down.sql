@@ -0,0 +1,3 @@
+ALTER TABLE users
+    DROP COLUMN merged_into,
+    DROP COLUMN is_anonymous;
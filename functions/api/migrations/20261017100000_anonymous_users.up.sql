@@ -0,0 +1,3 @@
+ALTER TABLE users
+ADD COLUMN is_anonymous BOOLEAN NOT NULL DEFAULT FALSE,
+ADD COLUMN merged_into TEXT REFERENCES users(user_id);
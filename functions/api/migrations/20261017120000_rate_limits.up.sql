@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS rate_limits (
+    key TEXT PRIMARY KEY, -- route, and the user id or client ip
+    full_at TIMESTAMP NOT NULL -- when the token bucket is full again
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_limits_full_at ON rate_limits(full_at);
@@ -0,0 +1,118 @@
+// Package stats summarizes a habit's daily logs for reports
+package stats
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"tabit-serverless/streak"
+)
+
+// DefaultWindows are the periods reported when none are requested
+var DefaultWindows = []int{7, 30, 90, 365}
+
+// MaxWindow is the longest period that can be requested, in days
+const MaxWindow = 3660
+
+// movingAverageDays is the length of the trailing average
+const movingAverageDays = 7
+
+type Stats struct {
+	Total         int                `json:"total"`
+	DaysLogged    int                `json:"days_logged"`
+	BestStreak    int                `json:"best_streak"` // Longest run of consecutive logged days
+	CurrentStreak streak.Info        `json:"current_streak"`
+	Windows       []Window           `json:"windows"`
+	MovingAverage []Average          `json:"moving_average"` // 7 day average for each day of the longest window
+	Weekdays      map[string]int     `json:"weekdays"`       // Total logged on each weekday
+	WeeklyGoal    *streak.WeeklyGoal `json:"weekly_goal,omitempty"`
+}
+
+// Window covers the given number of days up to and including today
+type Window struct {
+	Days           int     `json:"days"`
+	Total          int     `json:"total"`
+	DaysLogged     int     `json:"days_logged"`
+	CompletionRate float64 `json:"completion_rate"` // Share of days with a log, from 0 to 1
+}
+
+type Average struct {
+	Day     string  `json:"day"` // Format: YYYY-MM-DD
+	Average float64 `json:"average"`
+}
+
+// Compute summarizes logs as of today.
+// weekly_target is optional and only fills in WeeklyGoal
+func Compute(logs map[string]int, weekly_target int, windows []int, today time.Time) Stats {
+	today = startOfDay(today)
+	days := make(map[time.Time]int, len(logs))
+	for key, count := range logs {
+		day, err := time.Parse(time.DateOnly, key)
+		if err != nil || count <= 0 {
+			continue
+		}
+		days[day] = count
+	}
+
+	result := Stats{
+		CurrentStreak: streak.Calculate(logs, today),
+		Windows:       make([]Window, 0, len(windows)),
+		Weekdays:      make(map[string]int, 7),
+		WeeklyGoal:    streak.Weekly(logs, weekly_target, today),
+	}
+	for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+		result.Weekdays[strings.ToLower(weekday.String())] = 0
+	}
+	for day, count := range days {
+		result.Total += count
+		result.DaysLogged++
+		result.Weekdays[strings.ToLower(day.Weekday().String())] += count
+		// only the first day of a run walks it, so every run is counted once
+		if days[day.AddDate(0, 0, -1)] > 0 {
+			continue
+		}
+		run := 1
+		for days[day.AddDate(0, 0, run)] > 0 {
+			run++
+		}
+		result.BestStreak = max(result.BestStreak, run)
+	}
+
+	longest := 0
+	for _, length := range windows {
+		window := Window{Days: length}
+		for i := range length {
+			if count := days[today.AddDate(0, 0, -i)]; count > 0 {
+				window.Total += count
+				window.DaysLogged++
+			}
+		}
+		window.CompletionRate = round(float64(window.DaysLogged) / float64(length))
+		result.Windows = append(result.Windows, window)
+		longest = max(longest, length)
+	}
+
+	result.MovingAverage = make([]Average, 0, longest)
+	for i := longest - 1; i >= 0; i-- {
+		day := today.AddDate(0, 0, -i)
+		sum := 0
+		for j := range movingAverageDays {
+			sum += days[day.AddDate(0, 0, -j)]
+		}
+		result.MovingAverage = append(result.MovingAverage, Average{
+			Day:     day.Format(time.DateOnly),
+			Average: round(float64(sum) / movingAverageDays),
+		})
+	}
+	return result
+}
+
+func round(value float64) float64 {
+	return math.Round(value*100) / 100
+}
+
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
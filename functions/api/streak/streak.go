@@ -0,0 +1,124 @@
+// Package streak computes habit streaks and weekly goal progress from daily logs.
+// It follows the rules of the web client so both show the same numbers
+package streak
+
+import (
+	"slices"
+	"time"
+)
+
+type Type string
+
+const (
+	None Type = "none"
+	Day  Type = "day"
+	Week Type = "week"
+)
+
+type Info struct {
+	Type  Type   `json:"type"`
+	Count int    `json:"count"`
+	Last  string `json:"last,omitempty"` // Latest logged day when there is no streak. Format: YYYY-MM-DD
+}
+
+type WeeklyGoal struct {
+	Goal      int  `json:"goal"`
+	Count     int  `json:"count"` // Sum of the logs from monday up to today
+	Completed bool `json:"completed"`
+}
+
+// Calculate returns the current streak as of today.
+// A run of more than one day is a day streak, otherwise a run of more than one week is a week streak.
+// Nothing logged today means there is no streak yet
+func Calculate(logs map[string]int, today time.Time) Info {
+	days := loggedDays(logs)
+	if len(days) == 0 {
+		return Info{Type: None}
+	}
+
+	today = startOfDay(today)
+	if logs[today.Format(time.DateOnly)] <= 0 {
+		// show when last was
+		return Info{Type: None, Last: days[len(days)-1].Format(time.DateOnly)}
+	}
+
+	daily := dailyStreak(logs, today)
+	if daily > 1 {
+		return Info{Type: Day, Count: daily}
+	}
+
+	weekly := weeklyStreak(days, today)
+	if weekly > 1 {
+		return Info{Type: Week, Count: weekly}
+	}
+
+	return Info{Type: Day, Count: daily}
+}
+
+// Weekly returns the progress towards goal for the ISO week containing today.
+// It returns nil when there is no goal
+func Weekly(logs map[string]int, goal int, today time.Time) *WeeklyGoal {
+	if goal <= 0 {
+		return nil
+	}
+	today = startOfDay(today)
+	monday := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+
+	count := 0
+	for day := today; !day.Before(monday); day = day.AddDate(0, 0, -1) {
+		if logged := logs[day.Format(time.DateOnly)]; logged > 0 {
+			count += logged
+		}
+	}
+	return &WeeklyGoal{Goal: goal, Count: count, Completed: count >= goal}
+}
+
+// loggedDays returns the valid days with a positive count, oldest first
+func loggedDays(logs map[string]int) []time.Time {
+	days := make([]time.Time, 0, len(logs))
+	for key, count := range logs {
+		if count <= 0 {
+			continue
+		}
+		day, err := time.Parse(time.DateOnly, key)
+		if err != nil {
+			continue
+		}
+		days = append(days, day)
+	}
+	slices.SortFunc(days, func(a, b time.Time) int { return a.Compare(b) })
+	return days
+}
+
+func dailyStreak(logs map[string]int, today time.Time) int {
+	streak := 0
+	for day := today; logs[day.Format(time.DateOnly)] > 0; day = day.AddDate(0, 0, -1) {
+		streak++
+	}
+	return streak
+}
+
+// weeklyStreak counts consecutive ISO weeks with at least one log, ending with the current week
+func weeklyStreak(days []time.Time, today time.Time) int {
+	type isoWeek struct{ year, week int }
+	weeks := make(map[isoWeek]bool, len(days))
+	for _, day := range days {
+		year, week := day.ISOWeek()
+		weeks[isoWeek{year, week}] = true
+	}
+
+	streak := 0
+	for day := today; ; day = day.AddDate(0, 0, -7) {
+		year, week := day.ISOWeek()
+		if !weeks[isoWeek{year, week}] {
+			return streak
+		}
+		streak++
+	}
+}
+
+// startOfDay drops the time so days can be compared with the parsed log keys
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,107 @@
+package streak
+
+import (
+	"testing"
+	"time"
+)
+
+// wednesday is in ISO week 3 of 2026, which started on monday the 12th
+var wednesday = time.Date(2026, 1, 14, 18, 30, 0, 0, time.UTC)
+
+func TestCalculate(t *testing.T) {
+	tests := []struct {
+		name  string
+		logs  map[string]int
+		today time.Time
+		want  Info
+	}{
+		{name: "nothing logged", logs: map[string]int{}, today: wednesday, want: Info{Type: None}},
+		{name: "only zero counts", logs: map[string]int{"2026-01-14": 0}, today: wednesday, want: Info{Type: None}},
+		{
+			name:  "nothing today shows the last day",
+			logs:  map[string]int{"2026-01-10": 1, "2026-01-12": 1, "2026-01-13": 0},
+			today: wednesday,
+			want:  Info{Type: None, Last: "2026-01-12"},
+		},
+		{name: "today only", logs: map[string]int{"2026-01-14": 1}, today: wednesday, want: Info{Type: Day, Count: 1}},
+		{
+			name:  "consecutive days",
+			logs:  map[string]int{"2026-01-11": 1, "2026-01-12": 2, "2026-01-13": 1, "2026-01-14": 3},
+			today: wednesday,
+			want:  Info{Type: Day, Count: 4},
+		},
+		{
+			name:  "a gap ends the day streak",
+			logs:  map[string]int{"2026-01-11": 1, "2026-01-13": 1, "2026-01-14": 1},
+			today: wednesday,
+			want:  Info{Type: Day, Count: 2},
+		},
+		{
+			name:  "consecutive weeks across the new year",
+			logs:  map[string]int{"2025-12-29": 1, "2026-01-07": 1, "2026-01-14": 1},
+			today: wednesday,
+			want:  Info{Type: Week, Count: 3},
+		},
+		{
+			name:  "a week without logs ends the week streak",
+			logs:  map[string]int{"2025-12-31": 1, "2026-01-14": 1},
+			today: wednesday,
+			want:  Info{Type: Day, Count: 1},
+		},
+		{
+			name:  "invalid days are ignored",
+			logs:  map[string]int{"yesterday": 1, "2026-01-14": 1},
+			today: wednesday,
+			want:  Info{Type: Day, Count: 1},
+		},
+		{
+			name:  "today is the calendar day of its own location",
+			logs:  map[string]int{"2026-01-14": 1},
+			today: time.Date(2026, 1, 14, 23, 0, 0, 0, time.FixedZone("UTC-8", -8*60*60)),
+			want:  Info{Type: Day, Count: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Calculate(tt.logs, tt.today); got != tt.want {
+				t.Errorf("Calculate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeekly(t *testing.T) {
+	week := map[string]int{
+		"2026-01-11": 5, // sunday of the week before
+		"2026-01-12": 1,
+		"2026-01-13": 2,
+		"2026-01-14": 1,
+		"2026-01-15": 4, // after today
+	}
+
+	tests := []struct {
+		name  string
+		logs  map[string]int
+		goal  int
+		today time.Time
+		want  *WeeklyGoal
+	}{
+		{name: "no goal", logs: week, goal: 0, today: wednesday, want: nil},
+		{name: "a negative goal is no goal", logs: week, goal: -1, today: wednesday, want: nil},
+		{name: "counts from monday up to today", logs: week, goal: 5, today: wednesday, want: &WeeklyGoal{Goal: 5, Count: 4}},
+		{name: "reaching the goal completes it", logs: week, goal: 4, today: wednesday, want: &WeeklyGoal{Goal: 4, Count: 4, Completed: true}},
+		{name: "monday only counts itself", logs: week, goal: 1, today: time.Date(2026, 1, 12, 0, 0, 0, 0, time.UTC), want: &WeeklyGoal{Goal: 1, Count: 1, Completed: true}},
+		{name: "sunday counts the whole week", logs: week, goal: 9, today: time.Date(2026, 1, 18, 0, 0, 0, 0, time.UTC), want: &WeeklyGoal{Goal: 9, Count: 8}},
+		{name: "negative counts are ignored", logs: map[string]int{"2026-01-13": -3, "2026-01-14": 1}, goal: 1, today: wednesday, want: &WeeklyGoal{Goal: 1, Count: 1, Completed: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Weekly(tt.logs, tt.goal, tt.today)
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("Weekly() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,1246 @@
+package tabit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"tabit-serverless/stats"
+)
+
+type HTTPError struct {
+	Code    int    // HTTP status code
+	Message string // Error message
+	Err     error  // Underlying error (optional)
+}
+
+// Error satisfies the error interface
+func (e *HTTPError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("HTTP error %d: %s: %v", e.Code, e.Message, e.Err)
+	}
+	return fmt.Sprintf("HTTP error %d: %s", e.Code, e.Message)
+}
+
+// Unwrap allows errors.Is and errors.As to work with wrapped errors
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// Request and response types
+type CreateHabitRequest struct {
+	Name         string `json:"name"`
+	Sort         *int   `json:"sort"`
+	WeeklyTarget *int   `json:"weekly_target"`
+}
+
+// UpdateHabitRequest only changes the fields that are present
+type UpdateHabitRequest struct {
+	Name         *string `json:"name"`
+	Sort         *int    `json:"sort"`
+	WeeklyTarget *int    `json:"weekly_target"` // 0 clears the weekly goal
+}
+
+type LogHabitRequest struct {
+	Day    string    `json:"day"`    // Format: YYYY-MM-DD
+	Action LogAction `json:"action"` // Defaults to increment
+	Count  int       `json:"count"`  // New count for set, amount to add or remove otherwise. Defaults to 1
+}
+
+// LogAction is how a log request changes the count of a day. A day counted down to 0 is removed,
+// and decrementing a day that was never logged does nothing
+type LogAction string
+
+const (
+	LogSet       LogAction = "set"
+	LogIncrement LogAction = "increment"
+	LogDecrement LogAction = "decrement"
+)
+
+type CreateAPITokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`          // Any of read, log and write
+	ExpiresInDays int      `json:"expires_in_days"` // 0 never expires
+}
+
+// PasswordAuthRequest signs up or logs in with the native provider
+type PasswordAuthRequest struct {
+	Email          string `json:"email"`
+	Password       string `json:"password"`
+	AnonymousToken string `json:"anonymous_token"` // Session of an anonymous account to keep the data of. Optional
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"` // From the password reset email
+	Password string `json:"password"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"` // From the verification email
+}
+
+type AppleSignInRequest struct {
+	IDToken        string `json:"id_token"`        // Identity token from Sign in with Apple
+	Nonce          string `json:"nonce"`           // Raw nonce, Apple was given its sha256 hex digest
+	AnonymousToken string `json:"anonymous_token"` // Session of an anonymous account to merge. Optional
+}
+
+// MergeAnonymousRequest moves an anonymous account's data into the current account
+type MergeAnonymousRequest struct {
+	AnonymousToken string `json:"anonymous_token"`
+}
+
+// LinkIdentityRequest adds a way to sign in to the current account
+type LinkIdentityRequest struct {
+	Provider string `json:"provider"` // apple or the name of an OIDC provider
+	IDToken  string `json:"id_token"`
+	Nonce    string `json:"nonce"` // Only for apple
+}
+
+// SessionResponse is a session issued by the API itself
+type SessionResponse struct {
+	UserID    string    `json:"user_id"`
+	Token     string    `json:"access_token"`
+	TokenType string    `json:"token_type"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type SyncDataRequest struct {
+	LastUpdated int64                `json:"client_timestamp"` // Unix milliseconds UTC
+	HabitData   map[string]HabitData `json:"habit_data"`
+	BaseVersion *int64               `json:"base_version"` // Version the client last saw. Can also be sent as If-Match
+}
+
+// SyncChangesRequest carries only what changed since the client's cursor
+type SyncChangesRequest struct {
+	Cursor      int64                `json:"cursor"`           // Last change the client has seen. 0 fetches everything
+	LastUpdated int64                `json:"client_timestamp"` // Unix milliseconds UTC
+	Changes     map[string]HabitData `json:"changes"`          // Fields without a timestamp are ignored
+	BaseVersion *int64               `json:"base_version"`     // Version the client last saw. Can also be sent as If-Match
+}
+
+type HabitData struct {
+	Logs       map[string]int `json:"logs"`
+	WeeklyGoal int            `json:"weekly_goal"`
+	Sort       int            `json:"sort"`
+
+	// Unix milliseconds UTC of the last change to each field, used to merge devices.
+	// Missing timestamps default to the client_timestamp of the request
+	LogsUpdatedAt       map[string]int64 `json:"logs_updated_at,omitempty"`
+	WeeklyGoalUpdatedAt int64            `json:"weekly_goal_updated_at,omitempty"`
+	SortUpdatedAt       int64            `json:"sort_updated_at,omitempty"`
+	DeletedAt           int64            `json:"deleted_at,omitempty"`
+}
+
+// HabitStats is the report for a single habit
+type HabitStats struct {
+	HabitID int64  `json:"habit_id"`
+	Name    string `json:"name"`
+	stats.Stats
+}
+
+type StatsResponse struct {
+	Total  int          `json:"total"` // Sum of every habit's logs
+	Habits []HabitStats `json:"habits"`
+}
+
+type Response struct {
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// NewRouter builds the API routes on top of ds, accepting sessions from auth
+func NewRouter(cfg *Config, ds DataStore, auth *Auth) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(traceRequests, logRequests)
+	// CORS middleware
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if cfg.CORS.allowsOrigin(origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID")
+				w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Retry-After, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy")
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if r.Method == "OPTIONS" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	})
+	// after CORS so browsers can read the 429
+	router.Use(newRateLimiter(cfg.Limits, ds).limitRequests)
+
+	router.Handle("/metrics", handleMetrics(cfg.Metrics))
+	router.HandleFunc("/api/ping", func(w http.ResponseWriter, r *http.Request) {
+		sendSuccessResponse(w, "pong")
+	})
+	if auth.Native != nil {
+		router.HandleFunc("/api/auth/anonymous", handleAnonymousSignup(ds, auth.Native))
+		router.HandleFunc("/api/auth/signup", handleSignup(ds, auth))
+		router.HandleFunc("/api/auth/login", handleLogin(ds, auth))
+		router.HandleFunc("/api/auth/forgot-password", handleForgotPassword(ds, auth.Native))
+		router.HandleFunc("/api/auth/reset-password", handleResetPassword(ds, auth.Native))
+		router.HandleFunc("/api/auth/verify-email/resend", handleResendVerification(ds, auth))
+		router.HandleFunc("/api/auth/verify-email", handleVerifyEmail(ds))
+	}
+	if auth.apple != nil {
+		router.HandleFunc("/api/auth/apple", handleAppleSignIn(ds, auth))
+	}
+	router.HandleFunc("/api/auth/merge", handleMergeAnonymous(ds, auth))
+	router.HandleFunc("/api/account", handleAccount(ds, auth))
+	router.HandleFunc("/api/auth/identities/{provider}/{subject}", handleIdentity(ds, auth))
+	router.HandleFunc("/api/auth/identities", handleIdentities(ds, auth))
+	router.HandleFunc("/api/habits/{id}/stats", handleHabitStats(ds, auth))
+	router.HandleFunc("/api/habits/{id}", handleHabit(ds, auth))
+	router.HandleFunc("/api/habits", handleHabits(ds, auth))
+	router.HandleFunc("/api/stats", handleStats(ds, auth))
+	router.HandleFunc("/api/export", handleExport(ds, auth))
+	router.HandleFunc("/api/import", handleImport(cfg, ds, auth))
+	router.HandleFunc("/api/tokens/{id}", handleAPIToken(ds, auth))
+	router.HandleFunc("/api/tokens", handleAPITokens(ds, auth))
+	router.HandleFunc("/api/sync", handleSync(ds, auth))
+	router.HandleFunc("/api/sync/changes", handleSyncChanges(ds, auth))
+	notFound := func(w http.ResponseWriter, r *http.Request) {
+		sendErrorResponse(w, "not found", http.StatusNotFound)
+	}
+	router.HandleFunc("/", notFound)
+	// middleware only runs for matched routes
+	router.NotFoundHandler = traceRequests(logRequests(http.HandlerFunc(notFound)))
+	return router
+}
+
+// Handler for creating an account without credentials
+func handleAnonymousSignup(ds DataStore, native *NativeAuthenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, db_err := ds.CreateAnonymousUser(r.Context(), uuid.NewString())
+		if db_err != nil {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+		session, err := native.Issue(user)
+		if err != nil {
+			sendErrorResponse(w, "Failed to create session", http.StatusInternalServerError)
+			return
+		}
+		sendSuccessResponse(w, session)
+	}
+}
+
+// Handler for creating an email and password account.
+// With an anonymous session the anonymous account becomes the new account
+func handleSignup(ds DataStore, auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req PasswordAuthRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		email, err := normalizeEmail(req.Email)
+		if err != nil {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user_id := uuid.NewString()
+		if req.AnonymousToken != "" {
+			anonymous_id, db_err := auth.anonymousUser(r.Context(), req.AnonymousToken)
+			if db_err != nil {
+				sendErrorResponse(w, db_err.Message, db_err.Code)
+				return
+			}
+			user_id = *anonymous_id
+		}
+		user, db_err := ds.CreatePasswordUser(r.Context(), user_id, email, hash)
+		if db_err != nil {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+		// the account works without it, so a failed email does not fail the signup
+		if db_err := auth.Native.sendToken(r.Context(), user, PurposeEmailVerification); db_err != nil {
+			Logger(r.Context()).WarnContext(r.Context(), "Failed to send verification email", "user", user.UserID, "err", db_err)
+		}
+		session, err := auth.Native.Issue(user)
+		if err != nil {
+			sendErrorResponse(w, "Failed to create session", http.StatusInternalServerError)
+			return
+		}
+		sendSuccessResponse(w, session)
+	}
+}
+
+// Handler for logging in with an email and password.
+// With an anonymous session the anonymous account is merged into the one logged in to
+func handleLogin(ds DataStore, auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req PasswordAuthRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+
+		var user *UserModel
+		if email, err := normalizeEmail(req.Email); err == nil {
+			found, db_err := ds.GetUserByEmail(r.Context(), email)
+			if db_err != nil && db_err.Code != http.StatusNotFound {
+				sendErrorResponse(w, db_err.Message, db_err.Code)
+				return
+			}
+			user = found
+		}
+		// the same answer for an unknown email and a wrong password
+		if !checkPassword(user, req.Password) {
+			observeAuthFailure("invalid_password")
+			sendErrorResponse(w, "Invalid email or password", http.StatusUnauthorized)
+			return
+		}
+		if db_err := mergeAnonymous(r.Context(), ds, auth, req.AnonymousToken, user.UserID); db_err != nil {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+		session, err := auth.Native.Issue(user)
+		if err != nil {
+			sendErrorResponse(w, "Failed to create session", http.StatusInternalServerError)
+			return
+		}
+		sendSuccessResponse(w, session)
+	}
+}
+
+// Handler for requesting a password reset email
+func handleForgotPassword(ds DataStore, native *NativeAuthenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req ForgotPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		email, err := normalizeEmail(req.Email)
+		if err != nil {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user, db_err := ds.GetUserByEmail(r.Context(), email)
+		if db_err != nil && db_err.Code != http.StatusNotFound {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+		// the response is the same whether or not the email is registered or rate limited
+		if user != nil && user.PasswordHash != nil {
+			if db_err := native.sendToken(r.Context(), user, PurposePasswordReset); db_err != nil {
+				Logger(r.Context()).WarnContext(r.Context(), "Failed to send password reset email", "user", user.UserID, "err", db_err)
+			}
+		}
+		sendSuccessResponse(w, "ok")
+	}
+}
+
+// Handler for choosing a new password with an emailed token
+func handleResetPassword(ds DataStore, native *NativeAuthenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req ResetPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.Token == "" {
+			sendErrorResponse(w, "token is required", http.StatusBadRequest)
+			return
+		}
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user, db_err := ds.ResetPassword(r.Context(), hashToken(req.Token), hash)
+		if db_err != nil {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+		// every other session was signed out, this one starts fresh
+		session, err := native.Issue(user)
+		if err != nil {
+			sendErrorResponse(w, "Failed to create session", http.StatusInternalServerError)
+			return
+		}
+		sendSuccessResponse(w, session)
+	}
+}
+
+// Handler for confirming an email with an emailed token
+func handleVerifyEmail(ds DataStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req VerifyEmailRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		if req.Token == "" {
+			sendErrorResponse(w, "token is required", http.StatusBadRequest)
+			return
+		}
+
+		user, db_err := ds.VerifyEmail(r.Context(), hashToken(req.Token))
+		if db_err != nil {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+		sendSuccessResponse(w, user)
+	}
+}
+
+// Handler for sending another verification email to the signed in user
+func handleResendVerification(ds DataStore, auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user_id, db_err := userFromToken(r.Context(), ds, auth, r.Header.Get("Authorization"), scopeSession)
+		if db_err != nil {
+			sendAuthError(w, r, db_err)
+			return
+		}
+
+		user, db_err := ds.GetUser(r.Context(), *user_id)
+		if db_err != nil {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+		if user.EmailVerifiedAt != nil {
+			sendErrorResponse(w, "Email is already verified", http.StatusConflict)
+			return
+		}
+		if db_err := auth.Native.sendToken(r.Context(), user, PurposeEmailVerification); db_err != nil {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+		sendSuccessResponse(w, "ok")
+	}
+}
+
+// Handler for exchanging an Apple identity token for a session
+func handleAppleSignIn(ds DataStore, auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req AppleSignInRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+
+		identity, err := auth.apple.verify(r.Context(), req.IDToken, req.Nonce)
+		if err != nil {
+			observeAuthFailure("invalid_identity_token")
+			sendErrorResponse(w, "Invalid identity token: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		user, db_err := ds.UserFromIdentity(r.Context(), *identity, uuid.NewString())
+		if db_err != nil {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+		if db_err := mergeAnonymous(r.Context(), ds, auth, req.AnonymousToken, user.UserID); db_err != nil {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+		session, err := auth.Native.Issue(user)
+		if err != nil {
+			sendErrorResponse(w, "Failed to create session", http.StatusInternalServerError)
+			return
+		}
+		sendSuccessResponse(w, session)
+	}
+}
+
+// Handler for merging an anonymous account into the current account,
+// for clients that sign in with a provider other than the native one
+func handleMergeAnonymous(ds DataStore, auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user_id, db_err := userFromToken(r.Context(), ds, auth, r.Header.Get("Authorization"), scopeSession)
+		if db_err != nil {
+			sendAuthError(w, r, db_err)
+			return
+		}
+
+		var req MergeAnonymousRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AnonymousToken == "" {
+			sendErrorResponse(w, "anonymous_token is required", http.StatusBadRequest)
+			return
+		}
+		if db_err := mergeAnonymous(r.Context(), ds, auth, req.AnonymousToken, *user_id); db_err != nil {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+		sendSuccessResponse(w, "ok")
+	}
+}
+
+// Handler for listing and linking the identities that can sign in to the current account
+func handleIdentities(ds DataStore, auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user_id, db_err := userFromToken(r.Context(), ds, auth, r.Header.Get("Authorization"), scopeSession)
+		if db_err != nil {
+			sendAuthError(w, r, db_err)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			var req LinkIdentityRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+				return
+			}
+			identity, err := auth.identity(r.Context(), req.Provider, req.IDToken, req.Nonce)
+			if err != nil {
+				sendErrorResponse(w, "Invalid identity token: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if db_err := ds.LinkIdentity(r.Context(), *user_id, *identity); db_err != nil {
+				sendErrorResponse(w, db_err.Message, db_err.Code)
+				return
+			}
+			fallthrough
+		case http.MethodGet:
+			identities, db_err := ds.GetIdentities(r.Context(), *user_id)
+			if db_err != nil {
+				sendErrorResponse(w, db_err.Message, db_err.Code)
+				return
+			}
+			sendSuccessResponse(w, identities)
+		}
+	}
+}
+
+// Handler for unlinking an identity from the current account
+func handleIdentity(ds DataStore, auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user_id, db_err := userFromToken(r.Context(), ds, auth, r.Header.Get("Authorization"), scopeSession)
+		if db_err != nil {
+			sendAuthError(w, r, db_err)
+			return
+		}
+
+		vars := mux.Vars(r)
+		if db_err := ds.DeleteIdentity(r.Context(), *user_id, vars["provider"], vars["subject"]); db_err != nil {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+		sendSuccessResponse(w, "ok")
+	}
+}
+
+// Handler for erasing the current account
+func handleAccount(ds DataStore, auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user_id, db_err := userFromToken(r.Context(), ds, auth, r.Header.Get("Authorization"), scopeSession)
+		if db_err != nil {
+			sendAuthError(w, r, db_err)
+			return
+		}
+		if db_err := ds.DeleteUser(r.Context(), *user_id); db_err != nil {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+		sendSuccessResponse(w, "ok")
+	}
+}
+
+// Handler for habit-related endpoints
+func handleHabits(ds DataStore, auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		scope := ScopeWrite
+		if r.Method == http.MethodGet {
+			scope = ScopeRead
+		}
+		user_id, db_err := userFromToken(r.Context(), ds, auth, r.Header.Get("Authorization"), scope)
+		if db_err != nil {
+			sendAuthError(w, r, db_err)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			var req CreateHabitRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+				return
+			}
+			req.Name = strings.TrimSpace(req.Name)
+			if req.Name == "" {
+				sendErrorResponse(w, "name is required", http.StatusBadRequest)
+				return
+			}
+			habit, db_err := ds.CreateHabit(r.Context(), *user_id, req)
+			if db_err != nil {
+				sendErrorResponse(w, db_err.Message, db_err.Code)
+				return
+			}
+			sendSuccessResponse(w, habit)
+		case http.MethodGet:
+			habits, db_err := ds.GetHabits(r.Context(), *user_id)
+			if db_err != nil {
+				sendErrorResponse(w, db_err.Message, db_err.Code)
+				return
+			}
+			sendSuccessResponse(w, habits)
+		}
+	}
+}
+
+// Handler for a single habit and its logs
+func handleHabit(ds DataStore, auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		habitID, err := strconv.ParseInt(vars["id"], 10, 64)
+		if err != nil {
+			sendErrorResponse(w, "habit id must be an int", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodPatch, http.MethodDelete, http.MethodPut:
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		scope := ScopeWrite
+		switch r.Method {
+		case http.MethodGet:
+			scope = ScopeRead
+		case http.MethodPut:
+			scope = ScopeLog
+		}
+		user_id, db_err := userFromToken(r.Context(), ds, auth, r.Header.Get("Authorization"), scope)
+		if db_err != nil {
+			sendAuthError(w, r, db_err)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			habit, db_err := ds.GetHabit(r.Context(), *user_id, habitID)
+			if db_err != nil {
+				sendErrorResponse(w, db_err.Message, db_err.Code)
+				return
+			}
+			sendSuccessResponse(w, habit)
+		case http.MethodPatch:
+			var req UpdateHabitRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+				return
+			}
+			if req.Name != nil {
+				name := strings.TrimSpace(*req.Name)
+				if name == "" {
+					sendErrorResponse(w, "name cannot be empty", http.StatusBadRequest)
+					return
+				}
+				req.Name = &name
+			}
+			habit, db_err := ds.UpdateHabit(r.Context(), *user_id, habitID, req)
+			if db_err != nil {
+				sendErrorResponse(w, db_err.Message, db_err.Code)
+				return
+			}
+			sendSuccessResponse(w, habit)
+		case http.MethodDelete:
+			db_err := ds.DeleteHabit(r.Context(), *user_id, habitID)
+			if db_err != nil {
+				sendErrorResponse(w, db_err.Message, db_err.Code)
+				return
+			}
+			sendSuccessResponse(w, "ok")
+		case http.MethodPut:
+			var req LogHabitRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+				return
+			}
+			if habitID == 0 || req.Day == "" {
+				sendErrorResponse(w, "Missing request params", http.StatusBadRequest)
+				return
+			}
+			_, err := time.Parse("2006-01-02", req.Day)
+			if err != nil {
+				sendErrorResponse(w, "Date format must be yyyy-mm-dd", http.StatusBadRequest)
+				return
+			}
+			switch req.Action {
+			case "":
+				req.Action = LogIncrement
+				fallthrough
+			case LogIncrement, LogDecrement:
+				if req.Count == 0 {
+					req.Count = 1
+				}
+			case LogSet:
+			default:
+				sendErrorResponse(w, "action must be one of set, increment or decrement", http.StatusBadRequest)
+				return
+			}
+			if req.Count < 0 {
+				sendErrorResponse(w, "count cannot be negative", http.StatusBadRequest)
+				return
+			}
+			habitLog, db_err := ds.LogHabit(r.Context(), *user_id, habitID, req)
+			if db_err != nil {
+				sendErrorResponse(w, db_err.Message, db_err.Code)
+				return
+			}
+			sendSuccessResponse(w, habitLog)
+		}
+	}
+}
+
+// Handler for the report of a single habit
+func handleHabitStats(ds DataStore, auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		habitID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			sendErrorResponse(w, "habit id must be an int", http.StatusBadRequest)
+			return
+		}
+		windows, err := statsWindows(r)
+		if err != nil {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user_id, db_err := userFromToken(r.Context(), ds, auth, r.Header.Get("Authorization"), ScopeRead)
+		if db_err != nil {
+			sendAuthError(w, r, db_err)
+			return
+		}
+
+		habit, db_err := ds.GetHabit(r.Context(), *user_id, habitID)
+		if db_err != nil {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+		sendSuccessResponse(w, habitStats(*habit, windows, time.Now()))
+	}
+}
+
+// Handler for the report of every habit
+func handleStats(ds DataStore, auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		windows, err := statsWindows(r)
+		if err != nil {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user_id, db_err := userFromToken(r.Context(), ds, auth, r.Header.Get("Authorization"), ScopeRead)
+		if db_err != nil {
+			sendAuthError(w, r, db_err)
+			return
+		}
+
+		habits, db_err := ds.GetHabits(r.Context(), *user_id)
+		if db_err != nil {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+		now := time.Now()
+		result := StatsResponse{Habits: make([]HabitStats, 0, len(habits))}
+		for _, habit := range habits {
+			report := habitStats(habit, windows, now)
+			result.Total += report.Total
+			result.Habits = append(result.Habits, report)
+		}
+		sendSuccessResponse(w, result)
+	}
+}
+
+// Handler for downloading every habit as json, csv or a zip of both
+func handleExport(ds DataStore, auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+		}
+		file, ok := exportFormats[format]
+		if !ok {
+			sendErrorResponse(w, "format must be one of json, csv or zip", http.StatusBadRequest)
+			return
+		}
+
+		user_id, db_err := userFromToken(r.Context(), ds, auth, r.Header.Get("Authorization"), ScopeRead)
+		if db_err != nil {
+			sendAuthError(w, r, db_err)
+			return
+		}
+
+		now := time.Now()
+		out := &exportResponse{
+			w:           w,
+			contentType: file.contentType,
+			filename:    "tabit-export-" + now.UTC().Format(time.DateOnly) + "." + file.extension,
+		}
+		export, err := newExportWriter(format, out, *user_id, now)
+		if err != nil {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// releases the zip export's temporary file when the export fails
+		defer export.Abort()
+		db_err = ds.ExportUser(r.Context(), *user_id, export)
+		if db_err == nil {
+			if err := export.Close(); err != nil {
+				db_err = &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to export habits", Err: err}
+			}
+		}
+		if db_err != nil {
+			if !out.started {
+				sendErrorResponse(w, db_err.Message, db_err.Code)
+				return
+			}
+			// the download has begun, so cut the connection rather than leave a file that looks complete
+			Logger(r.Context()).ErrorContext(r.Context(), "Export failed after it started", "user", *user_id, "format", format, "err", db_err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// Handler for importing a Loop Habit Tracker export
+func handleImport(cfg *Config, ds DataStore, auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		strategy := ImportStrategy(r.URL.Query().Get("on_conflict"))
+		switch strategy {
+		case "":
+			strategy = ImportMerge
+		case ImportMerge, ImportReplace, ImportSkip, ImportRename:
+		default:
+			sendErrorResponse(w, "on_conflict must be one of merge, replace, skip or rename", http.StatusBadRequest)
+			return
+		}
+		dry_run := false
+		if value := r.URL.Query().Get("dry_run"); value != "" {
+			var err error
+			if dry_run, err = strconv.ParseBool(value); err != nil {
+				sendErrorResponse(w, "dry_run must be true or false", http.StatusBadRequest)
+				return
+			}
+		}
+
+		user_id, db_err := userFromToken(r.Context(), ds, auth, r.Header.Get("Authorization"), ScopeWrite)
+		if db_err != nil {
+			sendAuthError(w, r, db_err)
+			return
+		}
+
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, cfg.Limits.MaxImportBytes))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				sendErrorResponse(w, fmt.Sprintf("Import cannot be larger than %d bytes", cfg.Limits.MaxImportBytes), http.StatusRequestEntityTooLarge)
+				return
+			}
+			sendErrorResponse(w, "Failed to read request", http.StatusBadRequest)
+			return
+		}
+		source, habits, err := readLoopBackup(r.Context(), data)
+		if err != nil {
+			sendErrorResponse(w, "Invalid import: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, db_err := importHabits(r.Context(), ds, *user_id, source, habits, strategy, dry_run)
+		if db_err != nil {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+		sendSuccessResponse(w, result)
+	}
+}
+
+// exportResponse sends the download headers with the first write,
+// so an export that fails before producing anything still gets an error response
+type exportResponse struct {
+	w           http.ResponseWriter
+	contentType string
+	filename    string
+	started     bool
+}
+
+func (r *exportResponse) Write(p []byte) (int, error) {
+	if !r.started {
+		r.started = true
+		r.w.Header().Set("Content-Type", r.contentType)
+		r.w.Header().Set("Content-Disposition", `attachment; filename="`+r.filename+`"`)
+		r.w.Header().Set("Cache-Control", "no-store")
+		r.w.WriteHeader(http.StatusOK)
+	}
+	return r.w.Write(p)
+}
+
+func habitStats(habit HabitModel, windows []int, now time.Time) HabitStats {
+	target := 0
+	if habit.WeeklyTarget != nil {
+		target = *habit.WeeklyTarget
+	}
+	return HabitStats{
+		HabitID: habit.HabitID,
+		Name:    habit.Name,
+		// log days are UTC dates, same as the web client
+		Stats: stats.Compute(habit.Logs, target, windows, now.UTC()),
+	}
+}
+
+// statsWindows reads the comma separated windows query, in days
+func statsWindows(r *http.Request) ([]int, error) {
+	query := r.URL.Query().Get("windows")
+	if query == "" {
+		return stats.DefaultWindows, nil
+	}
+	var windows []int
+	for _, part := range strings.Split(query, ",") {
+		days, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || days < 1 || days > stats.MaxWindow {
+			return nil, fmt.Errorf("windows must be a list of days between 1 and %d", stats.MaxWindow)
+		}
+		windows = append(windows, days)
+	}
+	return windows, nil
+}
+
+// Handler for listing and creating personal access tokens
+func handleAPITokens(ds DataStore, auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user_id, db_err := userFromToken(r.Context(), ds, auth, r.Header.Get("Authorization"), scopeSession)
+		if db_err != nil {
+			sendAuthError(w, r, db_err)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			var req CreateAPITokenRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				sendErrorResponse(w, "Invalid request format", http.StatusBadRequest)
+				return
+			}
+			req.Name = strings.TrimSpace(req.Name)
+			if req.Name == "" {
+				sendErrorResponse(w, "name is required", http.StatusBadRequest)
+				return
+			}
+			scopes, err := parseScopes(req.Scopes)
+			if err != nil {
+				sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.ExpiresInDays < 0 {
+				sendErrorResponse(w, "expires_in_days cannot be negative", http.StatusBadRequest)
+				return
+			}
+			var expiresAt *time.Time
+			if req.ExpiresInDays > 0 {
+				expires := time.Now().UTC().AddDate(0, 0, req.ExpiresInDays)
+				expiresAt = &expires
+			}
+
+			token, hash, err := newAPIToken()
+			if err != nil {
+				sendErrorResponse(w, "Failed to create token", http.StatusInternalServerError)
+				return
+			}
+			created, db_err := ds.CreateAPIToken(r.Context(), *user_id, req.Name, hash, scopes, expiresAt)
+			if db_err != nil {
+				sendErrorResponse(w, db_err.Message, db_err.Code)
+				return
+			}
+			// the only time the token is shown
+			created.Token = token
+			sendSuccessResponse(w, created)
+		case http.MethodGet:
+			tokens, db_err := ds.GetAPITokens(r.Context(), *user_id)
+			if db_err != nil {
+				sendErrorResponse(w, db_err.Message, db_err.Code)
+				return
+			}
+			sendSuccessResponse(w, tokens)
+		}
+	}
+}
+
+// Handler for revoking a personal access token
+func handleAPIToken(ds DataStore, auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tokenID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			sendErrorResponse(w, "token id must be an int", http.StatusBadRequest)
+			return
+		}
+
+		user_id, db_err := userFromToken(r.Context(), ds, auth, r.Header.Get("Authorization"), scopeSession)
+		if db_err != nil {
+			sendAuthError(w, r, db_err)
+			return
+		}
+
+		if db_err := ds.DeleteAPIToken(r.Context(), *user_id, tokenID); db_err != nil {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+		sendSuccessResponse(w, "ok")
+	}
+}
+
+// Handler for synchronizing the entire user state
+func handleSync(ds DataStore, auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req SyncDataRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendErrorResponse(w, "Invalid request format: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user_id, db_err := userFromToken(r.Context(), ds, auth, r.Header.Get("Authorization"), ScopeWrite)
+		if db_err != nil {
+			sendAuthError(w, r, db_err)
+			return
+		}
+
+		if req.HabitData == nil {
+			req.HabitData = map[string]HabitData{}
+		}
+		baseVersion, err := ifMatchVersion(r, req.BaseVersion)
+		if err != nil {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		data, db_err := ds.SyncUserData(r.Context(), *user_id, baseVersion, req.LastUpdated, req.HabitData)
+		if db_err != nil && data == nil {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+
+		w.Header().Set("ETag", versionTag(data.Version))
+		if db_err != nil {
+			sendConflictResponse(w, db_err.Message, data)
+			return
+		}
+		sendSuccessResponse(w, data)
+	}
+}
+
+// Handler for incremental sync against the change log
+func handleSyncChanges(ds DataStore, auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req SyncChangesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendErrorResponse(w, "Invalid request format: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Cursor < 0 {
+			sendErrorResponse(w, "cursor cannot be negative", http.StatusBadRequest)
+			return
+		}
+
+		user_id, db_err := userFromToken(r.Context(), ds, auth, r.Header.Get("Authorization"), ScopeWrite)
+		if db_err != nil {
+			sendAuthError(w, r, db_err)
+			return
+		}
+
+		if req.Changes == nil {
+			req.Changes = map[string]HabitData{}
+		}
+		baseVersion, err := ifMatchVersion(r, req.BaseVersion)
+		if err != nil {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		data, db_err := ds.SyncChanges(r.Context(), *user_id, baseVersion, req.Cursor, req.LastUpdated, req.Changes)
+		if db_err != nil && data == nil {
+			sendErrorResponse(w, db_err.Message, db_err.Code)
+			return
+		}
+
+		w.Header().Set("ETag", versionTag(data.Version))
+		if db_err != nil {
+			sendConflictResponse(w, db_err.Message, data)
+			return
+		}
+		sendSuccessResponse(w, data)
+	}
+}
+
+// ifMatchVersion returns the sync version a write is based on.
+// An If-Match header takes precedence over the body field, "*" skips the check
+func ifMatchVersion(r *http.Request, fallback *int64) (*int64, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		return fallback, nil
+	}
+	if header == "*" {
+		return nil, nil
+	}
+	tag := strings.Trim(strings.TrimPrefix(header, "W/"), `"`)
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil || version < 0 {
+		return nil, fmt.Errorf("If-Match must be a sync version")
+	}
+	return &version, nil
+}
+
+func versionTag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// sendConflictResponse rejects a stale write along with the current state to rebase on
+func sendConflictResponse(w http.ResponseWriter, message string, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(Response{
+		Message: message,
+		Data:    data,
+	})
+}
+
+// sendAuthError rejects a request that failed authentication, lacks a token scope or comes from an erased account.
+// A server error while checking the credentials is not a reason to sign the client out, so it keeps its status
+func sendAuthError(w http.ResponseWriter, r *http.Request, err *HTTPError) {
+	switch {
+	case err.Code >= http.StatusInternalServerError:
+		Logger(r.Context()).ErrorContext(r.Context(), "Failed to check credentials", "err", err)
+		sendErrorResponse(w, http.StatusText(err.Code), err.Code)
+	case err.Code == http.StatusForbidden || err.Code == http.StatusGone || err.Code == http.StatusTooManyRequests:
+		sendErrorResponse(w, err.Message, err.Code)
+	default:
+		sendErrorResponse(w, err.Error(), http.StatusUnauthorized)
+	}
+}
+
+func sendErrorResponse(w http.ResponseWriter, message string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(Response{
+		Message: message,
+	})
+}
+
+func sendSuccessResponse(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Response{
+		Data: data,
+	})
+}
@@ -0,0 +1,64 @@
+package tabit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestAPI serves the API from an empty sqlite store with native auth and no rate limits.
+// configure can change the config before it is validated
+func newTestAPI(t *testing.T, configure func(cfg *Config)) (http.Handler, *SQLiteDataStore) {
+	t.Helper()
+	ds := newTestStore(t, "user")
+	cfg := defaultConfig()
+	cfg.Database = DatabaseConfig{Type: SQLiteDB, URL: "unused"}
+	cfg.Auth.Secret = strings.Repeat("s", minAuthSecretLength)
+	cfg.Mail.Mailer = "log"
+	cfg.Limits.RateLimits = nil
+	if configure != nil {
+		configure(cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewAuth(cfg, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewRouter(cfg, ds, auth), ds
+}
+
+// callAPI sends body as JSON with token as the bearer token, and decodes the response's data into data
+func callAPI(t *testing.T, h http.Handler, method string, path string, token string, body any, data any) (int, string) {
+	t.Helper()
+	var encoded bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&encoded).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &encoded)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var res struct {
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%s %s: %d %s", method, path, w.Code, w.Body)
+	}
+	if data != nil && len(res.Data) > 0 {
+		if err := json.Unmarshal(res.Data, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, res.Message
+}
@@ -0,0 +1,102 @@
+package tabit
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	appleIssuer  = "https://appleid.apple.com"
+	appleJWKSURL = "https://appleid.apple.com/auth/keys"
+)
+
+// appleVerifier checks Sign in with Apple identity tokens
+type appleVerifier struct {
+	keys      *jwks
+	clientIDs []string
+}
+
+type appleClaims struct {
+	jwt.RegisteredClaims
+	Nonce         string    `json:"nonce"`
+	Email         string    `json:"email"`
+	EmailVerified appleBool `json:"email_verified"`
+}
+
+// appleBool reads claims that Apple sends as either a boolean or a string
+type appleBool bool
+
+func (b *appleBool) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case bool:
+		*b = appleBool(value)
+	case string:
+		*b = appleBool(value == "true")
+	}
+	return nil
+}
+
+// newAppleVerifier returns nil when no client ids are configured
+func newAppleVerifier(cfg AppleConfig) *appleVerifier {
+	if len(cfg.ClientIDs) == 0 {
+		return nil
+	}
+	return &appleVerifier{keys: newJWKS(cfg.JWKSURL), clientIDs: cfg.ClientIDs}
+}
+
+// verify checks an identity token from the client along with the raw nonce it kept.
+// The client gives Apple the sha256 hex digest of the nonce to embed
+func (v *appleVerifier) verify(ctx context.Context, id_token string, nonce string) (*ExternalIdentity, error) {
+	var claims appleClaims
+	token, err := jwt.ParseWithClaims(id_token, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return v.keys.key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuer(appleIssuer),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if !slices.ContainsFunc(v.clientIDs, func(id string) bool { return slices.Contains(claims.Audience, id) }) {
+		return nil, errors.New("token was issued to another app")
+	}
+	if claims.Nonce == "" || nonce == "" {
+		return nil, errors.New("nonce is required")
+	}
+	// only the digest is in the token, so a captured token cannot be replayed by sending its claim
+	digest := sha256.Sum256([]byte(nonce))
+	if !equalStrings(claims.Nonce, hex.EncodeToString(digest[:])) {
+		return nil, errors.New("nonce does not match")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	return &ExternalIdentity{
+		Provider:      "apple",
+		Subject:       claims.Subject,
+		Email:         strings.ToLower(strings.TrimSpace(claims.Email)),
+		EmailVerified: bool(claims.EmailVerified),
+	}, nil
+}
+
+func equalStrings(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
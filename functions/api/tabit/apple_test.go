@@ -0,0 +1,187 @@
+package tabit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const appleClientID = "com.example.tabit"
+
+type appleTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce         string `json:"nonce,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified any    `json:"email_verified,omitempty"`
+}
+
+// appleToken returns the claims of an identity token for nonce, changed by edit
+func appleToken(subject string, nonce string, edit func(c *appleTokenClaims)) appleTokenClaims {
+	digest := sha256.Sum256([]byte(nonce))
+	c := appleTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    appleIssuer,
+			Subject:   subject,
+			Audience:  jwt.ClaimStrings{appleClientID},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		Nonce: hex.EncodeToString(digest[:]),
+	}
+	if edit != nil {
+		edit(&c)
+	}
+	return c
+}
+
+func TestAppleVerify(t *testing.T) {
+	key, ecKey := newRSAKey(t, "apple"), newECKey(t, "ec")
+	source := writeKeySet(t, filepath.Join(t.TempDir(), "jwks.json"), key, ecKey)
+	v := newAppleVerifier(AppleConfig{ClientIDs: []string{"com.example.other", appleClientID}, JWKSURL: source})
+
+	tests := []struct {
+		name    string
+		token   string
+		nonce   string
+		want    *ExternalIdentity
+		wantErr bool
+	}{
+		{
+			name:  "valid token",
+			token: key.sign(t, appleToken("apple-user", "nonce", func(c *appleTokenClaims) { c.Email, c.EmailVerified = " Alice@Example.com", true })),
+			nonce: "nonce",
+			want:  &ExternalIdentity{Provider: "apple", Subject: "apple-user", Email: "alice@example.com", EmailVerified: true},
+		},
+		{
+			name:  "email_verified sent as a string",
+			token: key.sign(t, appleToken("apple-user", "nonce", func(c *appleTokenClaims) { c.Email, c.EmailVerified = "alice@example.com", "true" })),
+			nonce: "nonce",
+			want:  &ExternalIdentity{Provider: "apple", Subject: "apple-user", Email: "alice@example.com", EmailVerified: true},
+		},
+		{
+			name:  "unverified email",
+			token: key.sign(t, appleToken("apple-user", "nonce", func(c *appleTokenClaims) { c.Email, c.EmailVerified = "alice@example.com", "false" })),
+			nonce: "nonce",
+			want:  &ExternalIdentity{Provider: "apple", Subject: "apple-user", Email: "alice@example.com"},
+		},
+		{
+			name:    "wrong audience",
+			token:   key.sign(t, appleToken("apple-user", "nonce", func(c *appleTokenClaims) { c.Audience = jwt.ClaimStrings{"com.example.evil"} })),
+			nonce:   "nonce",
+			wantErr: true,
+		},
+		{
+			name:    "wrong issuer",
+			token:   key.sign(t, appleToken("apple-user", "nonce", func(c *appleTokenClaims) { c.Issuer = "https://appleid.example.com" })),
+			nonce:   "nonce",
+			wantErr: true,
+		},
+		{
+			name:    "expired",
+			token:   key.sign(t, appleToken("apple-user", "nonce", func(c *appleTokenClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) })),
+			nonce:   "nonce",
+			wantErr: true,
+		},
+		{
+			name:    "the raw nonce in the token",
+			token:   key.sign(t, appleToken("apple-user", "nonce", func(c *appleTokenClaims) { c.Nonce = "nonce" })),
+			nonce:   "nonce",
+			wantErr: true,
+		},
+		{
+			name:    "the nonce's digest sent as the nonce",
+			token:   key.sign(t, appleToken("apple-user", "nonce", nil)),
+			nonce:   appleToken("apple-user", "nonce", nil).Nonce,
+			wantErr: true,
+		},
+		{
+			name:    "another nonce",
+			token:   key.sign(t, appleToken("apple-user", "nonce", nil)),
+			nonce:   "other",
+			wantErr: true,
+		},
+		{
+			name:    "no nonce",
+			token:   key.sign(t, appleToken("apple-user", "nonce", func(c *appleTokenClaims) { c.Nonce = "" })),
+			nonce:   "",
+			wantErr: true,
+		},
+		{
+			name:    "apple only signs with rs256",
+			token:   ecKey.sign(t, appleToken("apple-user", "nonce", nil)),
+			nonce:   "nonce",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := v.verify(context.Background(), tt.token, tt.nonce)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("accepted the token of %+v", identity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *identity != *tt.want {
+				t.Errorf("identity = %+v, want %+v", identity, tt.want)
+			}
+		})
+	}
+}
+
+func TestAppleSignIn(t *testing.T) {
+	key := newRSAKey(t, "apple")
+	source := writeKeySet(t, filepath.Join(t.TempDir(), "jwks.json"), key)
+	h, _ := newTestAPI(t, func(cfg *Config) {
+		cfg.Auth.Apple = AppleConfig{ClientIDs: []string{appleClientID}, JWKSURL: source}
+	})
+	signIn := func(subject string, email string, verified bool) (int, SessionResponse) {
+		t.Helper()
+		token := key.sign(t, appleToken(subject, "nonce", func(c *appleTokenClaims) { c.Email, c.EmailVerified = email, verified }))
+		var session SessionResponse
+		code, _ := callAPI(t, h, http.MethodPost, "/api/auth/apple", "", AppleSignInRequest{IDToken: token, Nonce: "nonce"}, &session)
+		return code, session
+	}
+
+	var alice SessionResponse
+	login := PasswordAuthRequest{Email: "alice@example.com", Password: "correct horse battery staple"}
+	if code, message := callAPI(t, h, http.MethodPost, "/api/auth/signup", "", login, &alice); code != http.StatusOK {
+		t.Fatalf("signup: %d %s", code, message)
+	}
+
+	// an unverified email could belong to anyone, so it gets an account of its own
+	code, session := signIn("apple-bob", "alice@example.com", false)
+	if code != http.StatusOK || session.UserID == alice.UserID {
+		t.Errorf("unverified email: %d, user %q, want a new account", code, session.UserID)
+	}
+
+	code, session = signIn("apple-alice", "alice@example.com", true)
+	if code != http.StatusOK || session.UserID != alice.UserID {
+		t.Errorf("verified email: %d, user %q, want %q", code, session.UserID, alice.UserID)
+	}
+	// alice never verified her email, so whoever set the password loses access
+	if code, _ := callAPI(t, h, http.MethodPost, "/api/auth/login", "", login, nil); code != http.StatusUnauthorized {
+		t.Errorf("password login after the link: %d, want 401", code)
+	}
+	if code, _ := callAPI(t, h, http.MethodGet, "/api/habits", alice.Token, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("session from before the link: %d, want 401", code)
+	}
+
+	// the identity is linked now, so the email no longer matters
+	code, session = signIn("apple-alice", "", false)
+	if code != http.StatusOK || session.UserID != alice.UserID {
+		t.Errorf("linked identity: %d, user %q, want %q", code, session.UserID, alice.UserID)
+	}
+	if code, _ := callAPI(t, h, http.MethodGet, "/api/habits", session.Token, nil, nil); code != http.StatusOK {
+		t.Errorf("session from apple: %d, want 200", code)
+	}
+}
@@ -0,0 +1,287 @@
+package tabit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Authenticator verifies the session tokens of one identity provider
+type Authenticator interface {
+	// Authenticate returns the user a session token belongs to
+	Authenticate(ctx context.Context, token string) (*string, error)
+}
+
+// mergedAccountError rejects the sessions of an anonymous account once it was merged into another account
+type mergedAccountError struct {
+	userID string
+}
+
+func (e *mergedAccountError) Error() string {
+	return "anonymous account was merged into another account"
+}
+
+// Auth holds the identity providers the API accepts sessions from
+type Auth struct {
+	Providers []Authenticator      // Tried in order until one accepts the token
+	Native    *NativeAuthenticator // Handles signup and login, nil when AUTH_SECRET is not set
+
+	apple *appleVerifier // Exchanges Apple identity tokens for native sessions, nil when not configured
+	oidc  []*oidcProvider
+}
+
+// NewAuth enables the providers configured in cfg. At least one is required
+func NewAuth(cfg *Config, ds DataStore) (*Auth, error) {
+	native, err := newNativeAuthenticator(ds, cfg)
+	if err != nil {
+		return nil, err
+	}
+	auth := &Auth{Native: native, apple: newAppleVerifier(cfg.Auth.Apple)}
+	if native != nil {
+		auth.Providers = append(auth.Providers, native)
+	}
+	if auth.apple != nil && native == nil {
+		return nil, errors.New("sign in with apple issues native sessions, set AUTH_SECRET")
+	}
+	auth.oidc = newOIDCProviders(ds, cfg.Auth.OIDC)
+	for _, provider := range auth.oidc {
+		auth.Providers = append(auth.Providers, provider)
+	}
+	if supabase := cfg.Auth.Supabase; supabase.JWTSecret != "" || supabase.JWKSURL != "" || supabase.URL != "" {
+		auth.Providers = append(auth.Providers, newSupabaseAuthenticator(ds, supabase))
+	}
+	if len(auth.Providers) == 0 {
+		return nil, errors.New("no auth provider configured, set AUTH_SECRET, OIDC_PROVIDERS, SUPABASE_JWT_SECRET or SUPABASE_JWKS_URL")
+	}
+	return auth, nil
+}
+
+// authenticate returns the user of the first provider that accepts token
+func (a *Auth) authenticate(ctx context.Context, token_string string) (*string, error) {
+	errs := make([]error, 0, len(a.Providers))
+	for _, provider := range a.Providers {
+		user_id, err := provider.Authenticate(ctx, token_string)
+		if err == nil {
+			return user_id, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no auth provider configured")
+	}
+	return nil, errors.Join(errs...)
+}
+
+// anonymousUser returns the user of a session that is about to be merged or upgraded.
+// Sessions of an account that was already merged are accepted so a merge can be retried.
+// Whether the account is anonymous is checked by the store
+func (a *Auth) anonymousUser(ctx context.Context, token_string string) (*string, *HTTPError) {
+	user_id, err := a.authenticate(ctx, strings.TrimPrefix(token_string, "Bearer "))
+	var merged *mergedAccountError
+	if errors.As(err, &merged) {
+		return &merged.userID, nil
+	}
+	var failed *HTTPError
+	if errors.As(err, &failed) && failed.Code >= http.StatusInternalServerError {
+		return nil, failed
+	}
+	if err != nil {
+		observeAuthFailure(authFailureReason(token_string, err))
+		return nil, &HTTPError{Code: http.StatusUnauthorized, Message: "Invalid anonymous session", Err: err}
+	}
+	return user_id, nil
+}
+
+// mergeAnonymous merges the account of an anonymous session into user_id. An empty token does nothing
+func mergeAnonymous(ctx context.Context, ds DataStore, auth *Auth, anonymous_token string, user_id string) *HTTPError {
+	if anonymous_token == "" {
+		return nil
+	}
+	anonymous_id, db_err := auth.anonymousUser(ctx, anonymous_token)
+	if db_err != nil {
+		return db_err
+	}
+	return ds.MergeAnonymousUser(ctx, *anonymous_id, user_id)
+}
+
+// identity checks a token from an outside provider that is about to be linked to an account
+func (a *Auth) identity(ctx context.Context, provider string, token string, nonce string) (*ExternalIdentity, error) {
+	if provider == "apple" && a.apple != nil {
+		return a.apple.verify(ctx, token, nonce)
+	}
+	for _, p := range a.oidc {
+		if p.name == provider {
+			return p.verify(ctx, token)
+		}
+	}
+	return nil, fmt.Errorf("unknown provider %q", provider)
+}
+
+// supabaseAuthenticator checks Supabase access tokens.
+// HS256 tokens use the project's shared secret, RS256 and ES256 tokens the project's JWKS
+type supabaseAuthenticator struct {
+	ds       DataStore // Records anonymous users
+	secret   []byte
+	keys     *jwks
+	issuer   string
+	audience string
+	roles    []string
+	leeway   time.Duration
+}
+
+// newSupabaseAuthenticator checks HS256 tokens with cfg.JWTSecret and RS256/ES256 tokens with the key set.
+// The key set and issuer default to the project's when cfg.URL is set
+func newSupabaseAuthenticator(ds DataStore, cfg SupabaseConfig) *supabaseAuthenticator {
+	v := &supabaseAuthenticator{
+		ds:       ds,
+		secret:   []byte(cfg.JWTSecret),
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+		roles:    cfg.Roles,
+		leeway:   time.Duration(cfg.Leeway),
+	}
+
+	projectURL := strings.TrimSuffix(cfg.URL, "/")
+	jwksURL := cfg.JWKSURL
+	if jwksURL == "" && projectURL != "" {
+		jwksURL = projectURL + "/auth/v1/.well-known/jwks.json"
+	}
+	if jwksURL != "" {
+		v.keys = newJWKS(jwksURL)
+	}
+	if v.issuer == "" && projectURL != "" {
+		v.issuer = projectURL + "/auth/v1"
+	}
+	if v.audience == "" {
+		v.audience = "authenticated"
+	}
+	if len(v.roles) == 0 {
+		v.roles = []string{"authenticated"}
+	}
+	return v
+}
+
+// Authenticate checks the signature and claims of a token and returns its subject
+func (v *supabaseAuthenticator) Authenticate(ctx context.Context, token_string string) (*string, error) {
+	methods := []string{}
+	if len(v.secret) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if v.keys != nil {
+		methods = append(methods, jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg())
+	}
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithAudience(v.audience),
+		jwt.WithLeeway(v.leeway),
+	}
+	if v.issuer != "" {
+		options = append(options, jwt.WithIssuer(v.issuer))
+	}
+
+	var claims struct {
+		jwt.RegisteredClaims
+		Role        string `json:"role"`
+		IsAnonymous bool   `json:"is_anonymous"`
+	}
+	token, err := jwt.ParseWithClaims(token_string, &claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+			return v.secret, nil
+		}
+		kid, _ := token.Header["kid"].(string)
+		return v.keys.key(ctx, kid)
+	}, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if !slices.Contains(v.roles, claims.Role) {
+		return nil, fmt.Errorf("role %q is not allowed", claims.Role)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	if claims.IsAnonymous {
+		user, db_err := v.ds.CreateAnonymousUser(ctx, claims.Subject)
+		if db_err != nil {
+			return nil, db_err
+		}
+		if user.DeletedAt != nil {
+			return nil, &HTTPError{Code: http.StatusGone, Message: "Account was deleted"}
+		}
+		if user.MergedInto != nil {
+			return nil, &mergedAccountError{userID: claims.Subject}
+		}
+	}
+
+	return &claims.Subject, nil
+}
+
+// userFromToken returns the user a session or personal access token belongs to.
+// Personal access tokens also need scope, sessions can do everything
+func userFromToken(ctx context.Context, ds DataStore, auth *Auth, token_string string, scope Scope) (*string, *HTTPError) {
+	ctx, span := tracer.Start(ctx, "userFromToken", trace.WithAttributes(attribute.String("tabit.scope", string(scope))))
+	user_id, db_err := tokenUser(ctx, ds, auth, token_string, scope)
+	if limited := limitUser(ctx, user_id); limited != nil {
+		user_id, db_err = nil, limited
+	}
+	if user_id != nil {
+		span.SetAttributes(semconv.EnduserID(*user_id))
+	}
+	endSpan(span, db_err)
+	return user_id, db_err
+}
+
+func tokenUser(ctx context.Context, ds DataStore, auth *Auth, token_string string, scope Scope) (*string, *HTTPError) {
+	token_string = strings.TrimPrefix(token_string, "Bearer ")
+	if strings.HasPrefix(token_string, apiTokenPrefix) {
+		user_id, db_err := userFromAPIToken(ctx, ds, token_string, scope)
+		if db_err != nil {
+			switch db_err.Code {
+			case http.StatusUnauthorized:
+				observeAuthFailure("invalid_api_token")
+			case http.StatusForbidden:
+				observeAuthFailure("insufficient_scope")
+			}
+			return nil, db_err
+		}
+		setRequestUser(ctx, *user_id)
+		return user_id, nil
+	}
+	user_id, err := auth.authenticate(ctx, token_string)
+	var failed *HTTPError
+	if errors.As(err, &failed) && failed.Code == http.StatusGone {
+		// the session is valid but the account was erased, clients should stop syncing it
+		observeAuthFailure("account_deleted")
+		return nil, failed
+	}
+	if errors.As(err, &failed) && failed.Code >= http.StatusInternalServerError {
+		// the session could not be checked, which says nothing about whether it is valid
+		return nil, failed
+	}
+	if err != nil {
+		reason := authFailureReason(token_string, err)
+		observeAuthFailure(reason)
+		Logger(ctx).InfoContext(ctx, "Authentication failed", "reason", reason, "err", err)
+		return nil, &HTTPError{Message: "Unauthorized", Code: http.StatusUnauthorized, Err: err}
+	}
+	setRequestUser(ctx, *user_id)
+	db_err := ds.CreateUser(ctx, *user_id)
+	if db_err != nil {
+		return nil, db_err
+	}
+	return user_id, nil
+}
@@ -0,0 +1,90 @@
+package tabit
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestSupabaseAuthenticate(t *testing.T) {
+	const issuer = "https://project.supabase.co/auth/v1"
+	const secret = "super-secret-jwt-token-with-at-least-32-characters"
+	rsaKey, ecKey := newRSAKey(t, "rsa"), newECKey(t, "ec")
+	unpublished := newECKey(t, "unpublished")
+	source := writeKeySet(t, filepath.Join(t.TempDir(), "jwks.json"), rsaKey, ecKey)
+	v := newSupabaseAuthenticator(nil, SupabaseConfig{
+		JWTSecret: secret,
+		JWKSURL:   source,
+		Issuer:    issuer,
+		Leeway:    Duration(30 * time.Second),
+	})
+
+	type claims struct {
+		jwt.RegisteredClaims
+		Role string `json:"role"`
+	}
+	// session returns the claims of a valid session, changed by edit
+	session := func(edit func(c *claims)) claims {
+		c := claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    issuer,
+				Subject:   "user",
+				Audience:  jwt.ClaimStrings{"authenticated"},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+			Role: "authenticated",
+		}
+		if edit != nil {
+			edit(&c)
+		}
+		return c
+	}
+	hs256 := func(key string, c claims) string {
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "rs256", token: rsaKey.sign(t, session(nil))},
+		{name: "es256", token: ecKey.sign(t, session(nil))},
+		{name: "hs256", token: hs256(secret, session(nil))},
+		{name: "hs256 with another secret", token: hs256("another-secret-jwt-token-with-32-characters", session(nil)), wantErr: true},
+		{name: "wrong issuer", token: ecKey.sign(t, session(func(c *claims) { c.Issuer = "https://other.supabase.co/auth/v1" })), wantErr: true},
+		{name: "wrong audience", token: ecKey.sign(t, session(func(c *claims) { c.Audience = jwt.ClaimStrings{"anon"} })), wantErr: true},
+		{name: "expired within the leeway", token: ecKey.sign(t, session(func(c *claims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-10 * time.Second)) }))},
+		{name: "expired beyond the leeway", token: ecKey.sign(t, session(func(c *claims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) })), wantErr: true},
+		{name: "no expiry", token: ecKey.sign(t, session(func(c *claims) { c.ExpiresAt = nil })), wantErr: true},
+		{name: "wrong role", token: ecKey.sign(t, session(func(c *claims) { c.Role = "service_role" })), wantErr: true},
+		{name: "no subject", token: ecKey.sign(t, session(func(c *claims) { c.Subject = "" })), wantErr: true},
+		{name: "unknown key id", token: unpublished.sign(t, session(nil)), wantErr: true},
+		{name: "signed by another key", token: signingKey{kid: "ec", key: unpublished.key}.sign(t, session(nil)), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user_id, err := v.Authenticate(context.Background(), tt.token)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("accepted the token of %s", *user_id)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *user_id != "user" {
+				t.Errorf("user = %q, want user", *user_id)
+			}
+		})
+	}
+}
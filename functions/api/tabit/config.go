@@ -0,0 +1,592 @@
+package tabit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultSessionTTL = 30 * 24 * time.Hour
+
+// Config holds every setting of the API. LoadConfig reads it once at startup
+type Config struct {
+	ListenAddr string         `json:"listen_addr"` // Only used by cmd/server
+	Database   DatabaseConfig `json:"database"`
+	Auth       AuthConfig     `json:"auth"`
+	Mail       MailConfig     `json:"mail"`
+	CORS       CORSConfig     `json:"cors"`
+	Limits     LimitsConfig   `json:"limits"`
+	Log        LogConfig      `json:"log"`
+	Metrics    MetricsConfig  `json:"metrics"`
+	Tracing    TracingConfig  `json:"tracing"`
+}
+
+type DatabaseConfig struct {
+	Type         DBType `json:"type"`           // postgres or sqlite
+	URL          string `json:"url"`            // Connection string, or the file of a sqlite database
+	MaxOpenConns int    `json:"max_open_conns"` // 0 is unlimited. sqlite always uses a single connection
+}
+
+// AuthConfig enables the identity providers. The native provider is on when Secret is set
+type AuthConfig struct {
+	Secret     string         `json:"secret"` // Signs native sessions, at least 32 characters
+	Issuer     string         `json:"issuer"`
+	SessionTTL Duration       `json:"session_ttl"`
+	AppURL     string         `json:"app_url"` // Web client that emailed links point to
+	Apple      AppleConfig    `json:"apple"`
+	OIDC       []OIDCConfig   `json:"oidc"`
+	Supabase   SupabaseConfig `json:"supabase"`
+}
+
+// AppleConfig enables Sign in with Apple when ClientIDs is set
+type AppleConfig struct {
+	ClientIDs []string `json:"client_ids"` // Bundle and services ids that tokens may be issued to
+	JWKSURL   string   `json:"jwks_url"`   // Can be a file path for testing
+}
+
+type OIDCConfig struct {
+	Name       string `json:"name"` // Lowercase, used in env keys and the ids of new users
+	Issuer     string `json:"issuer"`
+	ClientID   string `json:"client_id"`
+	JWKSURL    string `json:"jwks_url"`    // Discovered from the issuer when empty
+	TrustEmail bool   `json:"trust_email"` // Link the first sign in to the account with the same verified email
+}
+
+// SupabaseConfig enables Supabase sessions when any of JWTSecret, JWKSURL or URL is set
+type SupabaseConfig struct {
+	URL       string   `json:"url"`
+	JWTSecret string   `json:"jwt_secret"`
+	JWKSURL   string   `json:"jwks_url"` // Defaults to the project's key set when URL is set
+	Issuer    string   `json:"issuer"`   // Defaults to URL/auth/v1 when URL is set
+	Audience  string   `json:"audience"`
+	Roles     []string `json:"roles"`
+	Leeway    Duration `json:"leeway"`
+}
+
+type MailConfig struct {
+	Mailer       string `json:"mailer"` // smtp, or file or log for development. Required by native auth
+	From         string `json:"from"`
+	File         string `json:"file"`
+	SMTPHost     string `json:"smtp_host"`
+	SMTPPort     string `json:"smtp_port"`
+	SMTPUsername string `json:"smtp_username"`
+	SMTPPassword string `json:"smtp_password"`
+}
+
+type CORSConfig struct {
+	// AllowedOrigins are allowed on top of defaultAllowedOrigins. They may use * for any run of
+	// characters, such as https://*.staging.example.com, and any scheme, such as chrome-extension://id
+	AllowedOrigins []string `json:"allowed_origins"`
+}
+
+// defaultAllowedOrigins are the web app, its deploy previews and local development, which are always allowed
+var defaultAllowedOrigins = []string{
+	"https://tabits.netlify.app",
+	"https://*--tabits.netlify.app",
+	"http://localhost:*",
+}
+
+type LimitsConfig struct {
+	MaxImportBytes    int64  `json:"max_import_bytes"`
+	EmailsPerHour     int    `json:"emails_per_hour"`     // Of each kind, per account
+	RateLimitStore    string `json:"rate_limit_store"`    // memory, or postgres to share buckets between instances
+	TrustForwardedFor bool   `json:"trust_forwarded_for"` // Only behind a proxy that sets X-Forwarded-For
+	// RateLimits are the token buckets of routes, by route template such as /api/habits/{id}.
+	// Entries replace the default of their route, other routes are not limited
+	RateLimits map[string]RateLimit `json:"rate_limits"`
+}
+
+// RateLimit lets a client send Burst requests at once, refilled at Requests per Per.
+// A Requests of 0 turns the limit off
+type RateLimit struct {
+	Requests int      `json:"requests"`
+	Per      Duration `json:"per"`
+	Burst    int      `json:"burst"` // Defaults to Requests
+	By       string   `json:"by"`    // user, which counts signed out requests by ip, or ip
+}
+
+type LogConfig struct {
+	Level slog.Level `json:"level"` // debug, info, warn or error
+}
+
+type MetricsConfig struct {
+	Token   string `json:"token"`    // Bearer token /metrics asks for, open when empty
+	PushURL string `json:"push_url"` // Pushgateway that metrics are pushed to on shutdown
+	PushJob string `json:"push_job"`
+}
+
+type TracingConfig struct {
+	Exporter    string  `json:"exporter"` // none, otlp or stdout
+	Endpoint    string  `json:"endpoint"` // OTLP/HTTP url, such as http://localhost:4318
+	ServiceName string  `json:"service_name"`
+	SampleRatio float64 `json:"sample_ratio"` // Of traces that are not already sampled by the caller
+}
+
+// Duration is a time.Duration written like 720h in the config file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return errors.New("duration must be a string such as 30s or 720h")
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// defaultConfig is what a setting is when neither the file nor the environment sets it
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr: ":8080",
+		Database:   DatabaseConfig{Type: PostgresDB},
+		Auth: AuthConfig{
+			Issuer:     "tabit",
+			SessionTTL: Duration(defaultSessionTTL),
+			Apple:      AppleConfig{JWKSURL: appleJWKSURL},
+			Supabase:   SupabaseConfig{Audience: "authenticated", Roles: []string{"authenticated"}},
+		},
+		Mail: MailConfig{SMTPPort: "587"},
+		Limits: LimitsConfig{
+			MaxImportBytes: 32 << 20,
+			EmailsPerHour:  3,
+			RateLimitStore: "memory",
+			RateLimits: map[string]RateLimit{
+				"/api/sync":                 {Requests: 30, Per: Duration(time.Minute)},
+				"/api/sync/changes":         {Requests: 120, Per: Duration(time.Minute)},
+				"/api/auth/anonymous":       {Requests: 10, Per: Duration(time.Minute), By: "ip"},
+				"/api/auth/signup":          {Requests: 10, Per: Duration(time.Minute), By: "ip"},
+				"/api/auth/login":           {Requests: 10, Per: Duration(time.Minute), By: "ip"},
+				"/api/auth/forgot-password": {Requests: 10, Per: Duration(time.Minute), By: "ip"},
+				"/api/auth/reset-password":  {Requests: 10, Per: Duration(time.Minute), By: "ip"},
+				"/api/auth/verify-email":    {Requests: 10, Per: Duration(time.Minute), By: "ip"},
+				"/api/auth/apple":           {Requests: 10, Per: Duration(time.Minute), By: "ip"},
+			},
+		},
+		Metrics: MetricsConfig{PushJob: "tabit"},
+		Tracing: TracingConfig{Exporter: "none", ServiceName: "tabit", SampleRatio: 1},
+	}
+}
+
+// LoadConfig reads the JSON file named by CONFIG_FILE when it is set, lets the environment
+// override it and validates the result. Every problem is reported at once
+func LoadConfig() (*Config, error) {
+	cfg := defaultConfig()
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config: %w", err)
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if decoder.More() {
+			return nil, fmt.Errorf("failed to read %s: unexpected data after the config", path)
+		}
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
+
+// loadEnv overrides the settings whose environment variable is set
+func (c *Config) loadEnv() error {
+	var errs []error
+	str := func(dst *string, key string) {
+		if value := os.Getenv(key); value != "" {
+			*dst = value
+		}
+	}
+	list := func(dst *[]string, key string) {
+		if value := os.Getenv(key); value != "" {
+			*dst = splitList(value)
+		}
+	}
+	duration := func(dst *Duration, key string) {
+		if value := os.Getenv(key); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+				return
+			}
+			*dst = Duration(parsed)
+		}
+	}
+	integer := func(dst *int64, key string) {
+		if value := os.Getenv(key); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s must be a whole number", key))
+				return
+			}
+			*dst = parsed
+		}
+	}
+
+	str(&c.ListenAddr, "LISTEN_ADDR")
+
+	var dbType string
+	str(&dbType, "DB_TYPE")
+	if dbType != "" {
+		c.Database.Type = DBType(dbType)
+	}
+	str(&c.Database.URL, "DB_URL")
+	if c.Database.URL == "" && c.Database.Type == PostgresDB {
+		// kept for deployments from before sqlite was supported
+		str(&c.Database.URL, "PG_URL")
+	}
+	maxOpenConns := int64(c.Database.MaxOpenConns)
+	integer(&maxOpenConns, "DB_MAX_OPEN_CONNS")
+	c.Database.MaxOpenConns = int(maxOpenConns)
+
+	str(&c.Auth.Secret, "AUTH_SECRET")
+	str(&c.Auth.Issuer, "AUTH_ISSUER")
+	duration(&c.Auth.SessionTTL, "AUTH_SESSION_TTL")
+	str(&c.Auth.AppURL, "APP_URL")
+	list(&c.Auth.Apple.ClientIDs, "APPLE_CLIENT_IDS")
+	str(&c.Auth.Apple.JWKSURL, "APPLE_JWKS_URL")
+
+	if names := os.Getenv("OIDC_PROVIDERS"); names != "" {
+		c.Auth.OIDC = nil
+		for _, name := range splitList(names) {
+			prefix := oidcEnvPrefix(name)
+			c.Auth.OIDC = append(c.Auth.OIDC, OIDCConfig{
+				Name:       name,
+				Issuer:     os.Getenv(prefix + "ISSUER"),
+				ClientID:   os.Getenv(prefix + "CLIENT_ID"),
+				JWKSURL:    os.Getenv(prefix + "JWKS_URL"),
+				TrustEmail: os.Getenv(prefix+"TRUST_EMAIL") == "true",
+			})
+		}
+	}
+
+	str(&c.Auth.Supabase.URL, "SUPABASE_URL")
+	str(&c.Auth.Supabase.JWTSecret, "SUPABASE_JWT_SECRET")
+	str(&c.Auth.Supabase.JWKSURL, "SUPABASE_JWKS_URL")
+	str(&c.Auth.Supabase.Issuer, "SUPABASE_JWT_ISSUER")
+	str(&c.Auth.Supabase.Audience, "SUPABASE_JWT_AUDIENCE")
+	list(&c.Auth.Supabase.Roles, "SUPABASE_JWT_ROLES")
+	duration(&c.Auth.Supabase.Leeway, "SUPABASE_JWT_LEEWAY")
+
+	str(&c.Mail.Mailer, "MAILER")
+	str(&c.Mail.From, "MAIL_FROM")
+	str(&c.Mail.File, "MAIL_FILE")
+	str(&c.Mail.SMTPHost, "SMTP_HOST")
+	str(&c.Mail.SMTPPort, "SMTP_PORT")
+	str(&c.Mail.SMTPUsername, "SMTP_USERNAME")
+	str(&c.Mail.SMTPPassword, "SMTP_PASSWORD")
+
+	list(&c.CORS.AllowedOrigins, "ALLOWED_ORIGINS")
+
+	integer(&c.Limits.MaxImportBytes, "MAX_IMPORT_BYTES")
+	emailsPerHour := int64(c.Limits.EmailsPerHour)
+	integer(&emailsPerHour, "EMAILS_PER_HOUR")
+	c.Limits.EmailsPerHour = int(emailsPerHour)
+	str(&c.Limits.RateLimitStore, "RATE_LIMIT_STORE")
+	if value := os.Getenv("TRUST_FORWARDED_FOR"); value != "" {
+		c.Limits.TrustForwardedFor = value == "true"
+	}
+	if value := os.Getenv("RATE_LIMITS"); value != "" {
+		limits, err := parseRateLimits(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("RATE_LIMITS: %w", err))
+		}
+		if c.Limits.RateLimits == nil {
+			c.Limits.RateLimits = map[string]RateLimit{}
+		}
+		for route, limit := range limits {
+			c.Limits.RateLimits[route] = limit
+		}
+	}
+
+	str(&c.Tracing.Exporter, "TRACING_EXPORTER")
+	str(&c.Tracing.Endpoint, "OTEL_EXPORTER_OTLP_ENDPOINT")
+	str(&c.Tracing.ServiceName, "OTEL_SERVICE_NAME")
+	if value := os.Getenv("TRACING_SAMPLE_RATIO"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			errs = append(errs, errors.New("TRACING_SAMPLE_RATIO must be a number"))
+		} else {
+			c.Tracing.SampleRatio = parsed
+		}
+	}
+
+	str(&c.Metrics.Token, "METRICS_TOKEN")
+	str(&c.Metrics.PushURL, "METRICS_PUSH_URL")
+	str(&c.Metrics.PushJob, "METRICS_PUSH_JOB")
+
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := c.Log.Level.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, errors.New("LOG_LEVEL must be debug, info, warn or error"))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate reports every setting that cannot work, naming it as in the file and the environment
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	switch c.Database.Type {
+	case PostgresDB, SQLiteDB:
+	default:
+		invalid("database.type (DB_TYPE) must be postgres or sqlite, not %q", c.Database.Type)
+	}
+	if c.Database.URL == "" {
+		invalid("database.url (DB_URL) is required")
+	}
+	if c.Database.MaxOpenConns < 0 {
+		invalid("database.max_open_conns (DB_MAX_OPEN_CONNS) cannot be negative")
+	}
+
+	if c.Auth.Secret != "" && len(c.Auth.Secret) < minAuthSecretLength {
+		invalid("auth.secret (AUTH_SECRET) must be at least %d characters", minAuthSecretLength)
+	}
+	if c.Auth.Issuer == "" {
+		invalid("auth.issuer (AUTH_ISSUER) cannot be empty")
+	}
+	if c.Auth.SessionTTL <= 0 {
+		invalid("auth.session_ttl (AUTH_SESSION_TTL) must be positive")
+	}
+	if c.Auth.AppURL != "" && !isHTTPURL(c.Auth.AppURL) {
+		invalid("auth.app_url (APP_URL) must be an http or https url")
+	}
+	if len(c.Auth.Apple.ClientIDs) > 0 && c.Auth.Secret == "" {
+		invalid("auth.apple (APPLE_CLIENT_IDS) issues native sessions, set auth.secret (AUTH_SECRET)")
+	}
+	names := map[string]bool{}
+	for _, p := range c.Auth.OIDC {
+		prefix := oidcEnvPrefix(p.Name)
+		if !oidcProviderName.MatchString(p.Name) || p.Name == "apple" {
+			invalid("auth.oidc (OIDC_PROVIDERS) has an invalid provider name %q", p.Name)
+			continue
+		}
+		if names[p.Name] {
+			invalid("auth.oidc (OIDC_PROVIDERS) lists %q twice", p.Name)
+		}
+		names[p.Name] = true
+		if p.Issuer == "" || p.ClientID == "" {
+			invalid("auth.oidc %s needs issuer and client_id (%sISSUER and %sCLIENT_ID)", p.Name, prefix, prefix)
+		}
+	}
+	if c.Auth.Supabase.Leeway < 0 {
+		invalid("auth.supabase.leeway (SUPABASE_JWT_LEEWAY) cannot be negative")
+	}
+
+	switch c.Mail.Mailer {
+	case "":
+		if c.Auth.Secret != "" {
+			invalid("mail.mailer (MAILER) is required by auth.secret (AUTH_SECRET) to send reset and verification emails: smtp, or file or log for development")
+		}
+	case "log":
+	case "file":
+		if c.Mail.File == "" {
+			invalid("mail.file (MAIL_FILE) is required for the file mailer")
+		}
+	case "smtp":
+		if c.Mail.SMTPHost == "" || c.Mail.From == "" {
+			invalid("mail.smtp_host (SMTP_HOST) and mail.from (MAIL_FROM) are required for the smtp mailer")
+		}
+	default:
+		invalid("mail.mailer (MAILER) must be one of log, file or smtp, not %q", c.Mail.Mailer)
+	}
+
+	for _, pattern := range c.CORS.AllowedOrigins {
+		host := pattern
+		if i := strings.Index(pattern, "://"); i >= 0 {
+			host = pattern[i+len("://"):]
+		}
+		switch {
+		case strings.Trim(host, "*") == "":
+			// responses allow credentials, so every site could act as its visitors
+			invalid("cors.allowed_origins (ALLOWED_ORIGINS) cannot allow any host with %q, list the origins instead", pattern)
+		case !originPattern.MatchString(pattern):
+			invalid("cors.allowed_origins (ALLOWED_ORIGINS) has %q, origins are scheme://host such as https://tabit.example.com or chrome-extension://id", pattern)
+		}
+	}
+
+	if c.Limits.MaxImportBytes <= 0 {
+		invalid("limits.max_import_bytes (MAX_IMPORT_BYTES) must be positive")
+	}
+	if c.Limits.EmailsPerHour <= 0 {
+		invalid("limits.emails_per_hour (EMAILS_PER_HOUR) must be positive")
+	}
+	switch c.Limits.RateLimitStore {
+	case "memory":
+	case "postgres":
+		if c.Database.Type != PostgresDB {
+			invalid("limits.rate_limit_store (RATE_LIMIT_STORE) postgres needs database.type (DB_TYPE) postgres")
+		}
+	default:
+		invalid("limits.rate_limit_store (RATE_LIMIT_STORE) must be memory or postgres, not %q", c.Limits.RateLimitStore)
+	}
+	for route, limit := range c.Limits.RateLimits {
+		if !strings.HasPrefix(route, "/") {
+			invalid("limits.rate_limits (RATE_LIMITS) has %q, routes start with /", route)
+		}
+		if limit.Requests == 0 {
+			continue
+		}
+		if limit.Requests < 0 || limit.Per <= 0 || limit.Burst < 0 {
+			invalid("limits.rate_limits (RATE_LIMITS) %s needs positive requests and per", route)
+		}
+		switch limit.By {
+		case "", "user", "ip":
+		default:
+			invalid("limits.rate_limits (RATE_LIMITS) %s must be by user or ip, not %q", route, limit.By)
+		}
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		if c.Tracing.Endpoint != "" && !isHTTPURL(c.Tracing.Endpoint) {
+			invalid("tracing.endpoint (OTEL_EXPORTER_OTLP_ENDPOINT) must be an http or https url")
+		}
+	default:
+		invalid("tracing.exporter (TRACING_EXPORTER) must be one of none, otlp or stdout, not %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		invalid("tracing.sample_ratio (TRACING_SAMPLE_RATIO) must be between 0 and 1")
+	}
+	if c.Tracing.ServiceName == "" {
+		invalid("tracing.service_name (OTEL_SERVICE_NAME) cannot be empty")
+	}
+
+	if c.Metrics.PushURL != "" {
+		if !isHTTPURL(c.Metrics.PushURL) {
+			invalid("metrics.push_url (METRICS_PUSH_URL) must be an http or https url")
+		}
+		if c.Metrics.PushJob == "" {
+			invalid("metrics.push_job (METRICS_PUSH_JOB) is required to push metrics")
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// allowsOrigin reports whether origin matches one of the default or configured origin patterns
+func (c CORSConfig) allowsOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, pattern := range slices.Concat(defaultAllowedOrigins, c.AllowedOrigins) {
+		if matchWildcard(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchWildcard matches value against pattern, where * stands for any run of characters
+func matchWildcard(pattern string, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return len(value) >= len(last) && strings.HasSuffix(value, last)
+}
+
+// oidcProviderName keeps provider names usable in env keys and user ids
+var oidcProviderName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// originPattern matches an origin, or a pattern of one, of any scheme. Origins have no path
+var originPattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://[^/?#\s]+$`)
+
+// oidcEnvPrefix is the start of the environment variables of an OIDC provider
+func oidcEnvPrefix(name string) string {
+	return "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+}
+
+// parseRateLimits reads limits written as ROUTE=REQUESTS/PER, optionally followed by
+// burst=N and by=ip, such as /api/sync=30/1m burst=10,/api/auth/login=10/1m by=ip
+func parseRateLimits(value string) (map[string]RateLimit, error) {
+	limits := map[string]RateLimit{}
+	for _, item := range splitList(value) {
+		route, spec, _ := strings.Cut(item, "=")
+		fields := strings.Fields(spec)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("%q must look like /api/sync=30/1m", item)
+		}
+		var limit RateLimit
+		requests, per, _ := strings.Cut(fields[0], "/")
+		var err error
+		if limit.Requests, err = strconv.Atoi(requests); err != nil {
+			return nil, fmt.Errorf("%q must start with a number of requests", item)
+		}
+		if limit.Requests > 0 {
+			parsed, err := time.ParseDuration(per)
+			if err != nil {
+				return nil, fmt.Errorf("%q: %w", item, err)
+			}
+			limit.Per = Duration(parsed)
+		}
+		for _, option := range fields[1:] {
+			key, value, _ := strings.Cut(option, "=")
+			switch key {
+			case "burst":
+				if limit.Burst, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("%q: burst must be a whole number", item)
+				}
+			case "by":
+				limit.By = value
+			default:
+				return nil, fmt.Errorf("%q: unknown option %q", item, option)
+			}
+		}
+		limits[strings.TrimSpace(route)] = limit
+	}
+	return limits, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func isHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
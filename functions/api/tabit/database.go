@@ -0,0 +1,314 @@
+package tabit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+
+	"tabit-serverless/streak"
+)
+
+// UserModel is an account. Only email and password accounts have an email
+type UserModel struct {
+	UserID          string     `json:"user_id"`
+	Email           *string    `json:"email,omitempty"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+	PasswordHash    *string    `json:"-"`
+	SessionVersion  int64      `json:"-"` // Native sessions with an older version are signed out
+	Anonymous       bool       `json:"is_anonymous"`
+	MergedInto      *string    `json:"-"` // Account an anonymous account was merged into
+	DeletedAt       *time.Time `json:"-"` // Set on the tombstone of an erased account
+	CreatedAt       *time.Time `json:"created_at,omitempty"`
+}
+
+// ExternalIdentity is a user as vouched for by an outside identity provider
+type ExternalIdentity struct {
+	Provider      string // apple, or the name of an OIDC provider
+	Subject       string // Stable id of the user at the provider
+	Email         string // Lowercased, can be empty
+	EmailVerified bool   // The provider checked the user owns Email
+}
+
+// IdentityModel is an outside identity that can sign in to an account
+type IdentityModel struct {
+	Provider  string     `json:"provider"`
+	Subject   string     `json:"subject"`
+	Email     *string    `json:"email,omitempty"` // As reported by the provider when it was linked
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// TokenPurpose is what an emailed one-time token can be used for
+type TokenPurpose string
+
+const (
+	PurposePasswordReset     TokenPurpose = "password_reset"
+	PurposeEmailVerification TokenPurpose = "email_verification"
+)
+
+type UserSyncStateModel struct {
+	UserID      string
+	LastUpdated int64
+	Data        string
+	Cursor      int64 // Latest change in the user's change log
+	Version     int64 // Incremented whenever Data changes
+}
+
+type SyncChangesModel struct {
+	Cursor      int64                `json:"cursor"`
+	Version     int64                `json:"version"`
+	LastUpdated int64                `json:"last_updated"`
+	Full        bool                 `json:"full"` // Changes is the whole state rather than a delta
+	Changes     map[string]HabitData `json:"changes"`
+}
+
+type HabitModel struct {
+	HabitID      int64          `json:"habit_id"`
+	Name         string         `json:"name"`
+	Sort         int            `json:"sort"`
+	WeeklyTarget *int           `json:"weekly_target,omitempty"`
+	CreatedAt    *time.Time     `json:"created_at,omitempty"`
+	Logs         map[string]int `json:"logs"`
+
+	Streak     streak.Info        `json:"streak"`
+	WeeklyGoal *streak.WeeklyGoal `json:"weekly_goal,omitempty"` // Progress this week, only set with a weekly_target
+}
+
+// withProgress fills in the streak and weekly goal as of now.
+// Log days are UTC dates, same as the web client
+func (h *HabitModel) withProgress(now time.Time) *HabitModel {
+	today := now.UTC()
+	h.Streak = streak.Calculate(h.Logs, today)
+	if h.WeeklyTarget != nil {
+		h.WeeklyGoal = streak.Weekly(h.Logs, *h.WeeklyTarget, today)
+	}
+	return h
+}
+
+type HabitLogModel struct {
+	HabitID int64  `json:"habit_id"`
+	Day     string `json:"day"`
+	Count   int    `json:"count"`
+}
+
+// APITokenModel is a personal access token. The token itself is only known when it is created
+type APITokenModel struct {
+	TokenID    int64      `json:"token_id"`
+	UserID     string     `json:"-"`
+	Name       string     `json:"name"`
+	Scopes     []Scope    `json:"scopes"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Token      string     `json:"token,omitempty"`
+}
+
+// DataStore defines the interface for data storage operations
+type DataStore interface {
+	Close() error
+	// SyncUserData merges data into the stored habits and returns the merged result.
+	// If base_version is set and the stored state has moved on, nothing is written
+	// and the current state is returned with a 409
+	SyncUserData(ctx context.Context, user_id string, base_version *int64, last_updated int64, data map[string]HabitData) (*UserSyncStateModel, *HTTPError)
+	// SyncChanges merges a partial update and returns what changed after cursor.
+	// A stale base_version returns the changes after cursor with a 409 without writing
+	SyncChanges(ctx context.Context, user_id string, base_version *int64, cursor int64, last_updated int64, changes map[string]HabitData) (*SyncChangesModel, *HTTPError)
+	// CreateUser records a user the first time one of their sessions is seen. An erased account is a 410
+	CreateUser(ctx context.Context, user_id string) *HTTPError
+	// DeleteUser erases everything stored for a user in one transaction, including anonymous accounts merged into it.
+	// Only a tombstone with the user id is kept, so their sessions get a 410 instead of creating the account again
+	DeleteUser(ctx context.Context, user_id string) *HTTPError
+	// CreatePasswordUser registers an email and password account. A taken email is a 409.
+	// When user_id is an anonymous account, that account keeps its data and becomes permanent
+	CreatePasswordUser(ctx context.Context, user_id string, email string, password_hash string) (*UserModel, *HTTPError)
+	// CreateAnonymousUser creates an account without credentials, or returns it if user_id already exists
+	CreateAnonymousUser(ctx context.Context, user_id string) (*UserModel, *HTTPError)
+	// MergeAnonymousUser moves the habits, logs and sync state of an anonymous account into user_id
+	// and marks it as merged. Sync state is merged field by field keeping the newest change.
+	// Habits that only exist in the habits tables are merged by name, keeping the larger count of a day.
+	// Merging again into the same account does nothing
+	MergeAnonymousUser(ctx context.Context, anonymous_id string, user_id string) *HTTPError
+	// GetUserByEmail finds the account registered with email
+	GetUserByEmail(ctx context.Context, email string) (*UserModel, *HTTPError)
+	GetUser(ctx context.Context, user_id string) (*UserModel, *HTTPError)
+	// UserFromIdentity returns the user linked to identity. An unknown identity is linked to the
+	// account with the same verified email, or to a new account with new_user_id
+	UserFromIdentity(ctx context.Context, identity ExternalIdentity, new_user_id string) (*UserModel, *HTTPError)
+	// LinkIdentity lets identity sign in to user_id. An identity linked to another account is a 409
+	LinkIdentity(ctx context.Context, user_id string, identity ExternalIdentity) *HTTPError
+	GetIdentities(ctx context.Context, user_id string) ([]IdentityModel, *HTTPError)
+	// DeleteIdentity unlinks an identity. The last one cannot be removed from an account without a password
+	DeleteIdentity(ctx context.Context, user_id string, provider string, subject string) *HTTPError
+	// CreateAuthToken stores the hash of a one-time token. It fails with a 429 once
+	// max_per_hour tokens for the same purpose were created in the last hour
+	CreateAuthToken(ctx context.Context, user_id string, purpose TokenPurpose, hash string, expires_at time.Time, max_per_hour int) *HTTPError
+	// ResetPassword uses up a password reset token and replaces the password.
+	// Every native session of the user is signed out and their other reset tokens stop working
+	ResetPassword(ctx context.Context, hash string, password_hash string) (*UserModel, *HTTPError)
+	// VerifyEmail uses up an email verification token and marks the email as verified
+	VerifyEmail(ctx context.Context, hash string) (*UserModel, *HTTPError)
+	// ProjectSyncState rewrites a user's habits and logs from their sync state.
+	// Syncs already do this for the habits they change, it is meant for backfills
+	ProjectSyncState(ctx context.Context, user_id string) *HTTPError
+	// SyncedUsers lists every user that has a sync state
+	SyncedUsers(ctx context.Context) ([]string, *HTTPError)
+	// ExportUser passes the sync state of a user followed by each of their habits to export.
+	// The synced document is read whole, as a sync does. Logs kept only in the habits table
+	// are read one habit at a time
+	ExportUser(ctx context.Context, user_id string, export HabitExport) *HTTPError
+
+	CreateHabit(ctx context.Context, user_id string, req CreateHabitRequest) (*HabitModel, *HTTPError)
+	GetHabits(ctx context.Context, user_id string) ([]HabitModel, *HTTPError)
+	GetHabit(ctx context.Context, user_id string, habit_id int64) (*HabitModel, *HTTPError)
+	UpdateHabit(ctx context.Context, user_id string, habit_id int64, req UpdateHabitRequest) (*HabitModel, *HTTPError)
+	DeleteHabit(ctx context.Context, user_id string, habit_id int64) *HTTPError
+	LogHabit(ctx context.Context, user_id string, habit_id int64, req LogHabitRequest) (*HabitLogModel, *HTTPError)
+
+	CreateAPIToken(ctx context.Context, user_id string, name string, hash string, scopes []Scope, expires_at *time.Time) (*APITokenModel, *HTTPError)
+	GetAPITokens(ctx context.Context, user_id string) ([]APITokenModel, *HTTPError)
+	DeleteAPIToken(ctx context.Context, user_id string, token_id int64) *HTTPError
+	// UseAPIToken finds an unexpired token by its hash and records that it was used
+	UseAPIToken(ctx context.Context, hash string) (*APITokenModel, *HTTPError)
+}
+
+// DBType represents the supported database types
+type DBType string
+
+const (
+	PostgresDB DBType = "postgres"
+	SQLiteDB   DBType = "sqlite"
+)
+
+// PostgresDataStore implements DataStore for PostgreSQL
+type PostgresDataStore struct {
+	DB *sql.DB
+}
+
+// SQLiteDataStore implements DataStore for a single sqlite file
+type SQLiteDataStore struct {
+	DB *sql.DB
+}
+
+// NewDataStore creates a new DataStore based on the provided configuration
+func NewDataStore(dbType DBType, connectionString string) (DataStore, error) {
+	driver := string(dbType)
+	if dbType == SQLiteDB {
+		driver = "sqlite3"
+	}
+	db, err := sql.Open(driver, connectionString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	switch dbType {
+	case PostgresDB:
+		return &PostgresDataStore{DB: db}, nil
+	case SQLiteDB:
+		return newSQLiteDataStore(db)
+	default:
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
+	}
+}
+
+// NewDataStoreFromConfig opens the database of cfg
+func NewDataStoreFromConfig(cfg *Config) (DataStore, error) {
+	if cfg.Database.URL == "" {
+		return nil, errors.New("database connection string is empty")
+	}
+	if cfg.Database.Type == SQLiteDB {
+		slog.Info("Opening database", "type", cfg.Database.Type, "file", cfg.Database.URL)
+	} else {
+		slog.Info("Opening database", "type", cfg.Database.Type, "host", databaseHost(cfg.Database.URL))
+	}
+
+	ds, err := NewDataStore(cfg.Database.Type, cfg.Database.URL)
+	if err != nil {
+		return nil, err
+	}
+	if postgres, ok := ds.(*PostgresDataStore); ok {
+		postgres.DB.SetMaxOpenConns(cfg.Database.MaxOpenConns)
+	}
+	if err := RegisterDBMetrics(ds); err != nil {
+		slog.Warn("Failed to register database metrics", "err", err)
+	}
+	if cfg.Tracing.Exporter != "none" {
+		ds = &tracedStore{DataStore: ds}
+	}
+	return ds, nil
+}
+
+// databaseHost is the host of a postgres connection string, in url or key=value form,
+// so the rest of it, password included, is never logged
+func databaseHost(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	for _, field := range strings.Fields(dsn) {
+		if key, value, ok := strings.Cut(field, "="); ok && key == "host" {
+			return strings.Trim(value, "'")
+		}
+	}
+	return ""
+}
+
+func joinScopes(scopes []Scope) string {
+	parts := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		parts = append(parts, string(scope))
+	}
+	return strings.Join(parts, ",")
+}
+
+func splitScopes(scopes string) []Scope {
+	result := []Scope{}
+	for _, scope := range strings.Split(scopes, ",") {
+		if scope != "" {
+			result = append(result, Scope(scope))
+		}
+	}
+	return result
+}
+
+// checkMerge reports whether anonymous can be merged into user, or already was
+func checkMerge(anonymous *UserModel, user *UserModel) (merged bool, err *HTTPError) {
+	if anonymous.UserID == user.UserID {
+		return false, &HTTPError{Code: http.StatusBadRequest, Message: "Cannot merge an account into itself"}
+	}
+	if !anonymous.Anonymous {
+		return false, &HTTPError{Code: http.StatusConflict, Message: "Only anonymous accounts can be merged"}
+	}
+	if anonymous.MergedInto != nil {
+		if *anonymous.MergedInto == user.UserID {
+			return true, nil
+		}
+		return false, &HTTPError{Code: http.StatusConflict, Message: "Anonymous account was already merged into another account"}
+	}
+	if user.Anonymous {
+		return false, &HTTPError{Code: http.StatusBadRequest, Message: "Cannot merge into an anonymous account"}
+	}
+	return false, nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
@@ -0,0 +1,292 @@
+package tabit
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// ExportSchemaVersion is bumped whenever the layout of an export changes
+const ExportSchemaVersion = 1
+
+// HabitExport receives a user's habits one at a time as they are read
+type HabitExport interface {
+	// Begin is called once before the first habit. state is nil when the user never synced
+	Begin(state *UserSyncStateModel) error
+	// Habit is called for every habit in name order
+	Habit(name string, habit HabitData) error
+}
+
+// ExportMetadata describes an export. It leads the JSON document and makes up the ZIP manifest
+type ExportMetadata struct {
+	SchemaVersion int       `json:"schema_version"`
+	ExportedAt    time.Time `json:"exported_at"`
+	UserID        string    `json:"user_id"`
+	Version       int64     `json:"version"`      // Sync version the export was taken at
+	LastUpdated   int64     `json:"last_updated"` // Unix milliseconds UTC of the last sync
+}
+
+// exportManifest is manifest.json in a ZIP export
+type exportManifest struct {
+	ExportMetadata
+	Files  []string `json:"files"`
+	Habits int      `json:"habits"`
+	Rows   int      `json:"rows"` // Rows in habits.csv, not counting the header
+}
+
+// exportedHabit is a row of the habits table
+type exportedHabit struct {
+	id           int64
+	sort         int
+	weeklyTarget *int
+}
+
+// exportHabits sends a user's sync state combined with their habits table to export.
+// The sync state wins, the table adds habits created through the habits API and the days logged there.
+// logs reads the days of a single habit so only one habit's history is held at a time
+func exportHabits(state *UserSyncStateModel, habits map[string]exportedHabit, logs func(habit_id int64) (map[string]int, error), export HabitExport) error {
+	synced := map[string]HabitData{}
+	if state != nil {
+		if err := json.Unmarshal([]byte(state.Data), &synced); err != nil {
+			return err
+		}
+	}
+	names := slices.Collect(maps.Keys(synced))
+	for name := range habits {
+		if _, ok := synced[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	if err := export.Begin(state); err != nil {
+		return err
+	}
+	for _, name := range names {
+		habit, ok := synced[name]
+		if row, found := habits[name]; found {
+			if !ok {
+				habit = HabitData{Sort: row.sort}
+				if row.weeklyTarget != nil {
+					habit.WeeklyGoal = *row.weeklyTarget
+				}
+			}
+			days, err := logs(row.id)
+			if err != nil {
+				return err
+			}
+			if habit.Logs == nil {
+				habit.Logs = make(map[string]int, len(days))
+			}
+			for day, count := range days {
+				if _, ok := habit.Logs[day]; !ok {
+					habit.Logs[day] = count
+				}
+			}
+		}
+		if habit.Logs == nil {
+			habit.Logs = map[string]int{}
+		}
+		if err := export.Habit(name, habit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportWriter writes an export in one format. Close finishes the file after the last habit.
+// Abort releases what the writer holds without finishing the file, and does nothing after Close
+type exportWriter interface {
+	HabitExport
+	Close() error
+	Abort()
+}
+
+// exportFormats maps the format parameter of an export to its content type and file extension
+var exportFormats = map[string]struct {
+	contentType string
+	extension   string
+}{
+	"json": {"application/json", "json"},
+	"csv":  {"text/csv; charset=utf-8", "csv"},
+	"zip":  {"application/zip", "zip"},
+}
+
+// newExportWriter writes an export of user_id to w in format
+func newExportWriter(format string, w io.Writer, user_id string, exported_at time.Time) (exportWriter, error) {
+	metadata := ExportMetadata{SchemaVersion: ExportSchemaVersion, ExportedAt: exported_at.UTC(), UserID: user_id}
+	switch format {
+	case "json":
+		return &jsonExport{w: w, metadata: metadata}, nil
+	case "csv":
+		return &csvExport{w: csv.NewWriter(w)}, nil
+	case "zip":
+		return &zipExport{zip: zip.NewWriter(w), json: jsonExport{metadata: metadata}}, nil
+	default:
+		return nil, errors.New("format must be one of json, csv or zip")
+	}
+}
+
+// jsonExport writes the metadata followed by habit_data, the same document that is synced
+type jsonExport struct {
+	w        io.Writer
+	metadata ExportMetadata
+	habits   int
+}
+
+func (e *jsonExport) Begin(state *UserSyncStateModel) error {
+	if state != nil {
+		e.metadata.Version = state.Version
+		e.metadata.LastUpdated = state.LastUpdated
+	}
+	header, err := json.Marshal(e.metadata)
+	if err != nil {
+		return err
+	}
+	// reopen the metadata object to stream habit_data into it
+	header = append(header[:len(header)-1], `,"habit_data":{`...)
+	_, err = e.w.Write(header)
+	return err
+}
+
+func (e *jsonExport) Habit(name string, habit HabitData) error {
+	key, err := json.Marshal(name)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(habit)
+	if err != nil {
+		return err
+	}
+	entry := make([]byte, 0, len(key)+len(value)+2)
+	if e.habits > 0 {
+		entry = append(entry, ',')
+	}
+	entry = append(append(append(entry, key...), ':'), value...)
+	e.habits++
+	_, err = e.w.Write(entry)
+	return err
+}
+
+func (e *jsonExport) Close() error {
+	_, err := io.WriteString(e.w, "}}\n")
+	return err
+}
+
+func (e *jsonExport) Abort() {}
+
+// csvExport writes a row for every day a habit was logged
+type csvExport struct {
+	w    *csv.Writer
+	rows int
+}
+
+func (e *csvExport) Begin(state *UserSyncStateModel) error {
+	return e.w.Write([]string{"habit", "day", "count"})
+}
+
+func (e *csvExport) Habit(name string, habit HabitData) error {
+	logged, _ := projectedLogs(habit)
+	for _, day := range slices.Sorted(maps.Keys(logged)) {
+		if err := e.w.Write([]string{name, day, strconv.Itoa(logged[day])}); err != nil {
+			return err
+		}
+		e.rows++
+	}
+	return nil
+}
+
+func (e *csvExport) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvExport) Abort() {}
+
+// zipExport bundles the JSON and CSV exports with a manifest.
+// Entries are written one after another, so the CSV is kept in a temporary file until the JSON is done
+type zipExport struct {
+	zip  *zip.Writer
+	json jsonExport
+	csv  csvExport
+	temp *os.File
+}
+
+func (e *zipExport) Begin(state *UserSyncStateModel) error {
+	w, err := e.zip.Create("habits.json")
+	if err != nil {
+		return err
+	}
+	e.json.w = w
+	e.temp, err = os.CreateTemp("", "tabit-export-*.csv")
+	if err != nil {
+		return err
+	}
+	// unlinked right away so it is cleaned up even if the export fails
+	os.Remove(e.temp.Name())
+	e.csv.w = csv.NewWriter(e.temp)
+	if err := e.json.Begin(state); err != nil {
+		return err
+	}
+	return e.csv.Begin(state)
+}
+
+func (e *zipExport) Habit(name string, habit HabitData) error {
+	if err := e.json.Habit(name, habit); err != nil {
+		return err
+	}
+	return e.csv.Habit(name, habit)
+}
+
+func (e *zipExport) Close() error {
+	defer e.Abort()
+	if err := e.json.Close(); err != nil {
+		return err
+	}
+	if err := e.csv.Close(); err != nil {
+		return err
+	}
+	if _, err := e.temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w, err := e.zip.Create("habits.csv")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, e.temp); err != nil {
+		return err
+	}
+
+	manifest, err := json.MarshalIndent(exportManifest{
+		ExportMetadata: e.json.metadata,
+		Files:          []string{"habits.json", "habits.csv"},
+		Habits:         e.json.habits,
+		Rows:           e.csv.rows,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	w, err = e.zip.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(manifest); err != nil {
+		return err
+	}
+	return e.zip.Close()
+}
+
+// Abort closes the temporary CSV file, which was unlinked when it was created
+func (e *zipExport) Abort() {
+	if e.temp != nil {
+		e.temp.Close()
+		e.temp = nil
+	}
+}
@@ -0,0 +1,177 @@
+package tabit
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"time"
+)
+
+// ImportStrategy decides what happens to an imported habit with the name of an existing one
+type ImportStrategy string
+
+const (
+	ImportMerge   ImportStrategy = "merge"   // Days logged in both keep the larger count, the existing goal and sort are kept
+	ImportReplace ImportStrategy = "replace" // The existing habit's days, goal and sort are overwritten
+	ImportSkip    ImportStrategy = "skip"    // The existing habit is left alone
+	ImportRename  ImportStrategy = "rename"  // The imported habit is added under a free name such as "Run (2)"
+)
+
+// ImportResult reports what an import changed, or would change on a dry run
+type ImportResult struct {
+	DryRun  bool            `json:"dry_run"`
+	Source  string          `json:"source"`  // loop_csv or loop_sqlite
+	Version int64           `json:"version"` // Sync version after the import
+	Habits  []ImportedHabit `json:"habits"`
+}
+
+// ImportedHabit is what happened to one habit of an import
+type ImportedHabit struct {
+	Name        string `json:"name"`            // Name in the imported file
+	Habit       string `json:"habit,omitempty"` // Habit it was imported into, empty when skipped
+	Action      string `json:"action"`          // create, merge, replace or skip
+	Days        int    `json:"days"`            // Days logged in the imported file
+	ChangedDays int    `json:"changed_days"`    // Days that were added, changed or cleared
+	WeeklyGoal  int    `json:"weekly_goal"`
+}
+
+// importedHabit is a habit read from another tracker
+type importedHabit struct {
+	name       string
+	sort       int
+	weeklyGoal int
+	logs       map[string]int
+}
+
+// currentHabits collects a user's habits through ExportUser
+type currentHabits struct {
+	version int64
+	habits  map[string]HabitData
+}
+
+func (c *currentHabits) Begin(state *UserSyncStateModel) error {
+	if state != nil {
+		c.version = state.Version
+	}
+	return nil
+}
+
+func (c *currentHabits) Habit(name string, habit HabitData) error {
+	c.habits[name] = habit
+	return nil
+}
+
+// importHabits adds habits read from another tracker to user_id's habits.
+// They are written as a sync from a new device, so clients pick them up on their next sync
+func importHabits(ctx context.Context, ds DataStore, user_id string, source string, habits []importedHabit, strategy ImportStrategy, dry_run bool) (*ImportResult, *HTTPError) {
+	current := &currentHabits{habits: map[string]HabitData{}}
+	if db_err := ds.ExportUser(ctx, user_id, current); db_err != nil {
+		return nil, db_err
+	}
+	now := time.Now().UnixMilli()
+	changes, report := planImport(current.habits, habits, strategy, now)
+	result := &ImportResult{DryRun: dry_run, Source: source, Version: current.version, Habits: report}
+	if dry_run || len(changes) == 0 {
+		return result, nil
+	}
+
+	// the plan was made from this version, so a sync in between has to be planned again
+	synced, db_err := ds.SyncChanges(ctx, user_id, &current.version, 0, now, changes)
+	if db_err != nil {
+		if db_err.Code == http.StatusConflict {
+			return nil, &HTTPError{Code: http.StatusConflict, Message: "Habits changed during the import, try again"}
+		}
+		return nil, db_err
+	}
+	result.Version = synced.Version
+	return result, nil
+}
+
+// planImport works out the sync changes that add imported to existing, stamped with now
+func planImport(existing map[string]HabitData, imported []importedHabit, strategy ImportStrategy, now int64) (map[string]HabitData, []ImportedHabit) {
+	existing = maps.Clone(existing)
+	changes := map[string]HabitData{}
+	report := make([]ImportedHabit, 0, len(imported))
+	for _, habit := range imported {
+		if habit.name == "" {
+			continue
+		}
+		result := ImportedHabit{Name: habit.name, Habit: habit.name, Action: "create", Days: len(habit.logs), WeeklyGoal: habit.weeklyGoal}
+		current, taken := existing[habit.name]
+		if taken && current.isDeleted() {
+			taken, current = false, HabitData{}
+		}
+
+		change := HabitData{
+			Logs:                map[string]int{},
+			LogsUpdatedAt:       map[string]int64{},
+			WeeklyGoal:          habit.weeklyGoal,
+			WeeklyGoalUpdatedAt: now,
+			Sort:                habit.sort,
+			SortUpdatedAt:       now,
+		}
+		if taken {
+			switch strategy {
+			case ImportSkip:
+				result.Action, result.Habit = "skip", ""
+				report = append(report, result)
+				continue
+			case ImportRename:
+				result.Habit = freeHabitName(existing, habit.name)
+				current = HabitData{}
+			case ImportReplace:
+				result.Action = "replace"
+				for day, count := range current.Logs {
+					if _, ok := habit.logs[day]; !ok && count > 0 {
+						change.Logs[day], change.LogsUpdatedAt[day] = 0, now
+						result.ChangedDays++
+					}
+				}
+			default:
+				result.Action = "merge"
+				// restated so the habits table keeps them for habits that were never synced
+				change.WeeklyGoal, change.Sort = current.WeeklyGoal, current.Sort
+			}
+		}
+		for day, count := range habit.logs {
+			kept := current.Logs[day]
+			if kept == count || (result.Action == "merge" && kept > count) {
+				continue
+			}
+			change.Logs[day], change.LogsUpdatedAt[day] = count, now
+			result.ChangedDays++
+		}
+		if result.Action != "create" && len(change.Logs) == 0 && change.WeeklyGoal == current.WeeklyGoal && change.Sort == current.Sort {
+			report = append(report, result)
+			continue
+		}
+
+		// later habits with the same name see this one
+		updated := HabitData{Logs: maps.Clone(current.Logs), WeeklyGoal: change.WeeklyGoal, Sort: change.Sort}
+		if updated.Logs == nil {
+			updated.Logs = map[string]int{}
+		}
+		maps.Copy(updated.Logs, change.Logs)
+		existing[result.Habit] = updated
+		if previous, ok := changes[result.Habit]; ok {
+			maps.Copy(previous.Logs, change.Logs)
+			maps.Copy(previous.LogsUpdatedAt, change.LogsUpdatedAt)
+			previous.WeeklyGoal, previous.Sort = change.WeeklyGoal, change.Sort
+			change = previous
+		}
+		changes[result.Habit] = change
+		report = append(report, result)
+	}
+	return changes, report
+}
+
+// freeHabitName returns name followed by the first number that is not taken, such as "Run (2)"
+func freeHabitName(existing map[string]HabitData, name string) string {
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)", name, i)
+		if habit, ok := existing[candidate]; !ok || habit.isDeleted() {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package tabit
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestPlanImport(t *testing.T) {
+	const now = 1000
+	existing := map[string]HabitData{
+		"Run":     {Logs: map[string]int{"2026-01-01": 2, "2026-01-02": 1}, WeeklyGoal: 3, Sort: 1},
+		"Run (2)": {Logs: map[string]int{}},
+		"Gone":    {Logs: map[string]int{}, DeletedAt: 500},
+	}
+	run := importedHabit{name: "Run", sort: 4, weeklyGoal: 5, logs: map[string]int{"2026-01-01": 1, "2026-01-03": 1}}
+	// created is the change that adds habit as it was imported
+	created := func(habit importedHabit) HabitData {
+		change := HabitData{Logs: habit.logs, LogsUpdatedAt: map[string]int64{}, WeeklyGoal: habit.weeklyGoal, WeeklyGoalUpdatedAt: now, Sort: habit.sort, SortUpdatedAt: now}
+		for day := range habit.logs {
+			change.LogsUpdatedAt[day] = now
+		}
+		return change
+	}
+
+	tests := []struct {
+		name        string
+		imported    []importedHabit
+		strategy    ImportStrategy
+		wantChanges map[string]HabitData
+		wantReport  []ImportedHabit
+	}{
+		{
+			name:        "a new habit is created",
+			imported:    []importedHabit{{name: "Read", sort: 2, logs: map[string]int{"2026-01-01": 1}}},
+			strategy:    ImportMerge,
+			wantChanges: map[string]HabitData{"Read": created(importedHabit{sort: 2, logs: map[string]int{"2026-01-01": 1}})},
+			wantReport:  []ImportedHabit{{Name: "Read", Habit: "Read", Action: "create", Days: 1, ChangedDays: 1}},
+		},
+		{
+			name:     "merge keeps the larger count and the existing goal and sort",
+			imported: []importedHabit{run},
+			strategy: ImportMerge,
+			wantChanges: map[string]HabitData{"Run": {
+				Logs:                map[string]int{"2026-01-03": 1},
+				LogsUpdatedAt:       map[string]int64{"2026-01-03": now},
+				WeeklyGoal:          3,
+				WeeklyGoalUpdatedAt: now,
+				Sort:                1,
+				SortUpdatedAt:       now,
+			}},
+			wantReport: []ImportedHabit{{Name: "Run", Habit: "Run", Action: "merge", Days: 2, ChangedDays: 1, WeeklyGoal: 5}},
+		},
+		{
+			name:        "merging days that are already logged changes nothing",
+			imported:    []importedHabit{{name: "Run", logs: map[string]int{"2026-01-01": 1, "2026-01-02": 1}}},
+			strategy:    ImportMerge,
+			wantChanges: map[string]HabitData{},
+			wantReport:  []ImportedHabit{{Name: "Run", Habit: "Run", Action: "merge", Days: 2}},
+		},
+		{
+			name:     "replace clears the days missing from the import",
+			imported: []importedHabit{run},
+			strategy: ImportReplace,
+			wantChanges: map[string]HabitData{"Run": {
+				Logs:                map[string]int{"2026-01-01": 1, "2026-01-02": 0, "2026-01-03": 1},
+				LogsUpdatedAt:       map[string]int64{"2026-01-01": now, "2026-01-02": now, "2026-01-03": now},
+				WeeklyGoal:          5,
+				WeeklyGoalUpdatedAt: now,
+				Sort:                4,
+				SortUpdatedAt:       now,
+			}},
+			wantReport: []ImportedHabit{{Name: "Run", Habit: "Run", Action: "replace", Days: 2, ChangedDays: 3, WeeklyGoal: 5}},
+		},
+		{
+			name:        "skip leaves the existing habit alone",
+			imported:    []importedHabit{run},
+			strategy:    ImportSkip,
+			wantChanges: map[string]HabitData{},
+			wantReport:  []ImportedHabit{{Name: "Run", Action: "skip", Days: 2, WeeklyGoal: 5}},
+		},
+		{
+			name:        "rename picks the first free name",
+			imported:    []importedHabit{run},
+			strategy:    ImportRename,
+			wantChanges: map[string]HabitData{"Run (3)": created(run)},
+			wantReport:  []ImportedHabit{{Name: "Run", Habit: "Run (3)", Action: "create", Days: 2, ChangedDays: 2, WeeklyGoal: 5}},
+		},
+		{
+			name:        "the name of a deleted habit is free",
+			imported:    []importedHabit{{name: "Gone", logs: map[string]int{"2026-01-01": 1}}},
+			strategy:    ImportSkip,
+			wantChanges: map[string]HabitData{"Gone": created(importedHabit{logs: map[string]int{"2026-01-01": 1}})},
+			wantReport:  []ImportedHabit{{Name: "Gone", Habit: "Gone", Action: "create", Days: 1, ChangedDays: 1}},
+		},
+		{
+			name:        "habits without a name are dropped",
+			imported:    []importedHabit{{logs: map[string]int{"2026-01-01": 1}}},
+			strategy:    ImportMerge,
+			wantChanges: map[string]HabitData{},
+			wantReport:  []ImportedHabit{},
+		},
+		{
+			name: "a name repeated in the import merges into one change",
+			imported: []importedHabit{
+				{name: "Read", logs: map[string]int{"2026-01-01": 1}},
+				{name: "Read", logs: map[string]int{"2026-01-01": 2, "2026-01-02": 1}},
+			},
+			strategy:    ImportMerge,
+			wantChanges: map[string]HabitData{"Read": created(importedHabit{logs: map[string]int{"2026-01-01": 2, "2026-01-02": 1}})},
+			wantReport: []ImportedHabit{
+				{Name: "Read", Habit: "Read", Action: "create", Days: 1, ChangedDays: 1},
+				{Name: "Read", Habit: "Read", Action: "merge", Days: 2, ChangedDays: 2},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes, report := planImport(existing, tt.imported, tt.strategy, now)
+			got, _ := json.Marshal(changes)
+			if want, _ := json.Marshal(tt.wantChanges); string(got) != string(want) {
+				t.Errorf("changes = %s, want %s", got, want)
+			}
+			if !slices.Equal(report, tt.wantReport) {
+				t.Errorf("report = %+v, want %+v", report, tt.wantReport)
+			}
+		})
+	}
+
+	if _, ok := existing["Run (3)"]; ok {
+		t.Error("planImport modified the existing habits")
+	}
+}
@@ -0,0 +1,219 @@
+package tabit
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwksRefreshInterval limits how often an unknown key id triggers a refetch
+const jwksRefreshInterval = time.Minute
+
+// jwksFetchTimeout bounds a fetch, which every request waiting for a key shares
+const jwksFetchTimeout = 10 * time.Second
+
+// jwks caches the public keys of a JSON Web Key Set.
+// source is an http(s) URL, a file:// URL or a plain file path
+type jwks struct {
+	source string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]any
+	fetched time.Time
+	// fetching is closed when the fetch in flight is done, and nil when there is none
+	fetching chan struct{}
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func newJWKS(source string) *jwks {
+	return &jwks{source: source, client: &http.Client{Timeout: jwksFetchTimeout}}
+}
+
+// key returns the public key for kid, refetching the set once if kid is unknown.
+// The set is fetched without holding the lock, and requests arriving during a fetch wait for it
+// instead of starting their own
+func (k *jwks) key(ctx context.Context, kid string) (any, error) {
+	k.mu.Lock()
+	for {
+		if key, ok := k.keys[kid]; ok {
+			k.mu.Unlock()
+			return key, nil
+		}
+		if k.fetching == nil {
+			break
+		}
+		fetching := k.fetching
+		k.mu.Unlock()
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		k.mu.Lock()
+	}
+	if !k.fetched.IsZero() && time.Since(k.fetched) < jwksRefreshInterval {
+		k.mu.Unlock()
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	fetching := make(chan struct{})
+	k.fetching = fetching
+	k.mu.Unlock()
+
+	// the fetch is shared, so it does not end with the request that started it
+	fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jwksFetchTimeout)
+	keys, err := k.fetch(fetchCtx)
+	cancel()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	// even a failed fetch waits for the interval so a broken source is not hammered
+	k.fetched = time.Now()
+	if err == nil {
+		k.keys = keys
+	}
+	k.fetching = nil
+	close(fetching)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch jwks: %w", err)
+	}
+	if key, ok := k.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+func (k *jwks) fetch(ctx context.Context) (map[string]any, error) {
+	var body []byte
+	if strings.HasPrefix(k.source, "http://") || strings.HasPrefix(k.source, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.source, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := k.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %d", res.StatusCode)
+		}
+		body, err = io.ReadAll(io.LimitReader(res.Body, 1<<20))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		body, err = os.ReadFile(strings.TrimPrefix(k.source, "file://"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parseJWKS(body)
+}
+
+// parseJWKS reads the signing keys of a key set. Keys it cannot use are skipped
+func parseJWKS(body []byte) (map[string]any, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]any, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (any, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, errors.New("rsa exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		// ECDH rejects points that are not on the curve
+		if _, err := key.ECDH(); err != nil {
+			return nil, err
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(bytes), nil
+}
@@ -0,0 +1,197 @@
+package tabit
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is a private key published in a test key set under kid
+type signingKey struct {
+	kid string
+	key crypto.Signer
+}
+
+func newRSAKey(t *testing.T, kid string) signingKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingKey{kid: kid, key: key}
+}
+
+func newECKey(t *testing.T, kid string) signingKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingKey{kid: kid, key: key}
+}
+
+// publicJWK is the key set entry of k
+func (k signingKey) publicJWK(t *testing.T) jsonWebKey {
+	t.Helper()
+	encode := base64.RawURLEncoding.EncodeToString
+	switch key := k.key.(type) {
+	case *rsa.PrivateKey:
+		return jsonWebKey{Kid: k.kid, Kty: "RSA", Use: "sig", N: encode(key.N.Bytes()), E: encode(big.NewInt(int64(key.E)).Bytes())}
+	case *ecdsa.PrivateKey:
+		public, err := key.PublicKey.ECDH()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// an uncompressed point is 0x04 followed by x and y
+		point := public.Bytes()[1:]
+		return jsonWebKey{Kid: k.kid, Kty: "EC", Use: "sig", Crv: "P-256", X: encode(point[:32]), Y: encode(point[32:])}
+	default:
+		t.Fatalf("unsupported key %T", k.key)
+		return jsonWebKey{}
+	}
+}
+
+// sign returns a token with claims signed by k
+func (k signingKey) sign(t *testing.T, claims jwt.Claims) string {
+	t.Helper()
+	method := jwt.SigningMethod(jwt.SigningMethodRS256)
+	if _, ok := k.key.(*ecdsa.PrivateKey); ok {
+		method = jwt.SigningMethodES256
+	}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = k.kid
+	signed, err := token.SignedString(k.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// writeKeySet publishes the public keys of keys in a key set file and returns its file:// url
+func writeKeySet(t *testing.T, path string, keys ...signingKey) string {
+	t.Helper()
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	for _, key := range keys {
+		set.Keys = append(set.Keys, key.publicJWK(t))
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return "file://" + path
+}
+
+func TestParseJWKS(t *testing.T) {
+	rsaKey := newRSAKey(t, "rsa").publicJWK(t)
+	ecKey := newECKey(t, "ec").publicJWK(t)
+	encryption := rsaKey
+	encryption.Kid, encryption.Use = "enc", "enc"
+	offCurve := ecKey
+	offCurve.Kid, offCurve.Y = "off-curve", ecKey.X
+
+	tests := []struct {
+		name     string
+		keys     []jsonWebKey
+		wantKids []string
+		wantErr  bool
+	}{
+		{name: "rsa and ec keys", keys: []jsonWebKey{rsaKey, ecKey}, wantKids: []string{"ec", "rsa"}},
+		{name: "encryption keys are skipped", keys: []jsonWebKey{rsaKey, encryption}, wantKids: []string{"rsa"}},
+		{name: "unsupported key types are skipped", keys: []jsonWebKey{ecKey, {Kid: "oct", Kty: "oct"}}, wantKids: []string{"ec"}},
+		{name: "points off the curve are skipped", keys: []jsonWebKey{rsaKey, offCurve}, wantKids: []string{"rsa"}},
+		{name: "a set without usable keys", keys: []jsonWebKey{encryption}, wantErr: true},
+		{name: "an empty set", keys: nil, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(map[string][]jsonWebKey{"keys": tt.keys})
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, err := parseJWKS(body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want an error: %v", err, tt.wantErr)
+			}
+			if len(keys) != len(tt.wantKids) {
+				t.Errorf("parsed %d keys, want %v", len(keys), tt.wantKids)
+			}
+			for _, kid := range tt.wantKids {
+				if _, ok := keys[kid]; !ok {
+					t.Errorf("key %q is missing", kid)
+				}
+			}
+		})
+	}
+}
+
+func TestJWKSRefetchesUnknownKeys(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	first, second := newECKey(t, "first"), newECKey(t, "second")
+	keys := newJWKS(writeKeySet(t, path, first))
+
+	if _, err := keys.key(ctx, "first"); err != nil {
+		t.Fatal(err)
+	}
+	// a rotation is only picked up once the last fetch is old enough
+	writeKeySet(t, path, first, second)
+	if _, err := keys.key(ctx, "second"); err == nil {
+		t.Error("an unknown key was refetched within the refresh interval")
+	}
+	keys.fetched = time.Now().Add(-jwksRefreshInterval)
+	if _, err := keys.key(ctx, "second"); err != nil {
+		t.Errorf("the rotated key was not fetched: %v", err)
+	}
+	if _, err := keys.key(ctx, "unknown"); err == nil {
+		t.Error("an unknown key id was accepted")
+	}
+}
+
+func TestJWKSSharesFetches(t *testing.T) {
+	key := newECKey(t, "key")
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		json.NewEncoder(w).Encode(map[string][]jsonWebKey{"keys": {key.publicJWK(t)}})
+	}))
+	defer server.Close()
+	keys := newJWKS(server.URL)
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := keys.key(context.Background(), "key"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("fetched the key set %d times, want once", got)
+	}
+}
@@ -0,0 +1,176 @@
+package tabit
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern is what an incoming X-Request-ID has to look like to be kept
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// secretKeys are log attributes that are never written
+var secretKeys = map[string]bool{
+	"password":        true,
+	"secret":          true,
+	"authorization":   true,
+	"cookie":          true,
+	"access_token":    true,
+	"id_token":        true,
+	"anonymous_token": true,
+	"jwt_secret":      true,
+	"smtp_password":   true,
+}
+
+// secretPatterns find secrets inside logged strings, such as a DSN or an error quoting a header.
+// The first group is kept, and the second when there is one
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(password=)\S+`),
+	regexp.MustCompile(`(?i)(bearer )\S+`),
+	regexp.MustCompile(`(?i)(token=)[^&\s"]+`), // reset and verification links, id_token=...
+	regexp.MustCompile(`(tabit_(?:pat|reset|verify)_)[\w-]+`),
+	regexp.MustCompile(`(\w+://)[^/?#\s]+(@)`),        // user and password of a url
+	regexp.MustCompile(`()eyJ[\w-]*\.[\w-]+\.[\w-]+`), // JWTs, such as sessions and Apple and OIDC id tokens
+}
+
+// NewLogger writes JSON log lines to w with secrets redacted
+func NewLogger(w io.Writer, cfg LogConfig) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       cfg.Level,
+		ReplaceAttr: redactAttr,
+	}))
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if secretKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, "[REDACTED]")
+	}
+	switch value := a.Value.Any().(type) {
+	case string:
+		return slog.String(a.Key, redactString(value))
+	case error:
+		return slog.String(a.Key, redactString(value.Error()))
+	}
+	return a
+}
+
+// redactString hides the secrets matched by secretPatterns
+func redactString(s string) string {
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllString(s, "${1}[REDACTED]${2}")
+	}
+	return s
+}
+
+// requestLog is the logging state of a request, kept in its context
+type requestLog struct {
+	logger *slog.Logger
+	userID string
+}
+
+type requestLogKey struct{}
+
+// Logger returns the logger of the request ctx belongs to, which adds its request id
+// and, once authenticated, its user. Outside of a request it is the default logger
+func Logger(ctx context.Context) *slog.Logger {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return rl.logger
+	}
+	return slog.Default()
+}
+
+// setRequestUser adds user_id to the remaining log lines of the request
+func setRequestUser(ctx context.Context, user_id string) {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok && rl.userID != user_id {
+		rl.userID = user_id
+		rl.logger = rl.logger.With("user_id", user_id)
+	}
+}
+
+// statusRecorder remembers the status and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer to flush streamed exports
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logRequests gives every request an X-Request-ID, keeping a well formed one sent by the client,
+// puts a logger with it into the context and logs and counts the request once it is done
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		request_id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(request_id) {
+			request_id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, request_id)
+		var route string
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+
+		logger := slog.Default().With("request_id", request_id)
+		if span := trace.SpanContextFromContext(r.Context()); span.IsValid() {
+			logger = logger.With("trace_id", span.TraceID().String())
+		}
+		rl := &requestLog{logger: logger}
+		ctx := context.WithValue(r.Context(), requestLogKey{}, rl)
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			aborted := recover()
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			level := slog.LevelInfo
+			if aborted != nil || status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+			elapsed := time.Since(start)
+			observeRequest(r.Method, route, status, elapsed)
+			rl.logger.LogAttrs(ctx, level, "request",
+				slog.String("method", r.Method),
+				slog.String("route", route),
+				slog.Int("status", status),
+				slog.Float64("latency_ms", float64(elapsed.Microseconds())/1000),
+				slog.Int64("bytes", recorder.bytes),
+				slog.Bool("aborted", aborted != nil),
+			)
+			if aborted != nil {
+				panic(aborted)
+			}
+		}()
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+	})
+}
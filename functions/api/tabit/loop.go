@@ -0,0 +1,279 @@
+package tabit
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// loopYesManual is the value of a day the user checked off. Loop also stores days it
+	// filled in from the habit's frequency (1), misses (0), skips (3) and unknown days (-1)
+	loopYesManual = 2
+	// loopNumerical is the type of habits that log an amount, stored multiplied by 1000
+	loopNumerical = 1
+	// maxLoopFileSize caps each file read from a CSV export, which is compressed
+	maxLoopFileSize = 32 << 20
+)
+
+// loopHabitDir matches the per-habit folders of a CSV export, such as "001 Meditate"
+var loopHabitDir = regexp.MustCompile(`^(\d+) `)
+
+// readLoopBackup reads the habits and checked off days of a Loop Habit Tracker export.
+// data is either the zip from "Export as CSV" or the database from "Export full backup".
+// It returns which of the two it was
+func readLoopBackup(ctx context.Context, data []byte) (string, []importedHabit, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("SQLite format 3\x00")):
+		habits, err := readLoopSQLite(ctx, data)
+		return "loop_sqlite", habits, err
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		habits, err := readLoopCSV(data)
+		return "loop_csv", habits, err
+	default:
+		return "", nil, errors.New("expected the CSV export zip or the full backup of Loop Habit Tracker")
+	}
+}
+
+// readLoopCSV reads Habits.csv and the Checkmarks.csv in each habit's folder.
+// Folders start with the habit's Position in Habits.csv
+func readLoopCSV(data []byte) ([]importedHabit, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid zip: %w", err)
+	}
+	var habitsFile *zip.File
+	checkmarks := map[int]*zip.File{}
+	for _, f := range archive.File {
+		dir, name := path.Split(f.Name)
+		switch name {
+		case "Habits.csv":
+			if habitsFile == nil || len(f.Name) < len(habitsFile.Name) {
+				habitsFile = f
+			}
+		case "Checkmarks.csv":
+			match := loopHabitDir.FindStringSubmatch(path.Base(dir))
+			if match == nil {
+				continue // the combined file at the root has a column per habit
+			}
+			position, err := strconv.Atoi(match[1])
+			if err == nil {
+				checkmarks[position] = f
+			}
+		}
+	}
+	if habitsFile == nil {
+		return nil, errors.New("Habits.csv not found in zip")
+	}
+
+	rows, err := readLoopCSVFile(habitsFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("Habits.csv is empty")
+	}
+	columns := make(map[string]int, len(rows[0]))
+	for i, column := range rows[0] {
+		columns[strings.TrimSpace(strings.TrimPrefix(column, "\ufeff"))] = i
+	}
+	field := func(row []string, names ...string) string {
+		for _, name := range names {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+		}
+		return ""
+	}
+	if _, ok := columns["Name"]; !ok {
+		return nil, errors.New("Habits.csv has no Name column")
+	}
+
+	habits := make([]importedHabit, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		position, err := strconv.Atoi(field(row, "Position"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid position in Habits.csv: %w", err)
+		}
+		numerator, _ := strconv.Atoi(field(row, "FrequencyNumerator", "NumRepetitions"))
+		denominator, _ := strconv.Atoi(field(row, "FrequencyDenominator", "Interval"))
+		habit := importedHabit{
+			name:       field(row, "Name"),
+			sort:       position,
+			weeklyGoal: loopWeeklyGoal(numerator, denominator),
+			logs:       map[string]int{},
+		}
+		numerical := field(row, "Type") == strconv.Itoa(loopNumerical)
+		if f, ok := checkmarks[position]; ok {
+			days, err := readLoopCSVFile(f)
+			if err != nil {
+				return nil, err
+			}
+			for _, day := range days {
+				if len(day) < 2 {
+					continue
+				}
+				date, err := time.Parse(time.DateOnly, strings.TrimSpace(day[0]))
+				if err != nil {
+					continue // header of newer exports
+				}
+				value, err := strconv.ParseInt(strings.TrimSpace(day[1]), 10, 64)
+				if err != nil {
+					continue
+				}
+				if count := loopCount(value, numerical); count > 0 {
+					habit.logs[date.Format(time.DateOnly)] = count
+				}
+			}
+		}
+		habits = append(habits, habit)
+	}
+	return habits, nil
+}
+
+func readLoopCSVFile(f *zip.File) ([][]string, error) {
+	if f.UncompressedSize64 > maxLoopFileSize {
+		return nil, fmt.Errorf("%s is too large", f.Name)
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", f.Name, err)
+	}
+	defer r.Close()
+	reader := csv.NewReader(io.LimitReader(r, maxLoopFileSize))
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", f.Name, err)
+	}
+	return rows, nil
+}
+
+// readLoopSQLite reads the Habits and Repetitions tables of a full backup.
+// Columns added in later versions of Loop are only read when present
+func readLoopSQLite(ctx context.Context, data []byte) ([]importedHabit, error) {
+	file, err := os.CreateTemp("", "tabit-import-*.db")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+file.Name()+"?mode=ro&immutable=1")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	hasColumn := func(table, column string) (bool, error) {
+		var count int
+		err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+		return count > 0, err
+	}
+	habitType := "0"
+	if ok, err := hasColumn("Habits", "type"); err != nil {
+		return nil, fmt.Errorf("invalid backup: %w", err)
+	} else if ok {
+		habitType = "type"
+	}
+	value := strconv.Itoa(loopYesManual)
+	if ok, err := hasColumn("Repetitions", "value"); err != nil {
+		return nil, fmt.Errorf("invalid backup: %w", err)
+	} else if ok {
+		value = "value"
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, name, position, freq_num, freq_den, "+habitType+" FROM Habits ORDER BY position")
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup: %w", err)
+	}
+	var habits []importedHabit
+	byID := map[int64]int{}
+	numerical := map[int64]bool{}
+	for rows.Next() {
+		var id int64
+		var name sql.NullString
+		var position, numerator, denominator, kind sql.NullInt64
+		if err := rows.Scan(&id, &name, &position, &numerator, &denominator, &kind); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("invalid backup: %w", err)
+		}
+		byID[id] = len(habits)
+		numerical[id] = kind.Int64 == loopNumerical
+		habits = append(habits, importedHabit{
+			name:       strings.TrimSpace(name.String),
+			sort:       int(position.Int64) + 1, // same as the Position of a CSV export
+			weeklyGoal: loopWeeklyGoal(int(numerator.Int64), int(denominator.Int64)),
+			logs:       map[string]int{},
+		})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("invalid backup: %w", err)
+	}
+
+	rows, err = db.QueryContext(ctx, "SELECT habit, timestamp, "+value+" FROM Repetitions")
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var habit, timestamp, value int64
+		if err := rows.Scan(&habit, &timestamp, &value); err != nil {
+			return nil, fmt.Errorf("invalid backup: %w", err)
+		}
+		i, ok := byID[habit]
+		if !ok {
+			continue
+		}
+		// timestamps are midnight UTC of the day in milliseconds
+		day := time.UnixMilli(timestamp).UTC().Format(time.DateOnly)
+		if count := loopCount(value, numerical[habit]); count > 0 {
+			habits[i].logs[day] = count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("invalid backup: %w", err)
+	}
+	return habits, nil
+}
+
+// loopCount turns the value Loop stored for a day into a count.
+// Only days checked off by the user count. Amounts are rounded up so any amount logs the day
+func loopCount(value int64, numerical bool) int {
+	if numerical {
+		return int(math.Ceil(float64(value) / 1000))
+	}
+	if value == loopYesManual {
+		return 1
+	}
+	return 0
+}
+
+// loopWeeklyGoal turns a frequency of numerator times every denominator days into times per week.
+// Daily habits have no weekly goal
+func loopWeeklyGoal(numerator, denominator int) int {
+	if numerator <= 0 || denominator <= 1 {
+		return 0
+	}
+	goal := int(math.Round(float64(numerator) * 7 / float64(denominator)))
+	return min(max(goal, 1), 7)
+}
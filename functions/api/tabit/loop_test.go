@@ -0,0 +1,57 @@
+package tabit
+
+import "testing"
+
+func TestLoopCount(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     int64
+		numerical bool
+		want      int
+	}{
+		{name: "checked off", value: loopYesManual, want: 1},
+		{name: "filled in by the frequency", value: 1, want: 0},
+		{name: "missed", value: 0, want: 0},
+		{name: "skipped", value: 3, want: 0},
+		{name: "unknown", value: -1, want: 0},
+		{name: "whole amount", value: 3000, numerical: true, want: 3},
+		{name: "part of an amount rounds up", value: 2500, numerical: true, want: 3},
+		{name: "any amount logs the day", value: 1, numerical: true, want: 1},
+		{name: "no amount", value: 0, numerical: true, want: 0},
+		{name: "unknown amount", value: -1, numerical: true, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := loopCount(tt.value, tt.numerical); got != tt.want {
+				t.Errorf("loopCount(%d, %v) = %d, want %d", tt.value, tt.numerical, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoopWeeklyGoal(t *testing.T) {
+	tests := []struct {
+		name        string
+		numerator   int
+		denominator int
+		want        int
+	}{
+		{name: "every day", numerator: 1, denominator: 1, want: 0},
+		{name: "times per week", numerator: 3, denominator: 7, want: 3},
+		{name: "every other day", numerator: 1, denominator: 2, want: 4},
+		{name: "times per month", numerator: 10, denominator: 30, want: 2},
+		{name: "rarer than weekly still needs one", numerator: 1, denominator: 30, want: 1},
+		{name: "more than daily is capped", numerator: 10, denominator: 7, want: 7},
+		{name: "no frequency", numerator: 0, denominator: 7, want: 0},
+		{name: "invalid frequency", numerator: 3, denominator: 0, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := loopWeeklyGoal(tt.numerator, tt.denominator); got != tt.want {
+				t.Errorf("loopWeeklyGoal(%d, %d) = %d, want %d", tt.numerator, tt.denominator, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package tabit
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer delivers account emails such as password resets
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string // Plain text
+}
+
+// NewMailer builds the mailer named by cfg.Mailer:
+//   - log: logs the recipient and subject of every message without sending it, for development
+//   - file: appends every message to cfg.File
+//   - smtp: sends through cfg.SMTPHost and cfg.SMTPPort, logging in when cfg.SMTPUsername is set.
+//     Port 465 uses implicit TLS, other ports upgrade with STARTTLS when the server offers it
+func NewMailer(cfg MailConfig) (Mailer, error) {
+	switch cfg.Mailer {
+	case "":
+		return nil, errors.New("MAILER is required to send account emails")
+	case "log":
+		slog.Warn("The log mailer sends no emails, it is only meant for development")
+		return logMailer{}, nil
+	case "file":
+		if cfg.File == "" {
+			return nil, errors.New("MAIL_FILE is required for the file mailer")
+		}
+		from := cfg.From
+		if from == "" {
+			from = "tabit@localhost"
+		}
+		return &fileMailer{path: cfg.File, from: from}, nil
+	case "smtp":
+		if cfg.SMTPHost == "" || cfg.From == "" {
+			return nil, errors.New("SMTP_HOST and MAIL_FROM are required for the smtp mailer")
+		}
+		m := &smtpMailer{
+			host:     cfg.SMTPHost,
+			port:     cfg.SMTPPort,
+			username: cfg.SMTPUsername,
+			password: cfg.SMTPPassword,
+			from:     cfg.From,
+		}
+		if m.port == "" {
+			m.port = "587"
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q, must be one of log, file or smtp", cfg.Mailer)
+	}
+}
+
+// logMailer drops messages after logging who they were for. The body holds one-time tokens
+// that take over the account, so it is never logged
+type logMailer struct{}
+
+func (logMailer) Send(ctx context.Context, msg Message) error {
+	Logger(ctx).InfoContext(ctx, "Mail not sent", "to", msg.To, "subject", msg.Subject)
+	return nil
+}
+
+// fileMailer appends messages to a file in the same format they would be sent in
+type fileMailer struct {
+	path string
+	from string
+
+	mu sync.Mutex
+}
+
+func (m *fileMailer) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, err := os.OpenFile(m.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(formatMessage(m.from, msg, time.Now()), "\r\n"...))
+	return err
+}
+
+type smtpMailer struct {
+	host     string
+	port     string
+	username string
+	password string
+	from     string
+}
+
+func (m *smtpMailer) Send(ctx context.Context, msg Message) error {
+	from, err := mail.ParseAddress(m.from)
+	if err != nil {
+		return fmt.Errorf("invalid MAIL_FROM: %w", err)
+	}
+	addr := net.JoinHostPort(m.host, m.port)
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	if m.port == "465" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: m.host}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return err
+		}
+	}
+	if m.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(formatMessage(m.from, msg, time.Now())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// formatMessage renders msg as a plain text email
+func formatMessage(from string, msg Message, now time.Time) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
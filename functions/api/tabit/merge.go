@@ -0,0 +1,368 @@
+package tabit
+
+import (
+	"encoding/json"
+	"maps"
+	"time"
+)
+
+// mergeSyncState merges the habit data sent by a client into the stored state.
+// existing is nil when the user has never synced.
+// It also returns the stamped client data to record as a change
+func mergeSyncState(user_id string, existing *UserSyncStateModel, last_updated int64, data map[string]HabitData) (*UserSyncStateModel, map[string]HabitData, error) {
+	return mergeState(user_id, existing, last_updated, data, false)
+}
+
+// mergeSyncChanges is mergeSyncState for partial updates.
+// Fields without their own timestamp are ignored
+func mergeSyncChanges(user_id string, existing *UserSyncStateModel, last_updated int64, changes map[string]HabitData) (*UserSyncStateModel, map[string]HabitData, error) {
+	return mergeState(user_id, existing, last_updated, changes, true)
+}
+
+func mergeState(user_id string, existing *UserSyncStateModel, last_updated int64, data map[string]HabitData, partial bool) (*UserSyncStateModel, map[string]HabitData, error) {
+	current := map[string]HabitData{}
+	var currentUpdated, version int64
+	if existing != nil {
+		if err := json.Unmarshal([]byte(existing.Data), &current); err != nil {
+			return nil, nil, err
+		}
+		currentUpdated = existing.LastUpdated
+		version = existing.Version
+	}
+
+	var changes map[string]HabitData
+	if partial {
+		stamped := make(map[string]HabitData, len(data))
+		for name, habit := range data {
+			stamped[name] = habit.timestamped()
+		}
+		changes = mergeHabitData(nil, 0, stamped, 0)
+		for name, habit := range changes {
+			if habit.isEmpty() {
+				delete(changes, name)
+			}
+		}
+	} else {
+		changes = mergeHabitData(nil, 0, data, last_updated)
+	}
+	before := mergeHabitData(current, currentUpdated, nil, 0)
+	merged := mergeHabitData(current, currentUpdated, changes, 0)
+	// only habits the merge changed are recorded, resending what is stored is not a change
+	for name := range changes {
+		if sameHabit(before[name], merged[name]) {
+			delete(changes, name)
+		}
+	}
+	jsonData, err := json.Marshal(merged)
+	if err != nil {
+		return nil, nil, err
+	}
+	// compare re-encoded data since the stored json may be formatted or stamped differently
+	currentData, err := json.Marshal(before)
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(currentData) != string(jsonData) {
+		version++
+	}
+	return &UserSyncStateModel{
+		UserID:      user_id,
+		LastUpdated: max(currentUpdated, last_updated),
+		Data:        string(jsonData),
+		Version:     version,
+	}, changes, nil
+}
+
+// sameHabit compares two merged habits by their encoding, which orders the days
+func sameHabit(a, b HabitData) bool {
+	aData, aErr := json.Marshal(a)
+	bData, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && string(aData) == string(bData)
+}
+
+// collectChanges folds a recorded change into the changes sent back to a client
+func collectChanges(collected map[string]HabitData, habit string, data string) (map[string]HabitData, error) {
+	var change HabitData
+	if err := json.Unmarshal([]byte(data), &change); err != nil {
+		return nil, err
+	}
+	return mergeHabitData(collected, 0, map[string]HabitData{habit: change}, 0), nil
+}
+
+// syncChangesRetention is how long every recorded change is kept on its own.
+// Older changes of a habit are folded into one by foldChanges
+const syncChangesRetention = 30 * 24 * time.Hour
+
+// recordedChange is a row of the change log
+type recordedChange struct {
+	ChangeID int64
+	Habit    string
+	Data     string
+}
+
+// foldChanges folds the changes of each habit into the newest of them, ordered by change id.
+// The folded change keeps the newest id, so a cursor before it still receives everything,
+// and merging a change a client already has again changes nothing.
+// It returns the changes to rewrite and the ids of the ones to delete
+func foldChanges(changes []recordedChange) ([]recordedChange, []int64, error) {
+	byHabit := map[string][]recordedChange{}
+	var habits []string
+	for _, change := range changes {
+		if _, ok := byHabit[change.Habit]; !ok {
+			habits = append(habits, change.Habit)
+		}
+		byHabit[change.Habit] = append(byHabit[change.Habit], change)
+	}
+
+	var folded []recordedChange
+	var deleted []int64
+	for _, habit := range habits {
+		rows := byHabit[habit]
+		if len(rows) < 2 {
+			continue
+		}
+		collected := map[string]HabitData{}
+		for _, row := range rows {
+			var err error
+			if collected, err = collectChanges(collected, habit, row.Data); err != nil {
+				return nil, nil, err
+			}
+		}
+		data, err := json.Marshal(collected[habit])
+		if err != nil {
+			return nil, nil, err
+		}
+		newest := rows[len(rows)-1]
+		folded = append(folded, recordedChange{ChangeID: newest.ChangeID, Habit: habit, Data: string(data)})
+		for _, row := range rows[:len(rows)-1] {
+			deleted = append(deleted, row.ChangeID)
+		}
+	}
+	return folded, deleted, nil
+}
+
+// mergeHabitData combines two copies of a user's habits field by field.
+// Every log day, weekly goal and sort keeps the value with the newest timestamp.
+// Fields without their own timestamp use the timestamp of the document they came from.
+// Ties keep the larger value so the result does not depend on argument order.
+// The result has every timestamp filled in
+func mergeHabitData(a map[string]HabitData, aUpdated int64, b map[string]HabitData, bUpdated int64) map[string]HabitData {
+	merged := make(map[string]HabitData, max(len(a), len(b)))
+	for name, habit := range a {
+		merged[name] = habit.stamped(aUpdated)
+	}
+	for name, habit := range b {
+		habit = habit.stamped(bUpdated)
+		if existing, ok := merged[name]; ok {
+			habit = mergeHabit(existing, habit)
+		}
+		merged[name] = habit
+	}
+	for name, habit := range merged {
+		merged[name] = habit.pruned()
+	}
+	return merged
+}
+
+// stamped returns a copy of h where every field has a timestamp.
+// Unstamped fields of a deleted habit are treated as part of the deletion
+func (h HabitData) stamped(updated int64) HabitData {
+	fallback := updated
+	if h.DeletedAt > 0 {
+		fallback = min(updated, h.DeletedAt)
+	}
+
+	result := h
+	result.Logs = maps.Clone(h.Logs)
+	if result.Logs == nil {
+		result.Logs = map[string]int{}
+	}
+	result.LogsUpdatedAt = maps.Clone(h.LogsUpdatedAt)
+	if result.LogsUpdatedAt == nil {
+		result.LogsUpdatedAt = map[string]int64{}
+	}
+	for day := range result.Logs {
+		if result.LogsUpdatedAt[day] == 0 {
+			result.LogsUpdatedAt[day] = fallback
+		}
+	}
+	// a timestamp without a count means the day was cleared
+	for day := range result.LogsUpdatedAt {
+		if _, ok := result.Logs[day]; !ok {
+			result.Logs[day] = 0
+		}
+	}
+	if result.WeeklyGoalUpdatedAt == 0 {
+		result.WeeklyGoalUpdatedAt = fallback
+	}
+	if result.SortUpdatedAt == 0 {
+		result.SortUpdatedAt = fallback
+	}
+	return result
+}
+
+// mergeHabit merges two stamped copies of the same habit
+func mergeHabit(a, b HabitData) HabitData {
+	merged := HabitData{
+		Logs:          make(map[string]int, max(len(a.Logs), len(b.Logs))),
+		LogsUpdatedAt: make(map[string]int64, max(len(a.Logs), len(b.Logs))),
+		DeletedAt:     max(a.DeletedAt, b.DeletedAt),
+	}
+	for day, count := range a.Logs {
+		merged.Logs[day] = count
+		merged.LogsUpdatedAt[day] = a.LogsUpdatedAt[day]
+	}
+	for day, count := range b.Logs {
+		updated, ok := merged.LogsUpdatedAt[day]
+		if !ok {
+			merged.Logs[day] = count
+			merged.LogsUpdatedAt[day] = b.LogsUpdatedAt[day]
+			continue
+		}
+		merged.Logs[day], merged.LogsUpdatedAt[day] = pickNewest(merged.Logs[day], updated, count, b.LogsUpdatedAt[day])
+	}
+	merged.WeeklyGoal, merged.WeeklyGoalUpdatedAt = pickNewest(a.WeeklyGoal, a.WeeklyGoalUpdatedAt, b.WeeklyGoal, b.WeeklyGoalUpdatedAt)
+	merged.Sort, merged.SortUpdatedAt = pickNewest(a.Sort, a.SortUpdatedAt, b.Sort, b.SortUpdatedAt)
+	return merged
+}
+
+func pickNewest(a int, aUpdated int64, b int, bUpdated int64) (int, int64) {
+	switch {
+	case aUpdated > bUpdated:
+		return a, aUpdated
+	case bUpdated > aUpdated:
+		return b, bUpdated
+	default:
+		return max(a, b), aUpdated
+	}
+}
+
+// pruned drops everything that was changed before the habit was deleted.
+// A habit with nothing newer than its deletion is reduced to a tombstone
+func (h HabitData) pruned() HabitData {
+	if h.DeletedAt == 0 {
+		return h
+	}
+	for day, updated := range h.LogsUpdatedAt {
+		if updated <= h.DeletedAt {
+			delete(h.Logs, day)
+			delete(h.LogsUpdatedAt, day)
+		}
+	}
+	if h.WeeklyGoalUpdatedAt <= h.DeletedAt {
+		h.WeeklyGoal, h.WeeklyGoalUpdatedAt = 0, 0
+	}
+	if h.SortUpdatedAt <= h.DeletedAt {
+		h.Sort, h.SortUpdatedAt = 0, 0
+	}
+	return h
+}
+
+// isDeleted reports whether a merged habit is only a tombstone.
+// pruned already dropped every field older than the deletion
+func (h HabitData) isDeleted() bool {
+	return h.DeletedAt > 0 && len(h.Logs) == 0 && h.WeeklyGoalUpdatedAt == 0 && h.SortUpdatedAt == 0
+}
+
+// projectedHabits picks the habits of a merged state that have to be written to the habits table.
+// A nil changes picks every habit
+func projectedHabits(data string, changes map[string]HabitData) (map[string]HabitData, error) {
+	var state map[string]HabitData
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return nil, err
+	}
+	if changes == nil {
+		return state, nil
+	}
+	habits := make(map[string]HabitData, len(changes))
+	for name := range changes {
+		if habit, ok := state[name]; ok {
+			habits[name] = habit
+		}
+	}
+	return habits, nil
+}
+
+// projectedLogs splits the logs of a habit into days to store and days that were cleared.
+// Days that are not yyyy-mm-dd cannot be stored and are skipped
+func projectedLogs(habit HabitData) (logged map[string]int, cleared []string) {
+	logged = make(map[string]int, len(habit.Logs))
+	for day, count := range habit.Logs {
+		if _, err := time.Parse(time.DateOnly, day); err != nil {
+			continue
+		}
+		if count > 0 {
+			logged[day] = count
+		} else {
+			cleared = append(cleared, day)
+		}
+	}
+	return logged, cleared
+}
+
+// timestamped returns a copy of h without the fields that have no timestamp of their own
+func (h HabitData) timestamped() HabitData {
+	result := h
+	result.Logs = make(map[string]int, len(h.Logs))
+	result.LogsUpdatedAt = make(map[string]int64, len(h.LogsUpdatedAt))
+	for day, updated := range h.LogsUpdatedAt {
+		if updated > 0 {
+			result.Logs[day], result.LogsUpdatedAt[day] = h.Logs[day], updated
+		}
+	}
+	if h.WeeklyGoalUpdatedAt == 0 {
+		result.WeeklyGoal = 0
+	}
+	if h.SortUpdatedAt == 0 {
+		result.Sort = 0
+	}
+	return result
+}
+
+// isEmpty reports whether a partial update of a habit changes nothing
+func (h HabitData) isEmpty() bool {
+	return len(h.Logs) == 0 && h.DeletedAt == 0 && h.WeeklyGoalUpdatedAt == 0 && h.SortUpdatedAt == 0
+}
+
+// createdHabit is the change recording a habit written through the habits API,
+// with every field stamped at now
+func createdHabit(habit HabitModel, now int64) HabitData {
+	change := HabitData{
+		Logs:                maps.Clone(habit.Logs),
+		LogsUpdatedAt:       make(map[string]int64, len(habit.Logs)),
+		Sort:                habit.Sort,
+		SortUpdatedAt:       now,
+		WeeklyGoalUpdatedAt: now,
+	}
+	for day := range change.Logs {
+		change.LogsUpdatedAt[day] = now
+	}
+	if habit.WeeklyTarget != nil {
+		change.WeeklyGoal = *habit.WeeklyTarget
+	}
+	return change
+}
+
+// updatedHabit is the change recording the fields of req on habit.
+// A rename is recorded as deleting the old name and creating the new one
+func updatedHabit(old string, habit HabitModel, req UpdateHabitRequest, now int64) map[string]HabitData {
+	if habit.Name != old {
+		return map[string]HabitData{old: {DeletedAt: now}, habit.Name: createdHabit(habit, now)}
+	}
+	var change HabitData
+	if req.Sort != nil {
+		change.Sort, change.SortUpdatedAt = habit.Sort, now
+	}
+	if req.WeeklyTarget != nil {
+		change.WeeklyGoalUpdatedAt = now
+		if habit.WeeklyTarget != nil {
+			change.WeeklyGoal = *habit.WeeklyTarget
+		}
+	}
+	return map[string]HabitData{habit.Name: change}
+}
+
+// loggedHabit is the change recording the count of a day. A count of 0 clears the day
+func loggedHabit(day string, count int, now int64) HabitData {
+	return HabitData{Logs: map[string]int{day: count}, LogsUpdatedAt: map[string]int64{day: now}}
+}
@@ -0,0 +1,326 @@
+package tabit
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"testing"
+)
+
+func syncStateOf(t *testing.T, data map[string]HabitData, last_updated int64, version int64) *UserSyncStateModel {
+	t.Helper()
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &UserSyncStateModel{UserID: "user", LastUpdated: last_updated, Data: string(encoded), Version: version}
+}
+
+func TestMergeState(t *testing.T) {
+	stored := map[string]HabitData{
+		"walk": {
+			Logs:                map[string]int{"2026-01-01": 2, "2026-01-02": 1},
+			LogsUpdatedAt:       map[string]int64{"2026-01-01": 100, "2026-01-02": 300},
+			WeeklyGoal:          3,
+			WeeklyGoalUpdatedAt: 100,
+			Sort:                1,
+			SortUpdatedAt:       100,
+		},
+	}
+
+	tests := []struct {
+		name         string
+		existing     map[string]HabitData // nil when the user never synced
+		last_updated int64
+		data         map[string]HabitData
+		partial      bool
+		want         map[string]HabitData
+		wantVersion  int64
+		wantChanged  []string
+	}{
+		{
+			name:         "first sync stamps fields with the client timestamp",
+			last_updated: 50,
+			data:         map[string]HabitData{"read": {Logs: map[string]int{"2026-01-01": 1}, Sort: 2}},
+			want: map[string]HabitData{"read": {
+				Logs:                map[string]int{"2026-01-01": 1},
+				LogsUpdatedAt:       map[string]int64{"2026-01-01": 50},
+				WeeklyGoalUpdatedAt: 50,
+				Sort:                2,
+				SortUpdatedAt:       50,
+			}},
+			wantVersion: 1,
+			wantChanged: []string{"read"},
+		},
+		{
+			name:         "resending the stored data changes nothing",
+			existing:     stored,
+			last_updated: 400,
+			data:         stored,
+			want:         stored,
+			wantVersion:  5,
+		},
+		{
+			name:         "each day keeps its newest count",
+			existing:     stored,
+			last_updated: 200,
+			data: map[string]HabitData{"walk": {
+				Logs:          map[string]int{"2026-01-01": 5, "2026-01-02": 4},
+				LogsUpdatedAt: map[string]int64{"2026-01-01": 200, "2026-01-02": 200},
+			}},
+			// the goal and sort the full sync left out are stamped with its timestamp and win
+			want: map[string]HabitData{"walk": {
+				Logs:                map[string]int{"2026-01-01": 5, "2026-01-02": 1},
+				LogsUpdatedAt:       map[string]int64{"2026-01-01": 200, "2026-01-02": 300},
+				WeeklyGoalUpdatedAt: 200,
+				SortUpdatedAt:       200,
+			}},
+			wantVersion: 6,
+			wantChanged: []string{"walk"},
+		},
+		{
+			name:         "a tie keeps the larger value",
+			existing:     stored,
+			last_updated: 100,
+			data: map[string]HabitData{"walk": {
+				Logs:          map[string]int{"2026-01-01": 1},
+				LogsUpdatedAt: map[string]int64{"2026-01-01": 100},
+				WeeklyGoal:    7,
+				Sort:          0,
+			}},
+			want: map[string]HabitData{"walk": {
+				Logs:                map[string]int{"2026-01-01": 2, "2026-01-02": 1},
+				LogsUpdatedAt:       map[string]int64{"2026-01-01": 100, "2026-01-02": 300},
+				WeeklyGoal:          7,
+				WeeklyGoalUpdatedAt: 100,
+				Sort:                1,
+				SortUpdatedAt:       100,
+			}},
+			wantVersion: 6,
+			wantChanged: []string{"walk"},
+		},
+		{
+			name:         "a deletion drops everything older than it",
+			existing:     stored,
+			last_updated: 250,
+			data:         map[string]HabitData{"walk": {DeletedAt: 250}},
+			partial:      true,
+			want: map[string]HabitData{"walk": {
+				Logs:          map[string]int{"2026-01-02": 1},
+				LogsUpdatedAt: map[string]int64{"2026-01-02": 300},
+				DeletedAt:     250,
+			}},
+			wantVersion: 6,
+			wantChanged: []string{"walk"},
+		},
+		{
+			name: "a stale client cannot bring back a deleted habit",
+			existing: map[string]HabitData{"walk": {
+				Logs:          map[string]int{},
+				LogsUpdatedAt: map[string]int64{},
+				DeletedAt:     500,
+			}},
+			last_updated: 400,
+			data:         map[string]HabitData{"walk": {Logs: map[string]int{"2026-01-01": 2}, Sort: 1}},
+			want: map[string]HabitData{"walk": {
+				Logs:          map[string]int{},
+				LogsUpdatedAt: map[string]int64{},
+				DeletedAt:     500,
+			}},
+			wantVersion: 5,
+		},
+		{
+			name:         "a partial update leaves unstamped fields alone",
+			existing:     stored,
+			last_updated: 400,
+			data:         map[string]HabitData{"walk": {Sort: 9, SortUpdatedAt: 400, WeeklyGoal: 0}},
+			partial:      true,
+			want: map[string]HabitData{"walk": {
+				Logs:                map[string]int{"2026-01-01": 2, "2026-01-02": 1},
+				LogsUpdatedAt:       map[string]int64{"2026-01-01": 100, "2026-01-02": 300},
+				WeeklyGoal:          3,
+				WeeklyGoalUpdatedAt: 100,
+				Sort:                9,
+				SortUpdatedAt:       400,
+			}},
+			wantVersion: 6,
+			wantChanged: []string{"walk"},
+		},
+		{
+			name:         "a partial update with nothing stamped is not recorded",
+			existing:     stored,
+			last_updated: 400,
+			data:         map[string]HabitData{"walk": {Sort: 9}},
+			partial:      true,
+			want:         stored,
+			wantVersion:  5,
+		},
+		{
+			name:         "a partial update ignores unstamped new days and habits",
+			existing:     stored,
+			last_updated: 400,
+			data: map[string]HabitData{
+				"walk": {Logs: map[string]int{"2026-01-05": 2}},
+				"read": {Logs: map[string]int{"2026-01-01": 1}, Sort: 3},
+			},
+			partial:     true,
+			want:        stored,
+			wantVersion: 5,
+		},
+		{
+			name:         "a partial update keeps only the stamped days",
+			existing:     stored,
+			last_updated: 400,
+			data: map[string]HabitData{"walk": {
+				Logs:          map[string]int{"2026-01-05": 2, "2026-01-06": 1},
+				LogsUpdatedAt: map[string]int64{"2026-01-06": 400},
+			}},
+			partial: true,
+			want: map[string]HabitData{"walk": {
+				Logs:                map[string]int{"2026-01-01": 2, "2026-01-02": 1, "2026-01-06": 1},
+				LogsUpdatedAt:       map[string]int64{"2026-01-01": 100, "2026-01-02": 300, "2026-01-06": 400},
+				WeeklyGoal:          3,
+				WeeklyGoalUpdatedAt: 100,
+				Sort:                1,
+				SortUpdatedAt:       100,
+			}},
+			wantVersion: 6,
+			wantChanged: []string{"walk"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var existing *UserSyncStateModel
+			if tt.existing != nil {
+				existing = syncStateOf(t, tt.existing, 300, 5)
+			}
+			merged, changes, err := mergeState("user", existing, tt.last_updated, tt.data, tt.partial)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]HabitData
+			if err := json.Unmarshal([]byte(merged.Data), &got); err != nil {
+				t.Fatal(err)
+			}
+			want, _ := json.Marshal(tt.want)
+			if encoded, _ := json.Marshal(got); string(encoded) != string(want) {
+				t.Errorf("data = %s, want %s", encoded, want)
+			}
+			if merged.Version != tt.wantVersion {
+				t.Errorf("version = %d, want %d", merged.Version, tt.wantVersion)
+			}
+			if changed := slices.Sorted(maps.Keys(changes)); !slices.Equal(changed, tt.wantChanged) {
+				t.Errorf("changed habits = %v, want %v", changed, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func TestMergeHabitDataIsSymmetric(t *testing.T) {
+	a := map[string]HabitData{"walk": {
+		Logs:          map[string]int{"2026-01-01": 1, "2026-01-02": 3},
+		LogsUpdatedAt: map[string]int64{"2026-01-01": 100, "2026-01-02": 200},
+		Sort:          4,
+	}}
+	b := map[string]HabitData{"walk": {
+		Logs:          map[string]int{"2026-01-01": 2, "2026-01-02": 5},
+		LogsUpdatedAt: map[string]int64{"2026-01-01": 100, "2026-01-02": 150},
+		DeletedAt:     120,
+	}}
+
+	ab, _ := json.Marshal(mergeHabitData(a, 200, b, 150))
+	ba, _ := json.Marshal(mergeHabitData(b, 150, a, 200))
+	if string(ab) != string(ba) {
+		t.Errorf("merge depends on argument order:\n%s\n%s", ab, ba)
+	}
+}
+
+func TestFoldChanges(t *testing.T) {
+	change := func(id int64, habit string, data HabitData) recordedChange {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return recordedChange{ChangeID: id, Habit: habit, Data: string(encoded)}
+	}
+	walked := func(day string, count int, at int64) HabitData {
+		return HabitData{Logs: map[string]int{day: count}, LogsUpdatedAt: map[string]int64{day: at}}
+	}
+
+	tests := []struct {
+		name        string
+		changes     []recordedChange
+		wantFolded  map[int64]HabitData
+		wantDeleted []int64
+	}{
+		{
+			name:    "nothing to fold",
+			changes: nil,
+		},
+		{
+			name: "a habit with a single change is left alone",
+			changes: []recordedChange{
+				change(1, "walk", walked("2026-01-01", 1, 100)),
+				change(2, "read", walked("2026-01-01", 1, 100)),
+			},
+		},
+		{
+			name: "changes of a habit fold into the newest",
+			changes: []recordedChange{
+				change(1, "walk", walked("2026-01-01", 1, 100)),
+				change(2, "read", walked("2026-01-01", 1, 100)),
+				change(3, "walk", walked("2026-01-02", 2, 200)),
+				change(4, "walk", walked("2026-01-01", 3, 300)),
+			},
+			wantFolded: map[int64]HabitData{4: {
+				Logs:          map[string]int{"2026-01-01": 3, "2026-01-02": 2},
+				LogsUpdatedAt: map[string]int64{"2026-01-01": 300, "2026-01-02": 200},
+			}},
+			wantDeleted: []int64{1, 3},
+		},
+		{
+			name: "a deletion folds with the changes before it",
+			changes: []recordedChange{
+				change(1, "walk", walked("2026-01-01", 1, 100)),
+				change(2, "walk", HabitData{DeletedAt: 150}),
+			},
+			wantFolded: map[int64]HabitData{2: {
+				Logs:          map[string]int{},
+				LogsUpdatedAt: map[string]int64{},
+				DeletedAt:     150,
+			}},
+			wantDeleted: []int64{1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			folded, deleted, err := foldChanges(tt.changes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(folded) != len(tt.wantFolded) {
+				t.Fatalf("folded %d changes, want %d", len(folded), len(tt.wantFolded))
+			}
+			for _, got := range folded {
+				want, ok := tt.wantFolded[got.ChangeID]
+				if !ok {
+					t.Errorf("folded into change %d", got.ChangeID)
+					continue
+				}
+				var data HabitData
+				if err := json.Unmarshal([]byte(got.Data), &data); err != nil {
+					t.Fatal(err)
+				}
+				encoded, _ := json.Marshal(data)
+				if encoded_want, _ := json.Marshal(want); string(encoded) != string(encoded_want) {
+					t.Errorf("change %d = %s, want %s", got.ChangeID, encoded, encoded_want)
+				}
+			}
+			if !slices.Equal(deleted, tt.wantDeleted) {
+				t.Errorf("deleted = %v, want %v", deleted, tt.wantDeleted)
+			}
+		})
+	}
+}
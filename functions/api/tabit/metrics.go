@@ -0,0 +1,176 @@
+package tabit
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// metricsRegistry holds the metrics served on /metrics and pushed on shutdown
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tabit_http_requests_total",
+		Help: "Requests handled, by route template and status",
+	}, []string{"method", "route", "status"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tabit_http_request_duration_seconds",
+		Help:    "Time to handle a request, by route template and status",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+	syncTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tabit_sync_total",
+		Help: "Syncs by kind (full or changes) and outcome: existing when nothing changed, upserted, conflict or error",
+	}, []string{"kind", "outcome"})
+	syncAnomalies = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tabit_sync_anomalies_total",
+		Help: "Unusual sync paths: invalid_existing when the locked sync state could not be read, stale_client when a client sent data older than the stored state",
+	}, []string{"kind"})
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tabit_auth_failures_total",
+		Help: "Rejected credentials by reason",
+	}, []string{"reason"})
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tabit_rate_limited_total",
+		Help: "Requests answered 429, by route template and whether the user or the client ip ran out of tokens",
+	}, []string{"route", "by"})
+	rateLimitErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tabit_rate_limit_errors_total",
+		Help: "Rate limit store failures by operation: take, after which the request is let through, or purge",
+	}, []string{"op"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		requestDuration,
+		syncTotal,
+		syncAnomalies,
+		authFailures,
+		rateLimited,
+		rateLimitErrors,
+	)
+}
+
+// RegisterDBMetrics reports the connection pool stats of ds. It is called once per process
+func RegisterDBMetrics(ds DataStore) error {
+	var db *sql.DB
+	switch store := ds.(type) {
+	case *PostgresDataStore:
+		db = store.DB
+	case *SQLiteDataStore:
+		db = store.DB
+	default:
+		return nil
+	}
+	return metricsRegistry.Register(collectors.NewDBStatsCollector(db, "tabit"))
+}
+
+// observeRequest counts a request handled by a route. Unmatched requests have an empty route
+func observeRequest(method, route string, status int, elapsed time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+	default:
+		method = "other" // keeps made up methods from adding series
+	}
+	labels := prometheus.Labels{"method": method, "route": route, "status": strconv.Itoa(status)}
+	requestsTotal.With(labels).Inc()
+	requestDuration.With(labels).Observe(elapsed.Seconds())
+}
+
+// observeSync counts how a sync of kind full or changes ended. written is whether any habit changed
+func observeSync(kind string, written bool, db_err *HTTPError) {
+	outcome := "existing"
+	switch {
+	case db_err != nil && db_err.Code == http.StatusConflict:
+		outcome = "conflict"
+	case db_err != nil:
+		outcome = "error"
+	case written:
+		outcome = "upserted"
+	}
+	syncTotal.WithLabelValues(kind, outcome).Inc()
+}
+
+// observeAuthFailure counts credentials that were rejected
+func observeAuthFailure(reason string) {
+	authFailures.WithLabelValues(reason).Inc()
+}
+
+// observeRateLimited counts a request turned away by the rate limiter
+func observeRateLimited(route, by string) {
+	rateLimited.WithLabelValues(route, by).Inc()
+}
+
+// observeRateLimitError counts a failure of the rate limit store
+func observeRateLimitError(op string) {
+	rateLimitErrors.WithLabelValues(op).Inc()
+}
+
+// authFailureReason sums up why the providers rejected a session
+func authFailureReason(token_string string, err error) string {
+	var merged *mergedAccountError
+	switch {
+	case token_string == "":
+		return "missing_token"
+	case errors.As(err, &merged):
+		return "merged_account"
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return "expired"
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return "malformed"
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		return "invalid_signature"
+	default:
+		return "invalid_token"
+	}
+}
+
+// handleMetrics serves the metrics in the Prometheus text format, behind cfg.Token when it is set
+func handleMetrics(cfg MetricsConfig) http.Handler {
+	metrics := promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.Token != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) != 1 {
+				sendErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		metrics.ServeHTTP(w, r)
+	})
+}
+
+// PushMetrics sends the metrics to the Pushgateway at cfg.PushURL, for Lambda where nothing scrapes
+// the instance. Each instance pushes to its own group so they do not overwrite each other
+func PushMetrics(ctx context.Context, cfg MetricsConfig) error {
+	if cfg.PushURL == "" {
+		return nil
+	}
+	instance := os.Getenv("AWS_LAMBDA_LOG_STREAM_NAME")
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	return push.New(cfg.PushURL, cfg.PushJob).
+		Gatherer(metricsRegistry).
+		Grouping("instance", instance).
+		PushContext(ctx)
+}
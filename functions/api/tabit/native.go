@@ -0,0 +1,221 @@
+package tabit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// nativeAudience marks sessions meant for this API
+	nativeAudience = "tabit"
+	// minAuthSecretLength keeps AUTH_SECRET at least as long as the HS256 output
+	minAuthSecretLength = 32
+
+	minPasswordLength = 8
+	// maxPasswordLength is bcrypt's limit, anything longer would be silently ignored
+	maxPasswordLength = 72
+)
+
+// tokenEmails describe the email sent for each kind of one-time token
+var tokenEmails = map[TokenPurpose]struct {
+	ttl     time.Duration
+	expires string
+	subject string
+	intro   string
+	page    string // Path under APP_URL that finishes the flow
+	prefix  string // Makes the token recognizable, so logs can redact it
+}{
+	PurposePasswordReset: {
+		ttl:     time.Hour,
+		expires: "1 hour",
+		subject: "Reset your Tabit password",
+		intro:   "Use this to choose a new password for your Tabit account:",
+		page:    "reset-password",
+		prefix:  "tabit_reset_",
+	},
+	PurposeEmailVerification: {
+		ttl:     24 * time.Hour,
+		expires: "24 hours",
+		subject: "Verify your Tabit email",
+		intro:   "Use this to confirm the email of your Tabit account:",
+		page:    "verify-email",
+		prefix:  "tabit_verify_",
+	},
+}
+
+// NativeAuthenticator signs users in with an email and password and issues its own sessions,
+// so a self-hosted instance needs no external identity service
+type NativeAuthenticator struct {
+	ds            DataStore
+	mailer        Mailer
+	secret        []byte
+	issuer        string
+	ttl           time.Duration
+	appURL        string
+	emailsPerHour int // Limits how many emails of each kind an account can be sent
+}
+
+// nativeClaims are the claims of a native session
+type nativeClaims struct {
+	jwt.RegisteredClaims
+	SessionVersion int64 `json:"sv"` // users.session_version when the session was issued
+}
+
+// newNativeAuthenticator returns nil when no auth secret is configured.
+// Emails are sent with the mailer from NewMailer
+func newNativeAuthenticator(ds DataStore, cfg *Config) (*NativeAuthenticator, error) {
+	if cfg.Auth.Secret == "" {
+		return nil, nil
+	}
+	mailer, err := NewMailer(cfg.Mail)
+	if err != nil {
+		return nil, err
+	}
+	return &NativeAuthenticator{
+		ds:            ds,
+		mailer:        mailer,
+		secret:        []byte(cfg.Auth.Secret),
+		issuer:        cfg.Auth.Issuer,
+		ttl:           time.Duration(cfg.Auth.SessionTTL),
+		appURL:        strings.TrimSuffix(cfg.Auth.AppURL, "/"),
+		emailsPerHour: cfg.Limits.EmailsPerHour,
+	}, nil
+}
+
+// Issue signs a new session for user
+func (a *NativeAuthenticator) Issue(user *UserModel) (*SessionResponse, error) {
+	now := time.Now().UTC()
+	expires := now.Add(a.ttl)
+	claims := nativeClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    a.issuer,
+			Subject:   user.UserID,
+			Audience:  jwt.ClaimStrings{nativeAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+		SessionVersion: user.SessionVersion,
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.secret)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionResponse{UserID: user.UserID, Token: token, TokenType: "bearer", ExpiresAt: expires}, nil
+}
+
+// Authenticate checks a session issued by Issue and returns its subject.
+// Sessions issued before a password reset are rejected
+func (a *NativeAuthenticator) Authenticate(ctx context.Context, token_string string) (*string, error) {
+	var claims nativeClaims
+	token, err := jwt.ParseWithClaims(token_string, &claims, func(token *jwt.Token) (interface{}, error) {
+		return a.secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuer(a.issuer),
+		jwt.WithAudience(nativeAudience),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	user, db_err := a.ds.GetUser(ctx, claims.Subject)
+	if db_err != nil {
+		return nil, db_err
+	}
+	if user.DeletedAt != nil {
+		return nil, &HTTPError{Code: http.StatusGone, Message: "Account was deleted"}
+	}
+	if user.SessionVersion != claims.SessionVersion {
+		return nil, errors.New("session was signed out")
+	}
+	if user.MergedInto != nil {
+		return nil, &mergedAccountError{userID: user.UserID}
+	}
+	return &claims.Subject, nil
+}
+
+// sendToken emails user a one-time token for purpose
+func (a *NativeAuthenticator) sendToken(ctx context.Context, user *UserModel, purpose TokenPurpose) *HTTPError {
+	if user.Email == nil {
+		return &HTTPError{Code: http.StatusBadRequest, Message: "Account has no email"}
+	}
+	email := tokenEmails[purpose]
+	token, hash, err := newRandomToken(email.prefix)
+	if err != nil {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to create token", Err: err}
+	}
+	if db_err := a.ds.CreateAuthToken(ctx, user.UserID, purpose, hash, time.Now().UTC().Add(email.ttl), a.emailsPerHour); db_err != nil {
+		return db_err
+	}
+
+	link := token
+	if a.appURL != "" {
+		link = a.appURL + "/" + email.page + "?token=" + url.QueryEscape(token)
+	}
+	err = a.mailer.Send(ctx, Message{
+		To:      *user.Email,
+		Subject: email.subject,
+		Body:    fmt.Sprintf("%s\n\n%s\n\nIt expires in %s. If you did not ask for this, you can ignore this email.", email.intro, link, email.expires),
+	})
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Failed to send email", "user", user.UserID, "purpose", purpose, "err", err)
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to send email", Err: err}
+	}
+	return nil
+}
+
+// normalizeEmail returns the lowercased address or an error if email is not a plain address
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return "", errors.New("email is not a valid address")
+	}
+	return strings.ToLower(email), nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	if len(password) > maxPasswordLength {
+		return "", fmt.Errorf("password cannot be longer than %d bytes", maxPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// dummyPasswordHash is compared against when there is no account,
+// so a login takes as long whether or not the email is registered
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	return hash
+})
+
+// checkPassword reports whether password matches user's hash. user can be nil
+func checkPassword(user *UserModel, password string) bool {
+	if user == nil || user.PasswordHash == nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(*user.PasswordHash), []byte(password)) == nil
+}
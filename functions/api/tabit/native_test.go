@@ -0,0 +1,163 @@
+package tabit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestNativeAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	ds := newTestStore(t, "user")
+	secret := strings.Repeat("s", minAuthSecretLength)
+	a := &NativeAuthenticator{ds: ds, secret: []byte(secret), issuer: "tabit", ttl: time.Hour}
+
+	alice, db_err := ds.CreatePasswordUser(ctx, "alice", "alice@example.com", "hash")
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	bob, db_err := ds.CreatePasswordUser(ctx, "bob", "bob@example.com", "hash")
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	anonymous, db_err := ds.CreateAnonymousUser(ctx, "anonymous")
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	issue := func(user *UserModel) string {
+		session, err := a.Issue(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session.Token
+	}
+	// session signs the claims of a valid session of alice, changed by edit
+	session := func(key string, edit func(c *nativeClaims)) string {
+		c := nativeClaims{RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "tabit",
+			Subject:   "alice",
+			Audience:  jwt.ClaimStrings{nativeAudience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		}}
+		if edit != nil {
+			edit(&c)
+		}
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	bobSession, anonymousSession := issue(bob), issue(anonymous)
+	if db_err := ds.DeleteUser(ctx, "bob"); db_err != nil {
+		t.Fatal(db_err)
+	}
+	if db_err := ds.MergeAnonymousUser(ctx, "anonymous", "alice"); db_err != nil {
+		t.Fatal(db_err)
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		wantErr    bool
+		wantCode   int  // Status of the HTTPError returned, if any
+		wantMerged bool // Whether a mergedAccountError is returned
+	}{
+		{name: "issued session", token: issue(alice)},
+		{name: "another secret", token: session(strings.Repeat("x", minAuthSecretLength), nil), wantErr: true},
+		{name: "another issuer", token: session(secret, func(c *nativeClaims) { c.Issuer = "other" }), wantErr: true},
+		{name: "another audience", token: session(secret, func(c *nativeClaims) { c.Audience = jwt.ClaimStrings{"authenticated"} }), wantErr: true},
+		{name: "expired", token: session(secret, func(c *nativeClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) }), wantErr: true},
+		{name: "no expiry", token: session(secret, func(c *nativeClaims) { c.ExpiresAt = nil }), wantErr: true},
+		{name: "no subject", token: session(secret, func(c *nativeClaims) { c.Subject = "" }), wantErr: true},
+		{name: "older session version", token: session(secret, func(c *nativeClaims) { c.SessionVersion = alice.SessionVersion - 1 }), wantErr: true},
+		{name: "deleted account", token: bobSession, wantErr: true, wantCode: http.StatusGone},
+		{name: "merged anonymous account", token: anonymousSession, wantErr: true, wantMerged: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user_id, err := a.Authenticate(ctx, tt.token)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if *user_id != "alice" {
+					t.Errorf("user = %q, want alice", *user_id)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("accepted the session of %s", *user_id)
+			}
+			var failed *HTTPError
+			if tt.wantCode != 0 && (!errors.As(err, &failed) || failed.Code != tt.wantCode) {
+				t.Errorf("err = %v, want status %d", err, tt.wantCode)
+			}
+			var merged *mergedAccountError
+			if errors.As(err, &merged) != tt.wantMerged {
+				t.Errorf("err = %v, want a merged account: %v", err, tt.wantMerged)
+			}
+		})
+	}
+}
+
+func TestNativeSessions(t *testing.T) {
+	ctx := context.Background()
+	h, ds := newTestAPI(t, nil)
+	login := PasswordAuthRequest{Email: "alice@example.com", Password: "correct horse battery staple"}
+
+	var alice SessionResponse
+	if code, message := callAPI(t, h, http.MethodPost, "/api/auth/signup", "", login, &alice); code != http.StatusOK {
+		t.Fatalf("signup: %d %s", code, message)
+	}
+	var anonymous SessionResponse
+	if code, message := callAPI(t, h, http.MethodPost, "/api/auth/anonymous", "", nil, &anonymous); code != http.StatusOK {
+		t.Fatalf("anonymous signup: %d %s", code, message)
+	}
+
+	// logging in with the anonymous session merges it into alice
+	login.AnonymousToken = anonymous.Token
+	if code, message := callAPI(t, h, http.MethodPost, "/api/auth/login", "", login, nil); code != http.StatusOK {
+		t.Fatalf("login: %d %s", code, message)
+	}
+	code, message := callAPI(t, h, http.MethodGet, "/api/habits", anonymous.Token, nil, nil)
+	if code != http.StatusUnauthorized || !strings.Contains(message, (&mergedAccountError{}).Error()) {
+		t.Errorf("merged anonymous session: %d %q, want 401 saying it was merged", code, message)
+	}
+	// a client that missed the response can retry the merge
+	merge := MergeAnonymousRequest{AnonymousToken: anonymous.Token}
+	if code, message := callAPI(t, h, http.MethodPost, "/api/auth/merge", alice.Token, merge, nil); code != http.StatusOK {
+		t.Errorf("merge retry: %d %s", code, message)
+	}
+
+	// a password reset signs out every session issued before it
+	const resetToken = "tabit_reset_token"
+	if db_err := ds.CreateAuthToken(ctx, alice.UserID, PurposePasswordReset, hashToken(resetToken), time.Now().UTC().Add(time.Hour), 10); db_err != nil {
+		t.Fatal(db_err)
+	}
+	var reset SessionResponse
+	code, message = callAPI(t, h, http.MethodPost, "/api/auth/reset-password", "", ResetPasswordRequest{Token: resetToken, Password: "another horse battery staple"}, &reset)
+	if code != http.StatusOK {
+		t.Fatalf("reset password: %d %s", code, message)
+	}
+	if code, _ := callAPI(t, h, http.MethodGet, "/api/habits", alice.Token, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("session from before the reset: %d, want 401", code)
+	}
+	if code, message := callAPI(t, h, http.MethodGet, "/api/habits", reset.Token, nil, nil); code != http.StatusOK {
+		t.Errorf("session from the reset: %d %s", code, message)
+	}
+
+	// an erased account is gone for good, so its sessions get a 410 instead of a sign in prompt
+	if code, message := callAPI(t, h, http.MethodDelete, "/api/account", reset.Token, nil, nil); code != http.StatusOK {
+		t.Fatalf("delete account: %d %s", code, message)
+	}
+	if code, _ := callAPI(t, h, http.MethodGet, "/api/habits", reset.Token, nil, nil); code != http.StatusGone {
+		t.Errorf("session of a deleted account: %d, want 410", code)
+	}
+}
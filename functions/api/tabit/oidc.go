@@ -0,0 +1,190 @@
+package tabit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var discoveryClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcProvider accepts the ID tokens of an OpenID Connect identity provider as sessions.
+// Users are found through the identities table, new ones get the user id name:sub
+type oidcProvider struct {
+	ds         DataStore
+	name       string
+	issuer     string
+	clientID   string
+	trustEmail bool
+
+	mu   sync.Mutex
+	keys *jwks // nil until discovered
+	// discovering is closed when the discovery in flight is done, and nil when there is none
+	discovering chan struct{}
+	// failedAt and failure are the last failed discovery, which is not retried for jwksRefreshInterval
+	failedAt time.Time
+	failure  error
+}
+
+type oidcClaims struct {
+	jwt.RegisteredClaims
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// newOIDCProviders builds the providers of a validated config
+func newOIDCProviders(ds DataStore, providers []OIDCConfig) []*oidcProvider {
+	result := make([]*oidcProvider, 0, len(providers))
+	for _, cfg := range providers {
+		p := &oidcProvider{
+			ds:         ds,
+			name:       cfg.Name,
+			issuer:     strings.TrimSuffix(cfg.Issuer, "/"),
+			clientID:   cfg.ClientID,
+			trustEmail: cfg.TrustEmail,
+		}
+		if cfg.JWKSURL != "" {
+			p.keys = newJWKS(cfg.JWKSURL)
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+// Authenticate checks an ID token and returns the user its identity is linked to
+func (p *oidcProvider) Authenticate(ctx context.Context, token_string string) (*string, error) {
+	identity, err := p.verify(ctx, token_string)
+	if err != nil {
+		return nil, err
+	}
+	user, db_err := p.ds.UserFromIdentity(ctx, *identity, p.name+":"+identity.Subject)
+	if db_err != nil {
+		return nil, db_err
+	}
+	return &user.UserID, nil
+}
+
+// verify checks the signature and claims of an ID token
+func (p *oidcProvider) verify(ctx context.Context, token_string string) (*ExternalIdentity, error) {
+	// tokens from other issuers are turned away before they can trigger a key fetch
+	var unverified jwt.RegisteredClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(token_string, &unverified); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(unverified.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("token is not from %s", p.name)
+	}
+
+	var claims oidcClaims
+	token, err := jwt.ParseWithClaims(token_string, &claims, func(token *jwt.Token) (interface{}, error) {
+		keys, err := p.keySet(ctx)
+		if err != nil {
+			return nil, err
+		}
+		kid, _ := token.Header["kid"].(string)
+		return keys.key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithAudience(p.clientID),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if strings.TrimSuffix(claims.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("token is not from %s", p.name)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	return &ExternalIdentity{
+		Provider:      p.name,
+		Subject:       claims.Subject,
+		Email:         strings.ToLower(strings.TrimSpace(claims.Email)),
+		EmailVerified: claims.EmailVerified && p.trustEmail,
+	}, nil
+}
+
+// keySet returns the provider's keys, looking up their location in the discovery document on first use.
+// Like jwks.key, the lookup runs without holding the lock and is shared by the requests waiting for it
+func (p *oidcProvider) keySet(ctx context.Context) (*jwks, error) {
+	p.mu.Lock()
+	for {
+		if p.keys != nil {
+			p.mu.Unlock()
+			return p.keys, nil
+		}
+		if p.discovering == nil {
+			break
+		}
+		discovering := p.discovering
+		p.mu.Unlock()
+		select {
+		case <-discovering:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		p.mu.Lock()
+	}
+	if p.failure != nil && time.Since(p.failedAt) < jwksRefreshInterval {
+		err := p.failure
+		p.mu.Unlock()
+		return nil, err
+	}
+	discovering := make(chan struct{})
+	p.discovering = discovering
+	p.mu.Unlock()
+
+	discoverCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jwksFetchTimeout)
+	keys, err := p.discover(discoverCtx)
+	cancel()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.failedAt, p.failure = time.Now(), err
+	} else {
+		p.keys, p.failure = keys, nil
+	}
+	p.discovering = nil
+	close(discovering)
+	return keys, err
+}
+
+// discover reads the location of the provider's keys from its discovery document
+func (p *oidcProvider) discover(ctx context.Context) (*jwks, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := discoveryClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover %s: %w", p.name, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to discover %s: unexpected status %d", p.name, res.StatusCode)
+	}
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&discovery); err != nil {
+		return nil, fmt.Errorf("failed to discover %s: %w", p.name, err)
+	}
+	if discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("failed to discover %s: no jwks_uri", p.name)
+	}
+	return newJWKS(discovery.JWKSURI), nil
+}
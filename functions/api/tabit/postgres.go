@@ -0,0 +1,1334 @@
+package tabit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-jet/jet/v2/qrm"
+
+	"tabit-serverless/.gen_pg/tabit/public/model"
+	. "tabit-serverless/.gen_pg/tabit/public/table"
+
+	. "github.com/go-jet/jet/v2/postgres"
+	_ "github.com/lib/pq"
+)
+
+func (ds *PostgresDataStore) Close() error {
+	return ds.DB.Close()
+}
+
+func (ds *PostgresDataStore) CreateUser(ctx context.Context, user_id string) *HTTPError {
+	var existing model.Users
+	lookup := SELECT(Users.UserID, Users.DeletedAt).
+		FROM(Users).
+		WHERE(Users.UserID.EQ(Text(user_id)))
+	err := lookup.QueryContext(ctx, ds.DB, &existing)
+	if err == nil {
+		if existing.DeletedAt != nil {
+			return &HTTPError{Code: http.StatusGone, Message: "Account was deleted"}
+		}
+		return nil
+	}
+	if err != qrm.ErrNoRows {
+		Logger(ctx).ErrorContext(ctx, "Error querying user", "user", user_id, "err", err)
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to query user", Err: err}
+	}
+
+	user := model.Users{UserID: user_id}
+
+	stmt := Users.INSERT(Users.UserID).MODEL(user).ON_CONFLICT().DO_NOTHING()
+
+	_, err = stmt.ExecContext(ctx, ds.DB)
+	if err != nil {
+		return &HTTPError{
+			Code:    http.StatusInternalServerError,
+			Message: "Failed to create user",
+			Err:     err,
+		}
+	}
+	return nil
+}
+
+func (ds *PostgresDataStore) DeleteUser(ctx context.Context, user_id string) *HTTPError {
+	return deleteUser(ctx, ds.DB, ds, user_id)
+}
+
+func (ds *PostgresDataStore) CreatePasswordUser(ctx context.Context, user_id string, email string, password_hash string) (*UserModel, *HTTPError) {
+	user := model.Users{UserID: user_id, Email: &email, PasswordHash: &password_hash}
+	stmt := Users.INSERT(Users.UserID, Users.Email, Users.PasswordHash).
+		MODEL(user).
+		ON_CONFLICT(Users.UserID).
+		DO_UPDATE(SET(
+			Users.Email.SET(Users.EXCLUDED.Email),
+			Users.PasswordHash.SET(Users.EXCLUDED.PasswordHash),
+			Users.IsAnonymous.SET(Bool(false)),
+		).WHERE(Users.IsAnonymous.AND(Users.MergedInto.IS_NULL()))).
+		RETURNING(Users.AllColumns)
+
+	var dest model.Users
+	err := stmt.QueryContext(ctx, ds.DB, &dest)
+	if err == qrm.ErrNoRows {
+		return nil, &HTTPError{Code: http.StatusConflict, Message: "Account is not anonymous"}
+	}
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, &HTTPError{Code: http.StatusConflict, Message: "email is already registered", Err: err}
+		}
+		Logger(ctx).ErrorContext(ctx, "Error inserting user", "user", user_id, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to create user", Err: err}
+	}
+	return userFromModel(dest), nil
+}
+
+func (ds *PostgresDataStore) CreateAnonymousUser(ctx context.Context, user_id string) (*UserModel, *HTTPError) {
+	user := model.Users{UserID: user_id, IsAnonymous: true}
+	stmt := Users.INSERT(Users.UserID, Users.IsAnonymous).
+		MODEL(user).
+		ON_CONFLICT(Users.UserID).
+		DO_NOTHING()
+	if _, err := stmt.ExecContext(ctx, ds.DB); err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error inserting user", "user", user_id, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to create user", Err: err}
+	}
+	return ds.GetUser(ctx, user_id)
+}
+
+func (ds *PostgresDataStore) MergeAnonymousUser(ctx context.Context, anonymous_id string, user_id string) *HTTPError {
+	return mergeAnonymousUser(ctx, ds.DB, ds, anonymous_id, user_id)
+}
+
+func (ds *PostgresDataStore) GetUserByEmail(ctx context.Context, email string) (*UserModel, *HTTPError) {
+	var user model.Users
+	stmt := SELECT(Users.AllColumns).
+		FROM(Users).
+		WHERE(Users.Email.EQ(Text(email)))
+	err := stmt.QueryContext(ctx, ds.DB, &user)
+	if err == qrm.ErrNoRows {
+		return nil, &HTTPError{Code: http.StatusNotFound, Message: "User not found"}
+	}
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error querying user", "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to query user", Err: err}
+	}
+	return userFromModel(user), nil
+}
+
+func (ds *PostgresDataStore) GetUser(ctx context.Context, user_id string) (*UserModel, *HTTPError) {
+	var user model.Users
+	stmt := SELECT(Users.AllColumns).
+		FROM(Users).
+		WHERE(Users.UserID.EQ(Text(user_id)))
+	err := stmt.QueryContext(ctx, ds.DB, &user)
+	if err == qrm.ErrNoRows {
+		return nil, &HTTPError{Code: http.StatusNotFound, Message: "User not found"}
+	}
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error querying user", "user", user_id, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to query user", Err: err}
+	}
+	return userFromModel(user), nil
+}
+
+func (ds *PostgresDataStore) CreateAuthToken(ctx context.Context, user_id string, purpose TokenPurpose, hash string, expires_at time.Time, max_per_hour int) *HTTPError {
+	tx, err := ds.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to create token", Err: err}
+	}
+	defer tx.Rollback()
+	// concurrent requests for the same user wait here, so each one counts the tokens of the others
+	if _, db_err := ds.lockUser(ctx, tx, user_id); db_err != nil {
+		return db_err
+	}
+
+	var recent []model.AuthTokens
+	stmt := SELECT(AuthTokens.AllColumns).
+		FROM(AuthTokens).
+		WHERE(AuthTokens.UserID.EQ(Text(user_id)).AND(AuthTokens.Purpose.EQ(Text(string(purpose))))).
+		ORDER_BY(AuthTokens.TokenID.DESC()).
+		LIMIT(int64(max_per_hour))
+	err = stmt.QueryContext(ctx, tx, &recent)
+	if err != nil && err != qrm.ErrNoRows {
+		Logger(ctx).ErrorContext(ctx, "Error querying auth tokens", "user", user_id, "err", err)
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to create token", Err: err}
+	}
+	now := time.Now().UTC()
+	if len(recent) >= max_per_hour {
+		oldest := recent[len(recent)-1].CreatedAt
+		if oldest != nil && oldest.After(now.Add(-time.Hour)) {
+			return &HTTPError{Code: http.StatusTooManyRequests, Message: "Too many requests, try again later"}
+		}
+	}
+
+	// created_at is set here rather than by the database so it is compared in the same time zone
+	token := model.AuthTokens{UserID: user_id, Purpose: string(purpose), TokenHash: hash, CreatedAt: &now, ExpiresAt: expires_at}
+	insert := AuthTokens.INSERT(AuthTokens.UserID, AuthTokens.Purpose, AuthTokens.TokenHash, AuthTokens.CreatedAt, AuthTokens.ExpiresAt).
+		MODEL(token)
+	if _, err := insert.ExecContext(ctx, tx); err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error inserting auth token", "user", user_id, "err", err)
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to create token", Err: err}
+	}
+	if err := tx.Commit(); err != nil {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to create token", Err: err}
+	}
+	return nil
+}
+
+func (ds *PostgresDataStore) ResetPassword(ctx context.Context, hash string, password_hash string) (*UserModel, *HTTPError) {
+	tx, err := ds.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to reset password", Err: err}
+	}
+	defer tx.Rollback()
+
+	token, db_err := ds.useAuthToken(ctx, tx, hash, PurposePasswordReset)
+	if db_err != nil {
+		return nil, db_err
+	}
+	user, db_err := ds.lockUser(ctx, tx, token.UserID)
+	if db_err != nil {
+		return nil, db_err
+	}
+	now := time.Now().UTC()
+	user.PasswordHash = &password_hash
+	user.SessionVersion++
+	if user.EmailVerifiedAt == nil {
+		// following the emailed link proves the address works
+		user.EmailVerifiedAt = &now
+	}
+	update := Users.UPDATE(Users.PasswordHash, Users.SessionVersion, Users.EmailVerifiedAt).
+		MODEL(user).
+		WHERE(Users.UserID.EQ(Text(token.UserID)))
+	if _, err := update.ExecContext(ctx, tx); err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error updating password", "user", token.UserID, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to reset password", Err: err}
+	}
+
+	// other reset links still in the inbox should not work either
+	expire := AuthTokens.UPDATE(AuthTokens.UsedAt).
+		MODEL(model.AuthTokens{UsedAt: &now}).
+		WHERE(AuthTokens.UserID.EQ(Text(token.UserID)).
+			AND(AuthTokens.Purpose.EQ(Text(string(PurposePasswordReset)))).
+			AND(AuthTokens.UsedAt.IS_NULL()))
+	if _, err := expire.ExecContext(ctx, tx); err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error expiring reset tokens", "user", token.UserID, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to reset password", Err: err}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to reset password", Err: err}
+	}
+	return userFromModel(user), nil
+}
+
+func (ds *PostgresDataStore) VerifyEmail(ctx context.Context, hash string) (*UserModel, *HTTPError) {
+	tx, err := ds.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to verify email", Err: err}
+	}
+	defer tx.Rollback()
+
+	token, db_err := ds.useAuthToken(ctx, tx, hash, PurposeEmailVerification)
+	if db_err != nil {
+		return nil, db_err
+	}
+	user, db_err := ds.lockUser(ctx, tx, token.UserID)
+	if db_err != nil {
+		return nil, db_err
+	}
+	if user.EmailVerifiedAt == nil {
+		now := time.Now().UTC()
+		user.EmailVerifiedAt = &now
+		update := Users.UPDATE(Users.EmailVerifiedAt).
+			MODEL(user).
+			WHERE(Users.UserID.EQ(Text(token.UserID)))
+		if _, err := update.ExecContext(ctx, tx); err != nil {
+			Logger(ctx).ErrorContext(ctx, "Error verifying email", "user", token.UserID, "err", err)
+			return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to verify email", Err: err}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to verify email", Err: err}
+	}
+	return userFromModel(user), nil
+}
+
+func (ds *PostgresDataStore) UserFromIdentity(ctx context.Context, identity ExternalIdentity, new_user_id string) (*UserModel, *HTTPError) {
+	tx, err := ds.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to sign in", Err: err}
+	}
+	defer tx.Rollback()
+
+	var linked model.Identities
+	stmt := SELECT(Identities.AllColumns).
+		FROM(Identities).
+		WHERE(Identities.Provider.EQ(Text(identity.Provider)).AND(Identities.Subject.EQ(Text(identity.Subject))))
+	err = stmt.QueryContext(ctx, tx, &linked)
+	if err != nil && err != qrm.ErrNoRows {
+		Logger(ctx).ErrorContext(ctx, "Error querying identity", "provider", identity.Provider, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to sign in", Err: err}
+	}
+	if err == nil {
+		user, db_err := ds.lockUser(ctx, tx, linked.UserID)
+		if db_err != nil {
+			return nil, db_err
+		}
+		return userFromModel(user), nil
+	}
+
+	var user model.Users
+	found := false
+	if identity.Email != "" && identity.EmailVerified {
+		stmt := SELECT(Users.AllColumns).
+			FROM(Users).
+			WHERE(Users.Email.EQ(Text(identity.Email))).
+			FOR(UPDATE())
+		err := stmt.QueryContext(ctx, tx, &user)
+		if err != nil && err != qrm.ErrNoRows {
+			Logger(ctx).ErrorContext(ctx, "Error querying user", "err", err)
+			return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to sign in", Err: err}
+		}
+		found = err == nil
+	}
+
+	now := time.Now().UTC()
+	if found {
+		if user.EmailVerifiedAt == nil {
+			// whoever signed up with this email never proved they own it. The provider just did,
+			// so their password and sessions stop working rather than keep access to the account
+			user.EmailVerifiedAt = &now
+			user.PasswordHash = nil
+			user.SessionVersion++
+			update := Users.UPDATE(Users.EmailVerifiedAt, Users.PasswordHash, Users.SessionVersion).
+				MODEL(user).
+				WHERE(Users.UserID.EQ(Text(user.UserID)))
+			if _, err := update.ExecContext(ctx, tx); err != nil {
+				Logger(ctx).ErrorContext(ctx, "Error updating user", "user", user.UserID, "err", err)
+				return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to sign in", Err: err}
+			}
+		}
+	} else {
+		user = model.Users{UserID: new_user_id}
+		if identity.Email != "" && identity.EmailVerified {
+			user.Email = &identity.Email
+			user.EmailVerifiedAt = &now
+		}
+		// new_user_id can already exist when it is derived from the identity and the identity was unlinked.
+		// The account is picked up again rather than failing every sign in
+		insert := Users.INSERT(Users.UserID, Users.Email, Users.EmailVerifiedAt).
+			MODEL(user).
+			ON_CONFLICT(Users.UserID).DO_NOTHING()
+		if _, err := insert.ExecContext(ctx, tx); err != nil {
+			if isUniqueViolation(err) {
+				return nil, &HTTPError{Code: http.StatusConflict, Message: "Email is already registered to another account", Err: err}
+			}
+			Logger(ctx).ErrorContext(ctx, "Error inserting user", "user", new_user_id, "err", err)
+			return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to sign in", Err: err}
+		}
+		var db_err *HTTPError
+		user, db_err = ds.lockUser(ctx, tx, new_user_id)
+		if db_err != nil {
+			return nil, db_err
+		}
+		if user.DeletedAt != nil {
+			return nil, &HTTPError{Code: http.StatusGone, Message: "Account was deleted"}
+		}
+	}
+
+	if db_err := ds.linkIdentity(ctx, tx, user.UserID, identity); db_err != nil {
+		return nil, db_err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to sign in", Err: err}
+	}
+	return userFromModel(user), nil
+}
+
+func (ds *PostgresDataStore) LinkIdentity(ctx context.Context, user_id string, identity ExternalIdentity) *HTTPError {
+	tx, err := ds.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to link identity", Err: err}
+	}
+	defer tx.Rollback()
+
+	if db_err := ds.linkIdentity(ctx, tx, user_id, identity); db_err != nil {
+		return db_err
+	}
+	if err := tx.Commit(); err != nil {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to link identity", Err: err}
+	}
+	return nil
+}
+
+func (ds *PostgresDataStore) GetIdentities(ctx context.Context, user_id string) ([]IdentityModel, *HTTPError) {
+	var identities []model.Identities
+	stmt := SELECT(Identities.AllColumns).
+		FROM(Identities).
+		WHERE(Identities.UserID.EQ(Text(user_id))).
+		ORDER_BY(Identities.CreatedAt)
+	err := stmt.QueryContext(ctx, ds.DB, &identities)
+	if err != nil && err != qrm.ErrNoRows {
+		Logger(ctx).ErrorContext(ctx, "Error querying identities", "user", user_id, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to query identities", Err: err}
+	}
+
+	result := make([]IdentityModel, 0, len(identities))
+	for _, identity := range identities {
+		result = append(result, IdentityModel{
+			Provider:  identity.Provider,
+			Subject:   identity.Subject,
+			Email:     identity.Email,
+			CreatedAt: identity.CreatedAt,
+		})
+	}
+	return result, nil
+}
+
+func (ds *PostgresDataStore) DeleteIdentity(ctx context.Context, user_id string, provider string, subject string) *HTTPError {
+	tx, err := ds.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to unlink identity", Err: err}
+	}
+	defer tx.Rollback()
+
+	user, db_err := ds.lockUser(ctx, tx, user_id)
+	if db_err != nil {
+		return db_err
+	}
+	stmt := Identities.DELETE().
+		WHERE(Identities.UserID.EQ(Text(user_id)).
+			AND(Identities.Provider.EQ(Text(provider))).
+			AND(Identities.Subject.EQ(Text(subject))))
+	res, err := stmt.ExecContext(ctx, tx)
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error deleting identity", "user", user_id, "provider", provider, "err", err)
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to unlink identity", Err: err}
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return &HTTPError{Code: http.StatusNotFound, Message: "Identity not found"}
+	}
+
+	if user.PasswordHash == nil {
+		var remaining []model.Identities
+		stmt := SELECT(Identities.AllColumns).
+			FROM(Identities).
+			WHERE(Identities.UserID.EQ(Text(user_id))).
+			LIMIT(1)
+		if err := stmt.QueryContext(ctx, tx, &remaining); err != nil && err != qrm.ErrNoRows {
+			Logger(ctx).ErrorContext(ctx, "Error querying identities", "user", user_id, "err", err)
+			return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to unlink identity", Err: err}
+		}
+		if len(remaining) == 0 {
+			return &HTTPError{Code: http.StatusConflict, Message: "Cannot unlink the only way to sign in"}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to unlink identity", Err: err}
+	}
+	return nil
+}
+
+func (ds *PostgresDataStore) linkIdentity(ctx context.Context, tx *sql.Tx, user_id string, identity ExternalIdentity) *HTTPError {
+	linked := model.Identities{Provider: identity.Provider, Subject: identity.Subject, UserID: user_id}
+	if identity.Email != "" {
+		linked.Email = &identity.Email
+	}
+	insert := Identities.INSERT(Identities.Provider, Identities.Subject, Identities.UserID, Identities.Email).
+		MODEL(linked)
+	if _, err := insert.ExecContext(ctx, tx); err != nil {
+		if isUniqueViolation(err) {
+			return &HTTPError{Code: http.StatusConflict, Message: "Identity is already linked to an account", Err: err}
+		}
+		Logger(ctx).ErrorContext(ctx, "Error linking identity", "user", user_id, "provider", identity.Provider, "err", err)
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to link identity", Err: err}
+	}
+	return nil
+}
+
+// useAuthToken marks an unused and unexpired token as used
+func (ds *PostgresDataStore) useAuthToken(ctx context.Context, tx *sql.Tx, hash string, purpose TokenPurpose) (*model.AuthTokens, *HTTPError) {
+	var token model.AuthTokens
+	stmt := SELECT(AuthTokens.AllColumns).
+		FROM(AuthTokens).
+		WHERE(AuthTokens.TokenHash.EQ(Text(hash)).AND(AuthTokens.Purpose.EQ(Text(string(purpose))))).
+		FOR(UPDATE())
+	err := stmt.QueryContext(ctx, tx, &token)
+	if err != nil && err != qrm.ErrNoRows {
+		Logger(ctx).ErrorContext(ctx, "Error querying auth token", "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to check token", Err: err}
+	}
+	now := time.Now().UTC()
+	if err == qrm.ErrNoRows || token.UsedAt != nil || !token.ExpiresAt.After(now) {
+		return nil, &HTTPError{Code: http.StatusBadRequest, Message: "Token is invalid or has expired"}
+	}
+
+	update := AuthTokens.UPDATE(AuthTokens.UsedAt).
+		MODEL(model.AuthTokens{UsedAt: &now}).
+		WHERE(AuthTokens.TokenID.EQ(Int32(token.TokenID)))
+	if _, err := update.ExecContext(ctx, tx); err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error using auth token", "token", token.TokenID, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to check token", Err: err}
+	}
+	token.UsedAt = &now
+	return &token, nil
+}
+
+// lockUser reads a user for update
+func (ds *PostgresDataStore) lockUser(ctx context.Context, tx *sql.Tx, user_id string) (model.Users, *HTTPError) {
+	var user model.Users
+	stmt := SELECT(Users.AllColumns).
+		FROM(Users).
+		WHERE(Users.UserID.EQ(Text(user_id))).
+		FOR(UPDATE())
+	err := stmt.QueryContext(ctx, tx, &user)
+	if err == qrm.ErrNoRows {
+		return user, &HTTPError{Code: http.StatusNotFound, Message: "User not found"}
+	}
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error querying user", "user", user_id, "err", err)
+		return user, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to query user", Err: err}
+	}
+	return user, nil
+}
+
+func userFromModel(user model.Users) *UserModel {
+	return &UserModel{
+		UserID:          user.UserID,
+		Email:           user.Email,
+		EmailVerifiedAt: user.EmailVerifiedAt,
+		PasswordHash:    user.PasswordHash,
+		SessionVersion:  user.SessionVersion,
+		Anonymous:       user.IsAnonymous,
+		MergedInto:      user.MergedInto,
+		DeletedAt:       user.DeletedAt,
+		CreatedAt:       user.CreatedAt,
+	}
+}
+
+// lockAccount is lockUser for the flows shared with sqlite
+func (ds *PostgresDataStore) lockAccount(ctx context.Context, tx *sql.Tx, user_id string) (*UserModel, *HTTPError) {
+	user, db_err := ds.lockUser(ctx, tx, user_id)
+	if db_err != nil {
+		return nil, db_err
+	}
+	return userFromModel(user), nil
+}
+
+func (ds *PostgresDataStore) SyncUserData(ctx context.Context, user_id string, base_version *int64, last_updated int64, data map[string]HabitData) (*UserSyncStateModel, *HTTPError) {
+	return syncUserData(ctx, ds.DB, ds, user_id, base_version, last_updated, data)
+}
+
+func (ds *PostgresDataStore) SyncChanges(ctx context.Context, user_id string, base_version *int64, cursor int64, last_updated int64, changes map[string]HabitData) (*SyncChangesModel, *HTTPError) {
+	return syncChanges(ctx, ds.DB, ds, user_id, base_version, cursor, last_updated, changes)
+}
+
+// lockSyncState locks the user's sync state, creating it when the user never synced
+func (ds *PostgresDataStore) lockSyncState(ctx context.Context, tx *sql.Tx, user_id string) (*UserSyncStateModel, *HTTPError) {
+	// make sure there is a row to lock so concurrent syncs queue up behind each other
+	ensure := UserSyncState.INSERT(UserSyncState.UserID, UserSyncState.Data, UserSyncState.LastUpdated).
+		VALUES(Text(user_id), Json("{}"), Int(0)).
+		ON_CONFLICT(UserSyncState.UserID).
+		DO_NOTHING()
+	if _, err := ensure.ExecContext(ctx, tx); err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error creating sync state", "user", user_id, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to save sync state", Err: err}
+	}
+
+	var existing model.UserSyncState
+	stmt := SELECT(UserSyncState.AllColumns).
+		FROM(UserSyncState).
+		WHERE(UserSyncState.UserID.EQ(Text(user_id))).
+		FOR(UPDATE())
+	err := stmt.QueryContext(ctx, tx, &existing)
+	if err != nil {
+		query, _ := stmt.Sql()
+		Logger(ctx).ErrorContext(ctx, "Error querying sync state", "user", user_id, "query", query, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Database error checking sync state", Err: err}
+	}
+	if existing.UserID == "" {
+		query, _ := stmt.Sql()
+		syncAnomalies.WithLabelValues("invalid_existing").Inc()
+		Logger(ctx).WarnContext(ctx, "existing is likely invalid", "user", user_id, "query", query)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Database error checking sync state"}
+	}
+	return syncStateFromModel(existing), nil
+}
+
+// storedSyncState also locks the state, so a sync cannot change it halfway through a projection or merge
+func (ds *PostgresDataStore) storedSyncState(ctx context.Context, tx *sql.Tx, user_id string) (*UserSyncStateModel, error) {
+	var state model.UserSyncState
+	stmt := SELECT(UserSyncState.AllColumns).
+		FROM(UserSyncState).
+		WHERE(UserSyncState.UserID.EQ(Text(user_id))).
+		FOR(UPDATE())
+	if err := stmt.QueryContext(ctx, tx, &state); err != nil {
+		return nil, err
+	}
+	return syncStateFromModel(state), nil
+}
+
+func (ds *PostgresDataStore) saveSyncState(state *UserSyncStateModel) sqlStatement {
+	return UserSyncState.UPDATE(UserSyncState.Data, UserSyncState.LastUpdated, UserSyncState.Version).
+		MODEL(state).
+		WHERE(UserSyncState.UserID.EQ(Text(state.UserID)))
+}
+
+func syncStateFromModel(state model.UserSyncState) *UserSyncStateModel {
+	return &UserSyncStateModel{UserID: state.UserID, LastUpdated: state.LastUpdated, Data: state.Data, Version: state.Version}
+}
+
+func (ds *PostgresDataStore) latestChange(ctx context.Context, tx *sql.Tx, user_id string) (int64, error) {
+	var latest struct {
+		Latest *int64
+	}
+	stmt := SELECT(MAXi(SyncChanges.ChangeID).AS("latest")).
+		FROM(SyncChanges).
+		WHERE(SyncChanges.UserID.EQ(Text(user_id)))
+	if err := stmt.QueryContext(ctx, tx, &latest); err != nil && err != qrm.ErrNoRows {
+		return 0, err
+	}
+	if latest.Latest == nil {
+		return 0, nil
+	}
+	return *latest.Latest, nil
+}
+
+func (ds *PostgresDataStore) insertChanges(ctx context.Context, tx *sql.Tx, user_id string, changes map[string]string, now time.Time) ([]int64, error) {
+	rows := make([]model.SyncChanges, 0, len(changes))
+	for habit, data := range changes {
+		rows = append(rows, model.SyncChanges{UserID: user_id, Habit: habit, Data: data, CreatedAt: &now})
+	}
+	insert := SyncChanges.INSERT(SyncChanges.UserID, SyncChanges.Habit, SyncChanges.Data, SyncChanges.CreatedAt).
+		MODELS(rows).
+		RETURNING(SyncChanges.ChangeID)
+	var inserted []model.SyncChanges
+	if err := insert.QueryContext(ctx, tx, &inserted); err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(inserted))
+	for _, change := range inserted {
+		ids = append(ids, change.ChangeID)
+	}
+	return ids, nil
+}
+
+func (ds *PostgresDataStore) changesBetween(ctx context.Context, tx *sql.Tx, user_id string, after int64, through int64) ([]recordedChange, error) {
+	return ds.recordedChanges(ctx, tx, SyncChanges.UserID.EQ(Text(user_id)).
+		AND(SyncChanges.ChangeID.GT(Int(after))).
+		AND(SyncChanges.ChangeID.LT_EQ(Int(through))))
+}
+
+func (ds *PostgresDataStore) changesBefore(ctx context.Context, tx *sql.Tx, user_id string, cutoff time.Time) ([]recordedChange, error) {
+	return ds.recordedChanges(ctx, tx, SyncChanges.UserID.EQ(Text(user_id)).
+		AND(SyncChanges.CreatedAt.LT(TimestampT(cutoff))))
+}
+
+// recordedChanges reads the changes matching condition, ordered by id
+func (ds *PostgresDataStore) recordedChanges(ctx context.Context, tx *sql.Tx, condition BoolExpression) ([]recordedChange, error) {
+	var rows []model.SyncChanges
+	stmt := SELECT(SyncChanges.ChangeID, SyncChanges.Habit, SyncChanges.Data).
+		FROM(SyncChanges).
+		WHERE(condition).
+		ORDER_BY(SyncChanges.ChangeID)
+	if err := stmt.QueryContext(ctx, tx, &rows); err != nil && err != qrm.ErrNoRows {
+		return nil, err
+	}
+	changes := make([]recordedChange, 0, len(rows))
+	for _, row := range rows {
+		changes = append(changes, recordedChange{ChangeID: row.ChangeID, Habit: row.Habit, Data: row.Data})
+	}
+	return changes, nil
+}
+
+func (ds *PostgresDataStore) compactSteps(folded []recordedChange, deleted []int64) []sqlStep {
+	steps := make([]sqlStep, 0, len(folded)+1)
+	for _, change := range folded {
+		steps = append(steps, sqlStep{"fold change", SyncChanges.UPDATE(SyncChanges.Data).
+			MODEL(model.SyncChanges{Data: change.Data}).
+			WHERE(SyncChanges.ChangeID.EQ(Int(change.ChangeID)))})
+	}
+	ids := make([]Expression, 0, len(deleted))
+	for _, id := range deleted {
+		ids = append(ids, Int(id))
+	}
+	return append(steps, sqlStep{"delete folded changes", SyncChanges.DELETE().WHERE(SyncChanges.ChangeID.IN(ids...))})
+}
+
+func (ds *PostgresDataStore) CreateHabit(ctx context.Context, user_id string, req CreateHabitRequest) (*HabitModel, *HTTPError) {
+	habit := model.Habits{UserID: user_id, Name: req.Name}
+	columns := ColumnList{Habits.UserID, Habits.Name}
+	if req.Sort != nil {
+		habit.Sort = int32(*req.Sort)
+		columns = append(columns, Habits.Sort)
+	}
+	if req.WeeklyTarget != nil && *req.WeeklyTarget > 0 {
+		target := int32(*req.WeeklyTarget)
+		habit.WeeklyTarget = &target
+		columns = append(columns, Habits.WeeklyTarget)
+	}
+
+	tx, err := ds.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to insert habit", Err: err}
+	}
+	defer tx.Rollback()
+	if _, db_err := ds.lockSyncState(ctx, tx, user_id); db_err != nil {
+		return nil, db_err
+	}
+
+	stmt := Habits.INSERT(columns).
+		MODEL(habit).
+		RETURNING(Habits.AllColumns)
+
+	var dest model.Habits
+	err = stmt.QueryContext(ctx, tx, &dest)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, &HTTPError{Code: http.StatusConflict, Message: "Habit already exists", Err: err}
+		}
+		Logger(ctx).ErrorContext(ctx, "Error inserting habit", "user", user_id, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to insert habit", Err: err}
+	}
+	created := habitFromModel(dest, map[string]int{})
+
+	now := time.Now()
+	if db_err := recordHabitChanges(ctx, tx, ds, user_id, map[string]HabitData{created.Name: createdHabit(*created, now.UnixMilli())}, now); db_err != nil {
+		return nil, db_err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to insert habit", Err: err}
+	}
+	return created, nil
+}
+
+func (ds *PostgresDataStore) GetHabits(ctx context.Context, user_id string) ([]HabitModel, *HTTPError) {
+	var habits []model.Habits
+	stmt := SELECT(Habits.AllColumns).
+		FROM(Habits).
+		WHERE(Habits.UserID.EQ(Text(user_id))).
+		ORDER_BY(Habits.Sort, Habits.HabitID)
+	err := stmt.QueryContext(ctx, ds.DB, &habits)
+	if err != nil && err != qrm.ErrNoRows {
+		Logger(ctx).ErrorContext(ctx, "Error querying habits", "user", user_id, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to query habits", Err: err}
+	}
+
+	logs, db_err := ds.habitLogs(ctx, ds.DB, Habits.UserID.EQ(Text(user_id)))
+	if db_err != nil {
+		return nil, db_err
+	}
+
+	result := make([]HabitModel, 0, len(habits))
+	for _, habit := range habits {
+		result = append(result, *habitFromModel(habit, logs[int64(habit.HabitID)]))
+	}
+	return result, nil
+}
+
+func (ds *PostgresDataStore) GetHabit(ctx context.Context, user_id string, habit_id int64) (*HabitModel, *HTTPError) {
+	var habit model.Habits
+	stmt := SELECT(Habits.AllColumns).
+		FROM(Habits).
+		WHERE(Habits.UserID.EQ(Text(user_id)).AND(Habits.HabitID.EQ(Int(habit_id))))
+	err := stmt.QueryContext(ctx, ds.DB, &habit)
+	if err == qrm.ErrNoRows {
+		return nil, &HTTPError{Code: http.StatusNotFound, Message: "Habit not found"}
+	}
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error querying habit", "user", user_id, "habit", habit_id, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to query habit", Err: err}
+	}
+
+	logs, db_err := ds.habitLogs(ctx, ds.DB, Habits.HabitID.EQ(Int(habit_id)))
+	if db_err != nil {
+		return nil, db_err
+	}
+	return habitFromModel(habit, logs[habit_id]), nil
+}
+
+func (ds *PostgresDataStore) UpdateHabit(ctx context.Context, user_id string, habit_id int64, req UpdateHabitRequest) (*HabitModel, *HTTPError) {
+	var habit model.Habits
+	columns := ColumnList{}
+	if req.Name != nil {
+		habit.Name = *req.Name
+		columns = append(columns, Habits.Name)
+	}
+	if req.Sort != nil {
+		habit.Sort = int32(*req.Sort)
+		columns = append(columns, Habits.Sort)
+	}
+	if req.WeeklyTarget != nil {
+		// a target of 0 clears the weekly goal
+		if *req.WeeklyTarget > 0 {
+			target := int32(*req.WeeklyTarget)
+			habit.WeeklyTarget = &target
+		}
+		columns = append(columns, Habits.WeeklyTarget)
+	}
+	if len(columns) == 0 {
+		return ds.GetHabit(ctx, user_id, habit_id)
+	}
+
+	tx, err := ds.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to update habit", Err: err}
+	}
+	defer tx.Rollback()
+	if _, db_err := ds.lockSyncState(ctx, tx, user_id); db_err != nil {
+		return nil, db_err
+	}
+
+	// the old name is needed to record a rename
+	var old model.Habits
+	current := SELECT(Habits.Name).
+		FROM(Habits).
+		WHERE(Habits.UserID.EQ(Text(user_id)).AND(Habits.HabitID.EQ(Int(habit_id)))).
+		FOR(UPDATE())
+	err = current.QueryContext(ctx, tx, &old)
+	if err == qrm.ErrNoRows {
+		return nil, &HTTPError{Code: http.StatusNotFound, Message: "Habit not found"}
+	}
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error querying habit", "user", user_id, "habit", habit_id, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to update habit", Err: err}
+	}
+
+	stmt := Habits.UPDATE(columns).
+		MODEL(habit).
+		WHERE(Habits.UserID.EQ(Text(user_id)).AND(Habits.HabitID.EQ(Int(habit_id)))).
+		RETURNING(Habits.AllColumns)
+
+	var dest model.Habits
+	err = stmt.QueryContext(ctx, tx, &dest)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, &HTTPError{Code: http.StatusConflict, Message: "Habit already exists", Err: err}
+		}
+		Logger(ctx).ErrorContext(ctx, "Error updating habit", "user", user_id, "habit", habit_id, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to update habit", Err: err}
+	}
+
+	logs, db_err := ds.habitLogs(ctx, tx, Habits.HabitID.EQ(Int(habit_id)))
+	if db_err != nil {
+		return nil, db_err
+	}
+	updated := habitFromModel(dest, logs[habit_id])
+
+	now := time.Now()
+	if db_err = recordHabitChanges(ctx, tx, ds, user_id, updatedHabit(old.Name, *updated, req, now.UnixMilli()), now); db_err != nil {
+		return nil, db_err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to update habit", Err: err}
+	}
+	return updated, nil
+}
+
+func (ds *PostgresDataStore) DeleteHabit(ctx context.Context, user_id string, habit_id int64) *HTTPError {
+	tx, err := ds.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to delete habit", Err: err}
+	}
+	defer tx.Rollback()
+	if _, db_err := ds.lockSyncState(ctx, tx, user_id); db_err != nil {
+		return db_err
+	}
+
+	// the name is what the sync state knows the habit by
+	var habit model.Habits
+	current := SELECT(Habits.Name).
+		FROM(Habits).
+		WHERE(Habits.UserID.EQ(Text(user_id)).AND(Habits.HabitID.EQ(Int(habit_id)))).
+		FOR(UPDATE())
+	err = current.QueryContext(ctx, tx, &habit)
+	if err == qrm.ErrNoRows {
+		return &HTTPError{Code: http.StatusNotFound, Message: "Habit not found"}
+	}
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error querying habit", "user", user_id, "habit", habit_id, "err", err)
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to delete habit", Err: err}
+	}
+
+	_, err = runSteps(ctx, tx, ds.deleteHabits(Habits.UserID.EQ(Text(user_id)).AND(Habits.HabitID.EQ(Int(habit_id)))))
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error deleting habit", "user", user_id, "habit", habit_id, "err", err)
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to delete habit", Err: err}
+	}
+
+	now := time.Now()
+	if db_err := recordHabitChanges(ctx, tx, ds, user_id, map[string]HabitData{habit.Name: {DeletedAt: now.UnixMilli()}}, now); db_err != nil {
+		return db_err
+	}
+	if err = tx.Commit(); err != nil {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to delete habit", Err: err}
+	}
+	return nil
+}
+
+func (ds *PostgresDataStore) LogHabit(ctx context.Context, user_id string, habit_id int64, req LogHabitRequest) (*HabitLogModel, *HTTPError) {
+	day, err := time.Parse(time.DateOnly, req.Day)
+	if err != nil {
+		return nil, &HTTPError{Code: http.StatusBadRequest, Message: "Date format must be yyyy-mm-dd", Err: err}
+	}
+
+	tx, err := ds.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to log habit", Err: err}
+	}
+	defer tx.Rollback()
+	if _, db_err := ds.lockSyncState(ctx, tx, user_id); db_err != nil {
+		return nil, db_err
+	}
+
+	// lock the habit so it cannot be deleted while logging
+	var habit model.Habits
+	owner := SELECT(Habits.HabitID, Habits.Name).
+		FROM(Habits).
+		WHERE(Habits.UserID.EQ(Text(user_id)).AND(Habits.HabitID.EQ(Int(habit_id)))).
+		FOR(KEY_SHARE())
+	err = owner.QueryContext(ctx, tx, &habit)
+	if err == qrm.ErrNoRows {
+		return nil, &HTTPError{Code: http.StatusNotFound, Message: "Habit not found"}
+	}
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error querying habit", "user", user_id, "habit", habit_id, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to log habit", Err: err}
+	}
+
+	habitLog := model.HabitLogs{HabitID: int32(habit_id), Day: day, Count: int32(req.Count)}
+	upsert := func(count IntegerExpression) Statement {
+		return HabitLogs.INSERT(HabitLogs.HabitID, HabitLogs.Day, HabitLogs.Count).
+			MODEL(habitLog).
+			ON_CONFLICT(HabitLogs.HabitID, HabitLogs.Day).
+			DO_UPDATE(SET(HabitLogs.Count.SET(count))).
+			RETURNING(HabitLogs.AllColumns)
+	}
+	var stmt Statement
+	switch req.Action {
+	case LogSet:
+		stmt = upsert(HabitLogs.EXCLUDED.Count)
+	case LogIncrement:
+		stmt = upsert(HabitLogs.Count.ADD(HabitLogs.EXCLUDED.Count))
+	case LogDecrement:
+		// only a logged day can be counted down
+		stmt = HabitLogs.UPDATE(HabitLogs.Count).
+			SET(GREATEST(HabitLogs.Count.SUB(Int32(int32(req.Count))), Int32(0))).
+			WHERE(HabitLogs.HabitID.EQ(Int(habit_id)).AND(HabitLogs.Day.EQ(DateT(day)))).
+			RETURNING(HabitLogs.AllColumns)
+	default:
+		return nil, &HTTPError{Code: http.StatusBadRequest, Message: "Unknown log action"}
+	}
+
+	var dest model.HabitLogs
+	err = stmt.QueryContext(ctx, tx, &dest)
+	if err == qrm.ErrNoRows {
+		// decrementing a day that was never logged changes nothing
+		return &HabitLogModel{HabitID: habit_id, Day: req.Day, Count: 0}, nil
+	}
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error logging habit", "user", user_id, "habit", habit_id, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to log habit", Err: err}
+	}
+	if dest.Count <= 0 {
+		// a day counted down to 0 is not logged at all, the same as a day cleared by a sync
+		if _, err = HabitLogs.DELETE().WHERE(HabitLogs.HabitID.EQ(Int(habit_id)).AND(HabitLogs.Day.EQ(DateT(day)))).ExecContext(ctx, tx); err != nil {
+			Logger(ctx).ErrorContext(ctx, "Error clearing habit log", "user", user_id, "habit", habit_id, "err", err)
+			return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to log habit", Err: err}
+		}
+	}
+
+	now := time.Now()
+	if db_err := recordHabitChanges(ctx, tx, ds, user_id, map[string]HabitData{habit.Name: loggedHabit(req.Day, int(dest.Count), now.UnixMilli())}, now); db_err != nil {
+		return nil, db_err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to log habit", Err: err}
+	}
+	return &HabitLogModel{
+		HabitID: int64(dest.HabitID),
+		Day:     dest.Day.Format(time.DateOnly),
+		Count:   int(dest.Count),
+	}, nil
+}
+
+func (ds *PostgresDataStore) CreateAPIToken(ctx context.Context, user_id string, name string, hash string, scopes []Scope, expires_at *time.Time) (*APITokenModel, *HTTPError) {
+	token := model.APITokens{UserID: user_id, Name: name, TokenHash: hash, Scopes: joinScopes(scopes), ExpiresAt: expires_at}
+	stmt := APITokens.INSERT(APITokens.UserID, APITokens.Name, APITokens.TokenHash, APITokens.Scopes, APITokens.ExpiresAt).
+		MODEL(token).
+		RETURNING(APITokens.AllColumns)
+
+	var dest model.APITokens
+	if err := stmt.QueryContext(ctx, ds.DB, &dest); err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error inserting api token", "user", user_id, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to create token", Err: err}
+	}
+	return apiTokenFromModel(dest), nil
+}
+
+func (ds *PostgresDataStore) GetAPITokens(ctx context.Context, user_id string) ([]APITokenModel, *HTTPError) {
+	var tokens []model.APITokens
+	stmt := SELECT(APITokens.AllColumns).
+		FROM(APITokens).
+		WHERE(APITokens.UserID.EQ(Text(user_id))).
+		ORDER_BY(APITokens.TokenID)
+	err := stmt.QueryContext(ctx, ds.DB, &tokens)
+	if err != nil && err != qrm.ErrNoRows {
+		Logger(ctx).ErrorContext(ctx, "Error querying api tokens", "user", user_id, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to query tokens", Err: err}
+	}
+
+	result := make([]APITokenModel, 0, len(tokens))
+	for _, token := range tokens {
+		result = append(result, *apiTokenFromModel(token))
+	}
+	return result, nil
+}
+
+func (ds *PostgresDataStore) DeleteAPIToken(ctx context.Context, user_id string, token_id int64) *HTTPError {
+	stmt := APITokens.DELETE().
+		WHERE(APITokens.UserID.EQ(Text(user_id)).AND(APITokens.TokenID.EQ(Int(token_id))))
+	res, err := stmt.ExecContext(ctx, ds.DB)
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error deleting api token", "user", user_id, "token", token_id, "err", err)
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to revoke token", Err: err}
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return &HTTPError{Code: http.StatusNotFound, Message: "Token not found"}
+	}
+	return nil
+}
+
+func (ds *PostgresDataStore) UseAPIToken(ctx context.Context, hash string) (*APITokenModel, *HTTPError) {
+	var token model.APITokens
+	stmt := SELECT(APITokens.AllColumns).
+		FROM(APITokens).
+		WHERE(APITokens.TokenHash.EQ(Text(hash)))
+	err := stmt.QueryContext(ctx, ds.DB, &token)
+	if err == qrm.ErrNoRows {
+		return nil, &HTTPError{Code: http.StatusUnauthorized, Message: "Unauthorized", Err: errors.New("unknown api token")}
+	}
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error querying api token", "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to check token", Err: err}
+	}
+	now := time.Now().UTC()
+	if token.ExpiresAt != nil && !token.ExpiresAt.After(now) {
+		return nil, &HTTPError{Code: http.StatusUnauthorized, Message: "Unauthorized", Err: errors.New("api token expired")}
+	}
+
+	// last use is informational, a failed update should not block the request
+	touch := APITokens.UPDATE(APITokens.LastUsedAt).
+		MODEL(model.APITokens{LastUsedAt: &now}).
+		WHERE(APITokens.TokenID.EQ(Int32(token.TokenID)))
+	if _, err := touch.ExecContext(ctx, ds.DB); err != nil {
+		Logger(ctx).WarnContext(ctx, "Failed to record api token use", "token", token.TokenID, "err", err)
+	}
+	token.LastUsedAt = &now
+	return apiTokenFromModel(token), nil
+}
+
+func apiTokenFromModel(token model.APITokens) *APITokenModel {
+	return &APITokenModel{
+		TokenID:    int64(token.TokenID),
+		UserID:     token.UserID,
+		Name:       token.Name,
+		Scopes:     splitScopes(token.Scopes),
+		CreatedAt:  token.CreatedAt,
+		LastUsedAt: token.LastUsedAt,
+		ExpiresAt:  token.ExpiresAt,
+	}
+}
+
+// TakeToken spends a token of the bucket key in a single statement, so instances sharing the
+// database agree. The update is skipped when the bucket is empty, which returns no row
+func (ds *PostgresDataStore) TakeToken(ctx context.Context, key string, limit RateLimit, now time.Time) (bool, time.Time, *HTTPError) {
+	now = now.UTC()
+	interval := limit.interval()
+	var bucket model.RateLimits
+	stmt := RateLimits.INSERT(RateLimits.Key, RateLimits.FullAt).
+		VALUES(key, now.Add(interval)).
+		ON_CONFLICT(RateLimits.Key).
+		DO_UPDATE(SET(
+			RateLimits.FullAt.SET(TimestampExp(GREATEST(RateLimits.FullAt, TimestampT(now))).ADD(INTERVALd(interval))),
+		).WHERE(RateLimits.FullAt.LT_EQ(TimestampT(now.Add(time.Duration(limit.burst()-1) * interval))))).
+		RETURNING(RateLimits.FullAt)
+	err := stmt.QueryContext(ctx, ds.DB, &bucket)
+	if err == nil {
+		return true, bucket.FullAt, nil
+	}
+	if err != qrm.ErrNoRows {
+		Logger(ctx).ErrorContext(ctx, "Error taking rate limit token", "key", key, "err", err)
+		return false, time.Time{}, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to check rate limit", Err: err}
+	}
+	err = SELECT(RateLimits.FullAt).
+		FROM(RateLimits).
+		WHERE(RateLimits.Key.EQ(Text(key))).
+		QueryContext(ctx, ds.DB, &bucket)
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error querying rate limit", "key", key, "err", err)
+		return false, time.Time{}, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to check rate limit", Err: err}
+	}
+	return false, bucket.FullAt, nil
+}
+
+// PurgeRateLimits deletes the buckets that are full, which are the same as missing ones
+func (ds *PostgresDataStore) PurgeRateLimits(ctx context.Context, now time.Time) (int64, *HTTPError) {
+	stmt := RateLimits.DELETE().WHERE(RateLimits.FullAt.LT(TimestampT(now.UTC())))
+	res, err := stmt.ExecContext(ctx, ds.DB)
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error purging rate limits", "err", err)
+		return 0, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to purge rate limits", Err: err}
+	}
+	purged, _ := res.RowsAffected()
+	return purged, nil
+}
+
+// deleteHabits removes the habits matching condition along with their logs
+func (ds *PostgresDataStore) deleteHabits(condition BoolExpression) []sqlStep {
+	// habit_logs has no cascade, so clear them before the habit itself
+	return []sqlStep{
+		{"habit logs", HabitLogs.DELETE().USING(Habits).WHERE(HabitLogs.HabitID.EQ(Habits.HabitID).AND(condition))},
+		{"habits", Habits.DELETE().WHERE(condition)},
+	}
+}
+
+func (ds *PostgresDataStore) habitDeletes(user_id string, name string) []sqlStep {
+	return ds.deleteHabits(Habits.UserID.EQ(Text(user_id)).AND(Habits.Name.EQ(Text(name))))
+}
+
+func (ds *PostgresDataStore) eraseSteps(user_id string, session_version int64, now time.Time) []sqlStep {
+	steps := ds.deleteHabits(Habits.UserID.EQ(Text(user_id)))
+	return append(steps, []sqlStep{
+		{"sync changes", SyncChanges.DELETE().WHERE(SyncChanges.UserID.EQ(Text(user_id)))},
+		{"sync state", UserSyncState.DELETE().WHERE(UserSyncState.UserID.EQ(Text(user_id)))},
+		{"api tokens", APITokens.DELETE().WHERE(APITokens.UserID.EQ(Text(user_id)))},
+		{"auth tokens", AuthTokens.DELETE().WHERE(AuthTokens.UserID.EQ(Text(user_id)))},
+		{"identities", Identities.DELETE().WHERE(Identities.UserID.EQ(Text(user_id)))},
+		// anonymous accounts merged into this one only hold their id by now. They keep a tombstone
+		// too, or a session of theirs that is still valid would bring them back as new accounts
+		{"merged accounts", Users.UPDATE(Users.MergedInto, Users.DeletedAt).
+			MODEL(model.Users{DeletedAt: &now}).
+			WHERE(Users.MergedInto.EQ(Text(user_id)))},
+		// the tombstone keeps the id and when it was erased
+		{"tombstone", Users.UPDATE(Users.CreatedAt, Users.Email, Users.PasswordHash, Users.EmailVerifiedAt, Users.SessionVersion, Users.IsAnonymous, Users.MergedInto, Users.DeletedAt).
+			MODEL(model.Users{DeletedAt: &now, SessionVersion: session_version}).
+			WHERE(Users.UserID.EQ(Text(user_id)))},
+	}...)
+}
+
+func (ds *PostgresDataStore) mergeHabitSteps(anonymous_id string, user_id string) []sqlStep {
+	owned := Habits.AS("owned")
+	anonymousHabits := Habits.AS("anonymous_habits")
+	steps := []sqlStep{
+		// habits the account does not have yet move over with their logs
+		{"move habits", Habits.UPDATE(Habits.UserID).
+			SET(Text(user_id)).
+			WHERE(Habits.UserID.EQ(Text(anonymous_id)).
+				AND(Habits.Name.NOT_IN(SELECT(owned.Name).FROM(owned).WHERE(owned.UserID.EQ(Text(user_id))))))},
+		// the rest share a name with one of the account's habits. Their logs are added to it
+		{"merge logs", HabitLogs.INSERT(HabitLogs.HabitID, HabitLogs.Day, HabitLogs.Count).
+			QUERY(SELECT(owned.HabitID, HabitLogs.Day, HabitLogs.Count).
+				FROM(HabitLogs.
+					INNER_JOIN(anonymousHabits, anonymousHabits.HabitID.EQ(HabitLogs.HabitID)).
+					INNER_JOIN(owned, owned.Name.EQ(anonymousHabits.Name).AND(owned.UserID.EQ(Text(user_id))))).
+				WHERE(anonymousHabits.UserID.EQ(Text(anonymous_id)))).
+			ON_CONFLICT(HabitLogs.HabitID, HabitLogs.Day).
+			DO_UPDATE(SET(HabitLogs.Count.SET(IntExp(GREATEST(HabitLogs.Count, HabitLogs.EXCLUDED.Count)))))},
+	}
+	return append(steps, ds.deleteHabits(Habits.UserID.EQ(Text(anonymous_id)))...)
+}
+
+func (ds *PostgresDataStore) mergeAccountSteps(anonymous_id string, user_id string) []sqlStep {
+	return []sqlStep{
+		{"delete sync changes", SyncChanges.DELETE().WHERE(SyncChanges.UserID.EQ(Text(anonymous_id)))},
+		{"delete sync state", UserSyncState.DELETE().WHERE(UserSyncState.UserID.EQ(Text(anonymous_id)))},
+		{"move identities", Identities.UPDATE(Identities.UserID).SET(Text(user_id)).WHERE(Identities.UserID.EQ(Text(anonymous_id)))},
+		{"revoke tokens", APITokens.DELETE().WHERE(APITokens.UserID.EQ(Text(anonymous_id)))},
+		{"delete auth tokens", AuthTokens.DELETE().WHERE(AuthTokens.UserID.EQ(Text(anonymous_id)))},
+		{"mark merged", Users.UPDATE(Users.MergedInto).SET(Text(user_id)).WHERE(Users.UserID.EQ(Text(anonymous_id)))},
+	}
+}
+
+func (ds *PostgresDataStore) ProjectSyncState(ctx context.Context, user_id string) *HTTPError {
+	return projectSyncState(ctx, ds.DB, ds, user_id)
+}
+
+func (ds *PostgresDataStore) SyncedUsers(ctx context.Context) ([]string, *HTTPError) {
+	var states []model.UserSyncState
+	stmt := SELECT(UserSyncState.UserID).
+		FROM(UserSyncState).
+		ORDER_BY(UserSyncState.UserID)
+	err := stmt.QueryContext(ctx, ds.DB, &states)
+	if err != nil && err != qrm.ErrNoRows {
+		Logger(ctx).ErrorContext(ctx, "Error querying synced users", "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to query synced users", Err: err}
+	}
+
+	users := make([]string, 0, len(states))
+	for _, state := range states {
+		users = append(users, state.UserID)
+	}
+	return users, nil
+}
+
+// ExportUser reads from a single snapshot so the sync state and the habits tables agree
+func (ds *PostgresDataStore) ExportUser(ctx context.Context, user_id string, export HabitExport) *HTTPError {
+	tx, err := ds.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to export habits", Err: err}
+	}
+	defer tx.Rollback()
+	fail := func(step string, err error) *HTTPError {
+		Logger(ctx).ErrorContext(ctx, "Error exporting habits", "step", step, "user", user_id, "err", err)
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to export habits", Err: err}
+	}
+
+	var state *UserSyncStateModel
+	var existing model.UserSyncState
+	stmt := SELECT(UserSyncState.AllColumns).
+		FROM(UserSyncState).
+		WHERE(UserSyncState.UserID.EQ(Text(user_id)))
+	err = stmt.QueryContext(ctx, tx, &existing)
+	if err != nil && err != qrm.ErrNoRows {
+		return fail("sync state", err)
+	}
+	if err == nil {
+		state = &UserSyncStateModel{UserID: user_id, LastUpdated: existing.LastUpdated, Data: existing.Data, Version: existing.Version}
+	}
+
+	var rows []model.Habits
+	err = SELECT(Habits.AllColumns).
+		FROM(Habits).
+		WHERE(Habits.UserID.EQ(Text(user_id))).
+		QueryContext(ctx, tx, &rows)
+	if err != nil && err != qrm.ErrNoRows {
+		return fail("habits", err)
+	}
+	habits := make(map[string]exportedHabit, len(rows))
+	for _, row := range rows {
+		habit := exportedHabit{id: int64(row.HabitID), sort: int(row.Sort)}
+		if row.WeeklyTarget != nil {
+			target := int(*row.WeeklyTarget)
+			habit.weeklyTarget = &target
+		}
+		habits[row.Name] = habit
+	}
+
+	logs := func(habit_id int64) (map[string]int, error) {
+		var rows []model.HabitLogs
+		err := SELECT(HabitLogs.Day, HabitLogs.Count).
+			FROM(HabitLogs).
+			WHERE(HabitLogs.HabitID.EQ(Int(habit_id))).
+			QueryContext(ctx, tx, &rows)
+		if err != nil && err != qrm.ErrNoRows {
+			return nil, err
+		}
+		days := make(map[string]int, len(rows))
+		for _, row := range rows {
+			days[row.Day.Format(time.DateOnly)] = int(row.Count)
+		}
+		return days, nil
+	}
+	if err := exportHabits(state, habits, logs, export); err != nil {
+		return fail("export", err)
+	}
+	return nil
+}
+
+func (ds *PostgresDataStore) saveHabit(ctx context.Context, tx *sql.Tx, user_id string, name string, habit HabitData) (int64, error) {
+	row := model.Habits{UserID: user_id, Name: name, Sort: int32(habit.Sort)}
+	if habit.WeeklyGoal > 0 {
+		target := int32(habit.WeeklyGoal)
+		row.WeeklyTarget = &target
+	}
+	// a field nobody synced yet keeps what the habits API wrote.
+	// Setting the name to itself still returns the id of an existing habit
+	set := []ColumnAssigment{Habits.Name.SET(Habits.EXCLUDED.Name)}
+	if habit.SortUpdatedAt > 0 {
+		set = append(set, Habits.Sort.SET(Habits.EXCLUDED.Sort))
+	}
+	if habit.WeeklyGoalUpdatedAt > 0 {
+		set = append(set, Habits.WeeklyTarget.SET(Habits.EXCLUDED.WeeklyTarget))
+	}
+	upsert := Habits.INSERT(Habits.UserID, Habits.Name, Habits.Sort, Habits.WeeklyTarget).
+		MODEL(row).
+		ON_CONFLICT(Habits.UserID, Habits.Name).
+		DO_UPDATE(SET(set...)).
+		RETURNING(Habits.HabitID)
+	var saved model.Habits
+	if err := upsert.QueryContext(ctx, tx, &saved); err != nil {
+		return 0, err
+	}
+	return int64(saved.HabitID), nil
+}
+
+func (ds *PostgresDataStore) logSteps(habit_id int64, logged map[string]int, cleared []string) []sqlStep {
+	var steps []sqlStep
+	if len(logged) > 0 {
+		rows := make([]model.HabitLogs, 0, len(logged))
+		for day, count := range logged {
+			date, _ := time.Parse(time.DateOnly, day)
+			rows = append(rows, model.HabitLogs{HabitID: int32(habit_id), Day: date, Count: int32(count)})
+		}
+		steps = append(steps, sqlStep{"save logs", HabitLogs.INSERT(HabitLogs.HabitID, HabitLogs.Day, HabitLogs.Count).
+			MODELS(rows).
+			ON_CONFLICT(HabitLogs.HabitID, HabitLogs.Day).
+			DO_UPDATE(SET(HabitLogs.Count.SET(HabitLogs.EXCLUDED.Count)))})
+	}
+	if len(cleared) > 0 {
+		days := make([]Expression, 0, len(cleared))
+		for _, day := range cleared {
+			date, _ := time.Parse(time.DateOnly, day)
+			days = append(days, DateT(date))
+		}
+		steps = append(steps, sqlStep{"clear logs", HabitLogs.DELETE().
+			WHERE(HabitLogs.HabitID.EQ(Int(habit_id)).AND(HabitLogs.Day.IN(days...)))})
+	}
+	return steps
+}
+
+// habitLogs returns the logs of every habit matching condition, keyed by habit id then day
+func (ds *PostgresDataStore) habitLogs(ctx context.Context, db qrm.Queryable, condition BoolExpression) (map[int64]map[string]int, *HTTPError) {
+	var rows []model.HabitLogs
+	stmt := SELECT(HabitLogs.AllColumns).
+		FROM(HabitLogs.INNER_JOIN(Habits, HabitLogs.HabitID.EQ(Habits.HabitID))).
+		WHERE(condition)
+	err := stmt.QueryContext(ctx, db, &rows)
+	if err != nil && err != qrm.ErrNoRows {
+		Logger(ctx).ErrorContext(ctx, "Error querying habit logs", "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to query habit logs", Err: err}
+	}
+
+	logs := make(map[int64]map[string]int)
+	for _, row := range rows {
+		habitID := int64(row.HabitID)
+		if logs[habitID] == nil {
+			logs[habitID] = make(map[string]int)
+		}
+		logs[habitID][row.Day.Format(time.DateOnly)] = int(row.Count)
+	}
+	return logs, nil
+}
+
+func habitFromModel(habit model.Habits, logs map[string]int) *HabitModel {
+	if logs == nil {
+		logs = map[string]int{}
+	}
+	result := HabitModel{
+		HabitID:   int64(habit.HabitID),
+		Name:      habit.Name,
+		Sort:      int(habit.Sort),
+		CreatedAt: habit.CreatedAt,
+		Logs:      logs,
+	}
+	if habit.WeeklyTarget != nil {
+		target := int(*habit.WeeklyTarget)
+		result.WeeklyTarget = &target
+	}
+	return result.withProgress(time.Now())
+}
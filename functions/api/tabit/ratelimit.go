@@ -0,0 +1,302 @@
+package tabit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// rateLimitPurgeInterval is how often buckets that filled up again are forgotten
+const rateLimitPurgeInterval = 10 * time.Minute
+
+// RateLimitStore keeps token buckets. A bucket is stored as the time it is full again,
+// so a missing or past time is a full bucket
+type RateLimitStore interface {
+	// TakeToken spends a token of the bucket key when it has one, returning whether it did
+	// and when the bucket is full again
+	TakeToken(ctx context.Context, key string, limit RateLimit, now time.Time) (bool, time.Time, *HTTPError)
+	// PurgeRateLimits forgets the buckets that are full again, returning how many it forgot
+	PurgeRateLimits(ctx context.Context, now time.Time) (int64, *HTTPError)
+}
+
+// interval is how long a spent token takes to come back
+func (l RateLimit) interval() time.Duration {
+	return time.Duration(l.Per) / time.Duration(l.Requests)
+}
+
+func (l RateLimit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Requests
+}
+
+// take spends a token of a bucket that is full at full_at. A bucket has a token
+// as long as it is missing less than burst of them
+func (l RateLimit) take(full_at time.Time, now time.Time) (bool, time.Time) {
+	if full_at.Before(now) {
+		full_at = now
+	}
+	if full_at.Sub(now) > time.Duration(l.burst()-1)*l.interval() {
+		return false, full_at
+	}
+	return true, full_at.Add(l.interval())
+}
+
+// memoryRateLimits keeps the buckets of a single server
+type memoryRateLimits struct {
+	mu      sync.Mutex
+	buckets map[string]time.Time
+}
+
+func newMemoryRateLimits() *memoryRateLimits {
+	return &memoryRateLimits{buckets: map[string]time.Time{}}
+}
+
+func (m *memoryRateLimits) TakeToken(ctx context.Context, key string, limit RateLimit, now time.Time) (bool, time.Time, *HTTPError) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	allowed, full_at := limit.take(m.buckets[key], now)
+	if allowed {
+		m.buckets[key] = full_at
+	}
+	return allowed, full_at, nil
+}
+
+func (m *memoryRateLimits) PurgeRateLimits(ctx context.Context, now time.Time) (int64, *HTTPError) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var purged int64
+	for key, full_at := range m.buckets {
+		if full_at.Before(now) {
+			delete(m.buckets, key)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// newRateLimitStore returns the store chosen by cfg. The postgres store is ds itself
+func newRateLimitStore(cfg LimitsConfig, ds DataStore) RateLimitStore {
+	if cfg.RateLimitStore != "postgres" {
+		return newMemoryRateLimits()
+	}
+	if traced, ok := ds.(*tracedStore); ok {
+		ds = traced.DataStore
+	}
+	store, ok := ds.(*PostgresDataStore)
+	if !ok {
+		slog.Warn("Rate limit store postgres needs a postgres database, limiting each instance on its own")
+		return newMemoryRateLimits()
+	}
+	return store
+}
+
+type rateLimiter struct {
+	store             RateLimitStore
+	limits            map[string]RateLimit
+	trustForwardedFor bool
+
+	mu     sync.Mutex
+	purged time.Time
+}
+
+func newRateLimiter(cfg LimitsConfig, ds DataStore) *rateLimiter {
+	limits := make(map[string]RateLimit, len(cfg.RateLimits))
+	for route, limit := range cfg.RateLimits {
+		if limit.Requests > 0 {
+			limits[route] = limit
+		}
+	}
+	return &rateLimiter{store: newRateLimitStore(cfg, ds), limits: limits, trustForwardedFor: cfg.TrustForwardedFor, purged: time.Now()}
+}
+
+// rateLimitCheck is the token a request on a limited route still has to spend. Routes limited by
+// user wait for userFromToken to know who is asking, and fall back to the client ip
+type rateLimitCheck struct {
+	limiter *rateLimiter
+	w       http.ResponseWriter
+	route   string
+	limit   RateLimit
+	client  string
+	done    bool
+}
+
+type rateLimitKey struct{}
+
+// limitRequests answers 429 to clients that ran out of tokens for the route, and tells every
+// client of a limited route how many it has left in RateLimit headers
+func (rl *rateLimiter) limitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var route string
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		limit, ok := rl.limits[route]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		check := &rateLimitCheck{limiter: rl, w: w, route: route, limit: limit, client: rl.clientIP(r)}
+		if limit.By == "ip" || r.Header.Get("Authorization") == "" {
+			if db_err := check.take(r.Context(), nil); db_err != nil {
+				sendErrorResponse(w, db_err.Message, db_err.Code)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), rateLimitKey{}, check)
+		limited := &rateLimitedWriter{ResponseWriter: w, ctx: ctx, check: check}
+		next.ServeHTTP(limited, r.WithContext(ctx))
+		// a handler that wrote nothing still has its headers to send
+		limited.charge()
+	})
+}
+
+// rateLimitedWriter charges the client for a response that starts before userFromToken knew the
+// user, such as a bad request, while its headers can still be sent. A refused response is replaced
+// by the 429 and the handler's body is dropped
+type rateLimitedWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	check   *rateLimitCheck
+	refused bool
+}
+
+func (w *rateLimitedWriter) charge() {
+	if w.check.done {
+		return
+	}
+	if db_err := w.check.take(w.ctx, nil); db_err != nil {
+		w.refused = true
+		sendErrorResponse(w.ResponseWriter, db_err.Message, db_err.Code)
+	}
+}
+
+func (w *rateLimitedWriter) WriteHeader(status int) {
+	w.charge()
+	if !w.refused {
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *rateLimitedWriter) Write(b []byte) (int, error) {
+	w.charge()
+	if w.refused {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer to flush streamed exports
+func (w *rateLimitedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// limitUser spends the token of the request ctx belongs to, from the bucket of user_id or of the
+// client when it is nil. It does nothing when the route is not limited by user
+func limitUser(ctx context.Context, user_id *string) *HTTPError {
+	check, ok := ctx.Value(rateLimitKey{}).(*rateLimitCheck)
+	if !ok || check.done {
+		return nil
+	}
+	return check.take(ctx, user_id)
+}
+
+func (c *rateLimitCheck) take(ctx context.Context, user_id *string) *HTTPError {
+	c.done = true
+	by, subject := "ip", c.client
+	if user_id != nil {
+		by, subject = "user", *user_id
+	}
+	now := time.Now()
+	allowed, full_at, db_err := c.limiter.store.TakeToken(ctx, c.route+" "+by+":"+subject, c.limit, now)
+	if db_err != nil {
+		// an unreachable store should not take the API down with it
+		observeRateLimitError("take")
+		Logger(ctx).WarnContext(ctx, "Rate limit store failed, letting the request through", "route", c.route, "by", by, "err", db_err)
+		return nil
+	}
+	c.limiter.purge(ctx, now)
+
+	interval := c.limit.interval()
+	burst := c.limit.burst()
+	missing := full_at.Sub(now)
+	remaining := burst - int(math.Ceil(float64(missing)/float64(interval)))
+	header := c.w.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(burst))
+	header.Set("RateLimit-Remaining", strconv.Itoa(max(remaining, 0)))
+	header.Set("RateLimit-Reset", ceilSeconds(missing))
+	header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%s", burst, ceilSeconds(time.Duration(burst)*interval)))
+	if allowed {
+		return nil
+	}
+
+	retry := missing - time.Duration(burst-1)*interval
+	header.Set("Retry-After", ceilSeconds(max(retry, time.Second)))
+	observeRateLimited(c.route, by)
+	Logger(ctx).InfoContext(ctx, "Rate limited", "route", c.route, "by", by, "retry_after", retry.String())
+	return &HTTPError{Code: http.StatusTooManyRequests, Message: "Too many requests, try again later"}
+}
+
+// purge forgets full buckets every rateLimitPurgeInterval, on one request of the instance
+func (rl *rateLimiter) purge(ctx context.Context, now time.Time) {
+	rl.mu.Lock()
+	if now.Sub(rl.purged) < rateLimitPurgeInterval {
+		rl.mu.Unlock()
+		return
+	}
+	rl.purged = now
+	rl.mu.Unlock()
+	purged, db_err := rl.store.PurgeRateLimits(ctx, now)
+	if db_err != nil {
+		observeRateLimitError("purge")
+		Logger(ctx).WarnContext(ctx, "Failed to purge rate limits", "err", db_err)
+		return
+	}
+	Logger(ctx).InfoContext(ctx, "Purged rate limits", "buckets", purged)
+}
+
+// clientIP is the address requests without a user are counted by. IPv6 clients usually
+// hold a whole /64, so they are counted by it
+func (rl *rateLimiter) clientIP(r *http.Request) string {
+	client := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	if rl.trustForwardedFor {
+		// the last hop is the one added by the proxy, earlier ones are up to the client
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			if hop := strings.TrimSpace(hops[len(hops)-1]); hop != "" {
+				client = hop
+			}
+		}
+	}
+	addr, err := netip.ParseAddr(client)
+	if err != nil {
+		return client
+	}
+	addr = addr.Unmap()
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		return prefix.String()
+	}
+	return addr.String()
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
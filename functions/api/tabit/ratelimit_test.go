@@ -0,0 +1,69 @@
+package tabit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimitTake(t *testing.T) {
+	now := time.Date(2026, 1, 14, 12, 0, 0, 0, time.UTC)
+	// a token every 10s
+	perMinute := RateLimit{Requests: 6, Per: Duration(time.Minute)}
+
+	tests := []struct {
+		name       string
+		limit      RateLimit
+		full_at    time.Time
+		wantOK     bool
+		wantFullAt time.Time
+	}{
+		{name: "a new bucket is full", limit: perMinute, full_at: time.Time{}, wantOK: true, wantFullAt: now.Add(10 * time.Second)},
+		{name: "a bucket refills over time", limit: perMinute, full_at: now.Add(-time.Hour), wantOK: true, wantFullAt: now.Add(10 * time.Second)},
+		{name: "a drained bucket has tokens left", limit: perMinute, full_at: now.Add(30 * time.Second), wantOK: true, wantFullAt: now.Add(40 * time.Second)},
+		{name: "the last token", limit: perMinute, full_at: now.Add(50 * time.Second), wantOK: true, wantFullAt: now.Add(time.Minute)},
+		{name: "less than a token left", limit: perMinute, full_at: now.Add(55 * time.Second), wantOK: false, wantFullAt: now.Add(55 * time.Second)},
+		{name: "an empty bucket", limit: perMinute, full_at: now.Add(time.Minute), wantOK: false, wantFullAt: now.Add(time.Minute)},
+		{name: "a smaller burst", limit: RateLimit{Requests: 6, Per: Duration(time.Minute), Burst: 2}, full_at: now.Add(11 * time.Second), wantOK: false, wantFullAt: now.Add(11 * time.Second)},
+		{name: "a larger burst", limit: RateLimit{Requests: 6, Per: Duration(time.Minute), Burst: 10}, full_at: now.Add(90 * time.Second), wantOK: true, wantFullAt: now.Add(100 * time.Second)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, full_at := tt.limit.take(tt.full_at, now)
+			if ok != tt.wantOK || !full_at.Equal(tt.wantFullAt) {
+				t.Errorf("take() = %v, %v, want %v, %v", ok, full_at.Sub(now), tt.wantOK, tt.wantFullAt.Sub(now))
+			}
+		})
+	}
+}
+
+func TestMemoryRateLimits(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 1, 14, 12, 0, 0, 0, time.UTC)
+	limit := RateLimit{Requests: 6, Per: Duration(time.Minute), Burst: 3}
+	buckets := newMemoryRateLimits()
+
+	for i, step := range []struct {
+		key    string
+		after  time.Duration
+		wantOK bool
+	}{
+		{"alice", 0, true},
+		{"alice", 0, true},
+		{"alice", 0, true},
+		{"alice", 0, false}, // burst spent
+		{"bob", 0, true},    // buckets are per key
+		{"alice", 9 * time.Second, false},
+		{"alice", 10 * time.Second, true},
+		{"alice", 10 * time.Second, false},
+	} {
+		ok, _, db_err := buckets.TakeToken(ctx, step.key, limit, now.Add(step.after))
+		if db_err != nil {
+			t.Fatal(db_err)
+		}
+		if ok != step.wantOK {
+			t.Errorf("request %d of %s after %v: allowed = %v, want %v", i, step.key, step.after, ok, step.wantOK)
+		}
+	}
+}
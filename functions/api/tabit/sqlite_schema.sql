@@ -0,0 +1,94 @@
+PRAGMA foreign_keys = 1;
+
+CREATE TABLE IF NOT EXISTS users (
+    user_id TEXT PRIMARY KEY CHECK (length(user_id) > 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    email TEXT, -- Lowercased, only set for email and password accounts. Unique through idx_users_email
+    password_hash TEXT, -- bcrypt
+    email_verified_at TIMESTAMP,
+    session_version BIGINT NOT NULL DEFAULT 0, -- Incremented to sign out every native session
+    is_anonymous BOOLEAN NOT NULL DEFAULT FALSE, -- Created without credentials, can be merged into another account
+    merged_into TEXT REFERENCES users(user_id), -- Set once an anonymous account was merged, its sessions stop working
+    deleted_at TIMESTAMP -- Set when the account was erased. Only the user_id is kept so its data is not synced back
+);
+
+CREATE TABLE IF NOT EXISTS habits (
+    habit_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id TEXT NOT NULL,
+    name TEXT NOT NULL CHECK (length(name) > 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    sort INTEGER NOT NULL DEFAULT 0,
+    weekly_target INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users(user_id),
+    UNIQUE (user_id, name)
+);
+CREATE INDEX IF NOT EXISTS idx_habits_user_id ON habits(user_id);
+
+CREATE TABLE IF NOT EXISTS habit_logs (
+    habit_id INTEGER NOT NULL,
+    day TEXT NOT NULL CHECK (day GLOB '[0-9][0-9][0-9][0-9]-[0-1][0-9]-[0-3][0-9]'),
+    count INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (habit_id) REFERENCES habits(habit_id),
+    UNIQUE (habit_id, day)
+);
+CREATE INDEX IF NOT EXISTS idx_habit_logs_habit_id ON habit_logs(habit_id);
+
+CREATE TABLE IF NOT EXISTS user_sync_state (
+    user_id TEXT PRIMARY KEY,
+    data TEXT NOT NULL CHECK (length(data) > 1), -- Store the full HabitData as JSON
+    last_updated BIGINT NOT NULL, -- Store Unix milliseconds UTC
+    version BIGINT NOT NULL DEFAULT 0, -- Incremented on every change to data
+    FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
+
+CREATE INDEX IF NOT EXISTS  idx_user_sync_state_user_id ON user_sync_state(user_id);
+
+CREATE TABLE IF NOT EXISTS sync_changes (
+    change_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id TEXT NOT NULL,
+    habit TEXT NOT NULL,
+    data TEXT NOT NULL, -- HabitData fragment as JSON
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sync_changes_user_id ON sync_changes(user_id, change_id);
+
+CREATE TABLE IF NOT EXISTS api_tokens (
+    token_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id TEXT NOT NULL,
+    name TEXT NOT NULL CHECK (length(name) > 0),
+    token_hash TEXT NOT NULL UNIQUE, -- sha256 of the token, the token itself is never stored
+    scopes TEXT NOT NULL, -- Comma separated
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP,
+    expires_at TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id);
+
+CREATE TABLE IF NOT EXISTS auth_tokens (
+    token_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id TEXT NOT NULL,
+    purpose TEXT NOT NULL, -- password_reset or email_verification
+    token_hash TEXT NOT NULL UNIQUE, -- sha256 of the token, the token itself is only sent by email
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_auth_tokens_user_id ON auth_tokens(user_id, purpose);
+
+CREATE TABLE IF NOT EXISTS identities (
+    provider TEXT NOT NULL, -- apple, or the name of an OIDC provider
+    subject TEXT NOT NULL, -- sub claim, stable for the provider
+    user_id TEXT NOT NULL,
+    email TEXT, -- As reported by the provider when the identity was linked
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (provider, subject),
+    FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_identities_user_id ON identities(user_id);
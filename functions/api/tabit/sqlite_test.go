@@ -0,0 +1,199 @@
+package tabit
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// newTestStore opens an empty sqlite store with user_id already signed in
+func newTestStore(t *testing.T, user_id string) *SQLiteDataStore {
+	t.Helper()
+	ds, err := NewDataStore(SQLiteDB, filepath.Join(t.TempDir(), "tabit.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ds.Close() })
+	if db_err := ds.CreateUser(context.Background(), user_id); db_err != nil {
+		t.Fatal(db_err)
+	}
+	return ds.(*SQLiteDataStore)
+}
+
+func TestSyncChangesCursor(t *testing.T) {
+	ctx := context.Background()
+	ds := newTestStore(t, "user")
+
+	// changes 1 to 3 of the log
+	for _, change := range []struct {
+		last_updated int64
+		changes      map[string]HabitData
+	}{
+		{100, map[string]HabitData{"walk": {Logs: map[string]int{"2026-01-01": 1}, LogsUpdatedAt: map[string]int64{"2026-01-01": 100}}}},
+		{200, map[string]HabitData{"read": {Sort: 1, SortUpdatedAt: 200}}},
+		{300, map[string]HabitData{"walk": {Logs: map[string]int{"2026-01-02": 1}, LogsUpdatedAt: map[string]int64{"2026-01-02": 300}}}},
+	} {
+		if _, db_err := ds.SyncChanges(ctx, "user", nil, 0, change.last_updated, change.changes); db_err != nil {
+			t.Fatal(db_err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		cursor      int64
+		wantFull    bool
+		wantChanged []string
+		wantDays    []string // days of walk sent back
+	}{
+		{name: "no cursor gets the whole state", cursor: 0, wantFull: true, wantChanged: []string{"read", "walk"}, wantDays: []string{"2026-01-01", "2026-01-02"}},
+		{name: "the first change is skipped", cursor: 1, wantChanged: []string{"read", "walk"}, wantDays: []string{"2026-01-02"}},
+		{name: "only the last change", cursor: 2, wantChanged: []string{"walk"}, wantDays: []string{"2026-01-02"}},
+		{name: "an up to date client gets nothing", cursor: 3, wantChanged: []string{}},
+		{name: "a cursor from the future gets the whole state", cursor: 99, wantFull: true, wantChanged: []string{"read", "walk"}, wantDays: []string{"2026-01-01", "2026-01-02"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// sending nothing records nothing, so the cases don't affect each other
+			result, db_err := ds.SyncChanges(ctx, "user", nil, tt.cursor, 400, map[string]HabitData{})
+			if db_err != nil {
+				t.Fatal(db_err)
+			}
+			if result.Cursor != 3 || result.Version != 3 {
+				t.Errorf("cursor = %d, version = %d, want 3 and 3", result.Cursor, result.Version)
+			}
+			if result.Full != tt.wantFull {
+				t.Errorf("full = %v, want %v", result.Full, tt.wantFull)
+			}
+			if changed := slices.Sorted(maps.Keys(result.Changes)); !slices.Equal(changed, tt.wantChanged) {
+				t.Errorf("changed habits = %v, want %v", changed, tt.wantChanged)
+			}
+			if days := slices.Sorted(maps.Keys(result.Changes["walk"].Logs)); !slices.Equal(days, tt.wantDays) {
+				t.Errorf("walk days = %v, want %v", days, tt.wantDays)
+			}
+		})
+	}
+}
+
+func TestSyncChangesCompactsOldChanges(t *testing.T) {
+	ctx := context.Background()
+	ds := newTestStore(t, "user")
+	logged := func(day string, at int64) map[string]HabitData {
+		return map[string]HabitData{"walk": {Logs: map[string]int{day: 1}, LogsUpdatedAt: map[string]int64{day: at}}}
+	}
+
+	for i, day := range []string{"2026-01-01", "2026-01-02"} {
+		if _, db_err := ds.SyncChanges(ctx, "user", nil, 0, int64(i+1)*100, logged(day, int64(i+1)*100)); db_err != nil {
+			t.Fatal(db_err)
+		}
+	}
+	if _, err := ds.DB.Exec("UPDATE sync_changes SET created_at = '2000-01-01 00:00:00'"); err != nil {
+		t.Fatal(err)
+	}
+	result, db_err := ds.SyncChanges(ctx, "user", nil, 0, 300, logged("2026-01-03", 300))
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	if result.Cursor != 3 {
+		t.Errorf("cursor = %d, want 3", result.Cursor)
+	}
+
+	var ids []int64
+	rows, err := ds.DB.Query("SELECT change_id FROM sync_changes ORDER BY change_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if want := []int64{2, 3}; !slices.Equal(ids, want) {
+		t.Errorf("change ids = %v, want %v", ids, want)
+	}
+
+	// a client that only had the first change still receives everything after it
+	result, db_err = ds.SyncChanges(ctx, "user", nil, 1, 400, map[string]HabitData{})
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	days := slices.Sorted(maps.Keys(result.Changes["walk"].Logs))
+	if want := []string{"2026-01-01", "2026-01-02", "2026-01-03"}; result.Full || !slices.Equal(days, want) {
+		t.Errorf("full = %v, walk days = %v, want a delta with %v", result.Full, days, want)
+	}
+}
+
+func TestSyncBaseVersion(t *testing.T) {
+	ctx := context.Background()
+	version := func(v int64) *int64 { return &v }
+	first := map[string]HabitData{"walk": {Logs: map[string]int{"2026-01-01": 1}, LogsUpdatedAt: map[string]int64{"2026-01-01": 100}}}
+	second := map[string]HabitData{"walk": {Logs: map[string]int{"2026-01-02": 1}, LogsUpdatedAt: map[string]int64{"2026-01-02": 200}}}
+
+	tests := []struct {
+		name         string
+		base_version *int64
+		wantConflict bool
+	}{
+		{name: "no base version always merges", base_version: nil},
+		{name: "the current version merges", base_version: version(1)},
+		{name: "an older version conflicts", base_version: version(0), wantConflict: true},
+		{name: "an unknown version conflicts", base_version: version(7), wantConflict: true},
+	}
+
+	for _, tt := range tests {
+		t.Run("full/"+tt.name, func(t *testing.T) {
+			ds := newTestStore(t, "user")
+			if _, db_err := ds.SyncUserData(ctx, "user", nil, 100, first); db_err != nil {
+				t.Fatal(db_err)
+			}
+			state, db_err := ds.SyncUserData(ctx, "user", tt.base_version, 200, second)
+			if tt.wantConflict {
+				if db_err == nil || db_err.Code != http.StatusConflict {
+					t.Fatalf("err = %v, want a 409", db_err)
+				}
+				// the stored state comes back for the client to rebase on
+				if state == nil || state.Version != 1 || state.LastUpdated != 100 {
+					t.Errorf("state = %+v, want version 1 from 100", state)
+				}
+				return
+			}
+			if db_err != nil {
+				t.Fatal(db_err)
+			}
+			if state.Version != 2 {
+				t.Errorf("version = %d, want 2", state.Version)
+			}
+		})
+
+		t.Run("changes/"+tt.name, func(t *testing.T) {
+			ds := newTestStore(t, "user")
+			if _, db_err := ds.SyncChanges(ctx, "user", nil, 0, 100, first); db_err != nil {
+				t.Fatal(db_err)
+			}
+			result, db_err := ds.SyncChanges(ctx, "user", tt.base_version, 0, 200, second)
+			if tt.wantConflict {
+				if db_err == nil || db_err.Code != http.StatusConflict {
+					t.Fatalf("err = %v, want a 409", db_err)
+				}
+				// nothing was written and the missed changes come back
+				days := slices.Sorted(maps.Keys(result.Changes["walk"].Logs))
+				if result.Version != 1 || result.Cursor != 1 || !slices.Equal(days, []string{"2026-01-01"}) {
+					t.Errorf("result = %+v, want version 1 at cursor 1 with the first day", result)
+				}
+				return
+			}
+			if db_err != nil {
+				t.Fatal(db_err)
+			}
+			if result.Version != 2 || result.Cursor != 2 {
+				t.Errorf("version = %d, cursor = %d, want 2 and 2", result.Version, result.Cursor)
+			}
+		})
+	}
+}
@@ -0,0 +1,410 @@
+package tabit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-jet/jet/v2/qrm"
+)
+
+// sqlStatement is a statement built by either jet dialect
+type sqlStatement interface {
+	ExecContext(ctx context.Context, db qrm.Executable) (sql.Result, error)
+}
+
+// sqlStep is one statement of a longer write, named for the error log
+type sqlStep struct {
+	name string
+	stmt sqlStatement
+}
+
+// sqlDialect builds the queries that sqlite and postgres spell differently.
+// The flows running them are shared below, so both stores sync, merge and erase accounts the same way
+type sqlDialect interface {
+	// lockAccount reads a user and keeps other writers away from it until tx ends
+	lockAccount(ctx context.Context, tx *sql.Tx, user_id string) (*UserModel, *HTTPError)
+	// lockSyncState does the same for the user's sync state, creating it when the user never synced
+	lockSyncState(ctx context.Context, tx *sql.Tx, user_id string) (*UserSyncStateModel, *HTTPError)
+	// storedSyncState reads the user's sync state, or returns qrm.ErrNoRows when the user never synced
+	storedSyncState(ctx context.Context, tx *sql.Tx, user_id string) (*UserSyncStateModel, error)
+	saveSyncState(state *UserSyncStateModel) sqlStatement
+
+	// latestChange returns the id of the user's last recorded change, or 0 when there is none
+	latestChange(ctx context.Context, tx *sql.Tx, user_id string) (int64, error)
+	// insertChanges records the encoded change of each habit and returns the ids they got
+	insertChanges(ctx context.Context, tx *sql.Tx, user_id string, changes map[string]string, now time.Time) ([]int64, error)
+	// changesBetween returns the changes after one id up to and including through, ordered by id
+	changesBetween(ctx context.Context, tx *sql.Tx, user_id string, after int64, through int64) ([]recordedChange, error)
+	// changesBefore returns the changes recorded before cutoff, ordered by id
+	changesBefore(ctx context.Context, tx *sql.Tx, user_id string, cutoff time.Time) ([]recordedChange, error)
+	// compactSteps rewrite the folded changes and delete the ones folded into them
+	compactSteps(folded []recordedChange, deleted []int64) []sqlStep
+
+	// saveHabit upserts a synced habit and returns its id
+	saveHabit(ctx context.Context, tx *sql.Tx, user_id string, name string, habit HabitData) (int64, error)
+	// logSteps write the logged days of a habit and remove the cleared ones
+	logSteps(habit_id int64, logged map[string]int, cleared []string) []sqlStep
+	// habitDeletes remove the user's habit called name along with its logs
+	habitDeletes(user_id string, name string) []sqlStep
+
+	// eraseSteps delete everything the account holds and leave a tombstone with session_version
+	eraseSteps(user_id string, session_version int64, now time.Time) []sqlStep
+	// mergeHabitSteps move the habits of an anonymous account to user_id. Habits with a name the
+	// account already has add their logs to it instead
+	mergeHabitSteps(anonymous_id string, user_id string) []sqlStep
+	// mergeAccountSteps drop the anonymous account's sync data and tokens, move its identities
+	// and mark it merged into user_id
+	mergeAccountSteps(anonymous_id string, user_id string) []sqlStep
+}
+
+// runSteps executes steps in order and returns the name of the one that failed
+func runSteps(ctx context.Context, tx *sql.Tx, steps []sqlStep) (string, error) {
+	for _, step := range steps {
+		if _, err := step.stmt.ExecContext(ctx, tx); err != nil {
+			return step.name, err
+		}
+	}
+	return "", nil
+}
+
+func deleteUser(ctx context.Context, db *sql.DB, d sqlDialect, user_id string) *HTTPError {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to delete account", Err: err}
+	}
+	defer tx.Rollback()
+
+	user, db_err := d.lockAccount(ctx, tx, user_id)
+	if db_err != nil {
+		return db_err
+	}
+	// bumping the session version signs out native sessions
+	if step, err := runSteps(ctx, tx, d.eraseSteps(user_id, user.SessionVersion+1, time.Now().UTC())); err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error deleting account", "step", step, "user", user_id, "err", err)
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to delete account", Err: err}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to delete account", Err: err}
+	}
+	Logger(ctx).InfoContext(ctx, "deleted account", "user", user_id)
+	return nil
+}
+
+func mergeAnonymousUser(ctx context.Context, db *sql.DB, d sqlDialect, anonymous_id string, user_id string) *HTTPError {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to merge accounts", Err: err}
+	}
+	defer tx.Rollback()
+
+	anonymous, db_err := d.lockAccount(ctx, tx, anonymous_id)
+	if db_err != nil {
+		return db_err
+	}
+	user, db_err := d.lockAccount(ctx, tx, user_id)
+	if db_err != nil {
+		return db_err
+	}
+	merged, db_err := checkMerge(anonymous, user)
+	if db_err != nil || merged {
+		return db_err
+	}
+	fail := func(step string, err error) *HTTPError {
+		Logger(ctx).ErrorContext(ctx, "Error merging accounts", "step", step, "anonymous", anonymous_id, "user", user_id, "err", err)
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to merge accounts", Err: err}
+	}
+
+	if step, err := runSteps(ctx, tx, d.mergeHabitSteps(anonymous_id, user_id)); err != nil {
+		return fail(step, err)
+	}
+	// synced data is merged the same way as a sync from another device,
+	// so its newer changes also win over what the habits tables got above
+	state, err := d.storedSyncState(ctx, tx, anonymous_id)
+	if err != nil && err != qrm.ErrNoRows {
+		return fail("query sync state", err)
+	}
+	if err == nil {
+		var data map[string]HabitData
+		if err := json.Unmarshal([]byte(state.Data), &data); err != nil {
+			return fail("read sync state", err)
+		}
+		if len(data) > 0 {
+			if _, _, db_err := syncState(ctx, tx, d, user_id, nil, state.LastUpdated, data, false); db_err != nil {
+				return db_err
+			}
+		}
+	}
+	if step, err := runSteps(ctx, tx, d.mergeAccountSteps(anonymous_id, user_id)); err != nil {
+		return fail(step, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to merge accounts", Err: err}
+	}
+	Logger(ctx).InfoContext(ctx, "merged anonymous account", "anonymous", anonymous_id, "user", user_id)
+	return nil
+}
+
+func syncUserData(ctx context.Context, db *sql.DB, d sqlDialect, user_id string, base_version *int64, last_updated int64, data map[string]HabitData) (*UserSyncStateModel, *HTTPError) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		db_err := &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to save sync state", Err: err}
+		observeSync("full", false, db_err)
+		return nil, db_err
+	}
+	defer tx.Rollback()
+
+	merged, previous, db_err := syncState(ctx, tx, d, user_id, base_version, last_updated, data, false)
+	if db_err != nil {
+		observeSync("full", false, db_err)
+		return merged, db_err
+	}
+
+	if err = tx.Commit(); err != nil {
+		db_err = &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to save sync state", Err: err}
+		observeSync("full", false, db_err)
+		return nil, db_err
+	}
+	// the cursor only moves past previous when a habit changed
+	observeSync("full", merged.Cursor != previous, nil)
+	return merged, nil
+}
+
+func syncChanges(ctx context.Context, db *sql.DB, d sqlDialect, user_id string, base_version *int64, cursor int64, last_updated int64, changes map[string]HabitData) (*SyncChangesModel, *HTTPError) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		db_err := &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to save sync state", Err: err}
+		observeSync("changes", false, db_err)
+		return nil, db_err
+	}
+	defer tx.Rollback()
+
+	merged, previous, sync_err := syncState(ctx, tx, d, user_id, base_version, last_updated, changes, true)
+	if sync_err != nil && sync_err.Code != http.StatusConflict {
+		observeSync("changes", false, sync_err)
+		return nil, sync_err
+	}
+
+	result, db_err := changesAfter(ctx, tx, d, merged, cursor, previous)
+	if db_err != nil {
+		observeSync("changes", false, db_err)
+		return nil, db_err
+	}
+	if sync_err != nil {
+		// nothing was written, the client rebases on the changes it missed
+		observeSync("changes", false, sync_err)
+		return result, sync_err
+	}
+
+	if err = tx.Commit(); err != nil {
+		db_err = &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to save sync state", Err: err}
+		observeSync("changes", false, db_err)
+		return nil, db_err
+	}
+	observeSync("changes", merged.Cursor != previous, nil)
+	return result, nil
+}
+
+// changesAfter collects what was recorded after cursor, up to and including previous
+func changesAfter(ctx context.Context, tx *sql.Tx, d sqlDialect, state *UserSyncStateModel, cursor int64, previous int64) (*SyncChangesModel, *HTTPError) {
+	result := &SyncChangesModel{Cursor: state.Cursor, Version: state.Version, LastUpdated: state.LastUpdated}
+	// a cursor from the future means the log was reset, so start over
+	if cursor == 0 || cursor > previous {
+		result.Full = true
+		if err := json.Unmarshal([]byte(state.Data), &result.Changes); err != nil {
+			return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to read sync state", Err: err}
+		}
+		return result, nil
+	}
+
+	missed, err := d.changesBetween(ctx, tx, state.UserID, cursor, previous)
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error querying sync changes", "user", state.UserID, "err", err)
+		return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to query sync changes", Err: err}
+	}
+
+	result.Changes = map[string]HabitData{}
+	for _, change := range missed {
+		result.Changes, err = collectChanges(result.Changes, change.Habit, change.Data)
+		if err != nil {
+			return nil, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to read sync changes", Err: err}
+		}
+	}
+	return result, nil
+}
+
+// recordHabitChanges merges changes made through the habits API into the sync state, so they
+// bump the version and reach other devices like a sync would. The caller locks the sync state
+// with lockSyncState before writing the habits, in the same order as a sync
+func recordHabitChanges(ctx context.Context, tx *sql.Tx, d sqlDialect, user_id string, changes map[string]HabitData, now time.Time) *HTTPError {
+	_, _, db_err := syncState(ctx, tx, d, user_id, nil, now.UnixMilli(), changes, true)
+	return db_err
+}
+
+// syncState merges data into the user's stored state and appends it to the change log.
+// It returns the merged state and the latest change before this one.
+// When base_version is stale it returns the stored state with a 409 instead
+func syncState(ctx context.Context, tx *sql.Tx, d sqlDialect, user_id string, base_version *int64, last_updated int64, data map[string]HabitData, partial bool) (*UserSyncStateModel, int64, *HTTPError) {
+	current, db_err := d.lockSyncState(ctx, tx, user_id)
+	if db_err != nil {
+		return nil, 0, db_err
+	}
+	if current.LastUpdated > last_updated {
+		syncAnomalies.WithLabelValues("stale_client").Inc()
+		Logger(ctx).InfoContext(ctx, "merging stale client data", "user", user_id, "last_updated", last_updated, "existing", current.LastUpdated)
+	}
+
+	previous, err := d.latestChange(ctx, tx, user_id)
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error querying sync changes", "user", user_id, "err", err)
+		return nil, 0, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to query sync changes", Err: err}
+	}
+	current.Cursor = previous
+
+	if base_version != nil && *base_version != current.Version {
+		Logger(ctx).InfoContext(ctx, "rejecting stale sync", "user", user_id, "base_version", *base_version, "version", current.Version)
+		return current, previous, &HTTPError{Code: http.StatusConflict, Message: "Sync state has changed, rebase on the returned state"}
+	}
+
+	var merged *UserSyncStateModel
+	var changes map[string]HabitData
+	if partial {
+		merged, changes, err = mergeSyncChanges(user_id, current, last_updated, data)
+	} else {
+		merged, changes, err = mergeSyncState(user_id, current, last_updated, data)
+	}
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error merging sync state", "user", user_id, "err", err)
+		return nil, 0, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to merge sync state", Err: err}
+	}
+	Logger(ctx).InfoContext(ctx, "saving merged state", "user", user_id, "last_updated", merged.LastUpdated, "version", merged.Version)
+
+	if _, err = d.saveSyncState(merged).ExecContext(ctx, tx); err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error updating sync state", "user", user_id, "err", err)
+		return nil, 0, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to save sync state", Err: err}
+	}
+
+	habits, err := projectedHabits(merged.Data, changes)
+	if err != nil {
+		return nil, 0, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to read sync state", Err: err}
+	}
+	if db_err := projectHabits(ctx, tx, d, user_id, habits); db_err != nil {
+		return nil, 0, db_err
+	}
+
+	merged.Cursor = previous
+	if len(changes) == 0 {
+		return merged, previous, nil
+	}
+
+	encoded := make(map[string]string, len(changes))
+	for habit, change := range changes {
+		changeData, err := json.Marshal(change)
+		if err != nil {
+			return nil, 0, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to save sync changes", Err: err}
+		}
+		encoded[habit] = string(changeData)
+	}
+	// created_at is stamped here like auth tokens, so compactChanges compares it in the same time zone
+	now := time.Now().UTC()
+	ids, err := d.insertChanges(ctx, tx, user_id, encoded, now)
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error inserting sync changes", "user", user_id, "err", err)
+		return nil, 0, &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to save sync changes", Err: err}
+	}
+	for _, id := range ids {
+		merged.Cursor = max(merged.Cursor, id)
+	}
+	if db_err := compactChanges(ctx, tx, d, user_id, now); db_err != nil {
+		return nil, 0, db_err
+	}
+	return merged, previous, nil
+}
+
+// compactChanges folds the changes each habit recorded before the retention window, so the
+// change log of a user stays around one row per habit plus the recent changes
+func compactChanges(ctx context.Context, tx *sql.Tx, d sqlDialect, user_id string, now time.Time) *HTTPError {
+	old, err := d.changesBefore(ctx, tx, user_id, now.Add(-syncChangesRetention).UTC())
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error querying sync changes", "user", user_id, "err", err)
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to query sync changes", Err: err}
+	}
+	folded, deleted, err := foldChanges(old)
+	if err != nil {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to read sync changes", Err: err}
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	if _, err := runSteps(ctx, tx, d.compactSteps(folded, deleted)); err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error compacting sync changes", "user", user_id, "err", err)
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to save sync changes", Err: err}
+	}
+	Logger(ctx).InfoContext(ctx, "Compacted sync changes", "user", user_id, "folded", len(folded), "deleted", len(deleted))
+	return nil
+}
+
+func projectSyncState(ctx context.Context, db *sql.DB, d sqlDialect, user_id string) *HTTPError {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to project sync state", Err: err}
+	}
+	defer tx.Rollback()
+
+	state, err := d.storedSyncState(ctx, tx, user_id)
+	if err == qrm.ErrNoRows {
+		return &HTTPError{Code: http.StatusNotFound, Message: "Sync state not found"}
+	}
+	if err != nil {
+		Logger(ctx).ErrorContext(ctx, "Error querying sync state", "user", user_id, "err", err)
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to project sync state", Err: err}
+	}
+
+	habits, err := projectedHabits(state.Data, nil)
+	if err != nil {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to read sync state", Err: err}
+	}
+	if db_err := projectHabits(ctx, tx, d, user_id, habits); db_err != nil {
+		return db_err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to project sync state", Err: err}
+	}
+	return nil
+}
+
+// projectHabits writes merged sync data to the habits and habit_logs tables.
+// Deleted habits are removed. Days missing from the sync data are left alone
+// so logs written through the habits API are kept
+func projectHabits(ctx context.Context, tx *sql.Tx, d sqlDialect, user_id string, habits map[string]HabitData) *HTTPError {
+	for name, habit := range habits {
+		if name == "" {
+			continue
+		}
+		if habit.isDeleted() {
+			if _, err := runSteps(ctx, tx, d.habitDeletes(user_id, name)); err != nil {
+				Logger(ctx).ErrorContext(ctx, "Error deleting synced habit", "user", user_id, "habit", name, "err", err)
+				return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to save habits", Err: err}
+			}
+			continue
+		}
+
+		habit_id, err := d.saveHabit(ctx, tx, user_id, name, habit)
+		if err != nil {
+			Logger(ctx).ErrorContext(ctx, "Error saving synced habit", "user", user_id, "habit", name, "err", err)
+			return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to save habits", Err: err}
+		}
+		logged, cleared := projectedLogs(habit)
+		if step, err := runSteps(ctx, tx, d.logSteps(habit_id, logged, cleared)); err != nil {
+			Logger(ctx).ErrorContext(ctx, "Error saving synced logs", "step", step, "user", user_id, "habit", name, "err", err)
+			return &HTTPError{Code: http.StatusInternalServerError, Message: "Failed to save habit logs", Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package tabit
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// apiTokenPrefix marks personal access tokens so they are never mistaken for a JWT
+const apiTokenPrefix = "tabit_pat_"
+
+// Scope limits what a personal access token can do
+type Scope string
+
+const (
+	ScopeRead  Scope = "read"  // GET habits and stats
+	ScopeLog   Scope = "log"   // PUT /api/habits/{id}
+	ScopeWrite Scope = "write" // Everything a token can do, including read and log
+
+	// scopeSession can only be met by a login session. Tokens cannot manage tokens
+	scopeSession Scope = "session"
+)
+
+var grantableScopes = []Scope{ScopeRead, ScopeLog, ScopeWrite}
+
+// allows reports whether a token with scopes may be used for required
+func allows(scopes []Scope, required Scope) bool {
+	if required == scopeSession {
+		return false
+	}
+	return slices.Contains(scopes, required) || slices.Contains(scopes, ScopeWrite)
+}
+
+func parseScopes(scopes []string) ([]Scope, error) {
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	result := make([]Scope, 0, len(scopes))
+	for _, scope := range scopes {
+		scope := Scope(strings.TrimSpace(scope))
+		if !slices.Contains(grantableScopes, scope) {
+			return nil, fmt.Errorf("unknown scope %q, must be one of read, log or write", scope)
+		}
+		if !slices.Contains(result, scope) {
+			result = append(result, scope)
+		}
+	}
+	return result, nil
+}
+
+// newAPIToken returns a random token and the hash to store for it
+func newAPIToken() (token string, hash string, err error) {
+	return newRandomToken(apiTokenPrefix)
+}
+
+func newRandomToken(prefix string) (token string, hash string, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	token = prefix + base64.RawURLEncoding.EncodeToString(secret)
+	return token, hashToken(token), nil
+}
+
+// hashToken needs no salt or stretching since tokens are long and random
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func userFromAPIToken(ctx context.Context, ds DataStore, token_string string, scope Scope) (*string, *HTTPError) {
+	token, db_err := ds.UseAPIToken(ctx, hashToken(token_string))
+	if db_err != nil {
+		return nil, db_err
+	}
+	if !allows(token.Scopes, scope) {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "Token does not have the required scope"}
+	}
+	return &token.UserID, nil
+}
@@ -0,0 +1,139 @@
+package tabit
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAllows(t *testing.T) {
+	tests := []struct {
+		name     string
+		scopes   []Scope
+		required Scope
+		want     bool
+	}{
+		{name: "read allows read", scopes: []Scope{ScopeRead}, required: ScopeRead, want: true},
+		{name: "read does not allow log", scopes: []Scope{ScopeRead}, required: ScopeLog},
+		{name: "read does not allow write", scopes: []Scope{ScopeRead}, required: ScopeWrite},
+		{name: "log does not allow read", scopes: []Scope{ScopeLog}, required: ScopeRead},
+		{name: "read and log allow log", scopes: []Scope{ScopeRead, ScopeLog}, required: ScopeLog, want: true},
+		{name: "write allows read", scopes: []Scope{ScopeWrite}, required: ScopeRead, want: true},
+		{name: "write allows log", scopes: []Scope{ScopeWrite}, required: ScopeLog, want: true},
+		{name: "write does not allow session", scopes: []Scope{ScopeWrite}, required: scopeSession},
+		{name: "session is never granted", scopes: []Scope{scopeSession}, required: scopeSession},
+		{name: "no scopes", scopes: nil, required: ScopeRead},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allows(tt.scopes, tt.required); got != tt.want {
+				t.Errorf("allows(%v, %s) = %v, want %v", tt.scopes, tt.required, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		scopes  []string
+		want    []Scope
+		wantErr bool
+	}{
+		{name: "one scope", scopes: []string{"read"}, want: []Scope{ScopeRead}},
+		{name: "duplicates and spaces", scopes: []string{"log", " read ", "log"}, want: []Scope{ScopeLog, ScopeRead}},
+		{name: "no scopes", scopes: nil, wantErr: true},
+		{name: "unknown scope", scopes: []string{"read", "admin"}, wantErr: true},
+		{name: "session cannot be granted", scopes: []string{"session"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseScopes(tt.scopes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want an error: %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseScopes(%q) = %v, want %v", tt.scopes, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPITokenScopes(t *testing.T) {
+	h, ds := newTestAPI(t, nil)
+	var session SessionResponse
+	login := PasswordAuthRequest{Email: "alice@example.com", Password: "correct horse battery staple"}
+	if code, message := callAPI(t, h, http.MethodPost, "/api/auth/signup", "", login, &session); code != http.StatusOK {
+		t.Fatalf("signup: %d %s", code, message)
+	}
+	var habit HabitModel
+	if code, message := callAPI(t, h, http.MethodPost, "/api/habits", session.Token, CreateHabitRequest{Name: "walk"}, &habit); code != http.StatusOK {
+		t.Fatalf("create habit: %d %s", code, message)
+	}
+	newToken := func(scopes ...string) string {
+		t.Helper()
+		var token APITokenModel
+		code, message := callAPI(t, h, http.MethodPost, "/api/tokens", session.Token, CreateAPITokenRequest{Name: "test", Scopes: scopes}, &token)
+		if code != http.StatusOK {
+			t.Fatalf("create token: %d %s", code, message)
+		}
+		return token.Token
+	}
+	read, log, write := newToken("read"), newToken("log"), newToken("write")
+
+	const expired = apiTokenPrefix + "expired"
+	yesterday := time.Now().UTC().Add(-24 * time.Hour)
+	if _, db_err := ds.CreateAPIToken(context.Background(), session.UserID, "expired", hashToken(expired), []Scope{ScopeWrite}, &yesterday); db_err != nil {
+		t.Fatal(db_err)
+	}
+
+	habitPath := "/api/habits/" + strconv.FormatInt(habit.HabitID, 10)
+	logDay := LogHabitRequest{Day: "2025-01-01"}
+	tests := []struct {
+		name     string
+		token    string
+		method   string
+		path     string
+		body     any
+		wantCode int
+	}{
+		{name: "read lists habits", token: read, method: http.MethodGet, path: "/api/habits", wantCode: http.StatusOK},
+		{name: "read gets stats", token: read, method: http.MethodGet, path: habitPath + "/stats", wantCode: http.StatusOK},
+		{name: "read cannot log", token: read, method: http.MethodPut, path: habitPath, body: logDay, wantCode: http.StatusForbidden},
+		{name: "read cannot create habits", token: read, method: http.MethodPost, path: "/api/habits", body: CreateHabitRequest{Name: "run"}, wantCode: http.StatusForbidden},
+		{name: "log logs days", token: log, method: http.MethodPut, path: habitPath, body: logDay, wantCode: http.StatusOK},
+		{name: "log cannot read", token: log, method: http.MethodGet, path: "/api/habits", wantCode: http.StatusForbidden},
+		{name: "log cannot rename", token: log, method: http.MethodPatch, path: habitPath, body: map[string]string{"name": "run"}, wantCode: http.StatusForbidden},
+		{name: "log cannot delete", token: log, method: http.MethodDelete, path: habitPath, wantCode: http.StatusForbidden},
+		{name: "write reads", token: write, method: http.MethodGet, path: habitPath, wantCode: http.StatusOK},
+		{name: "write logs", token: write, method: http.MethodPut, path: habitPath, body: logDay, wantCode: http.StatusOK},
+		{name: "write creates habits", token: write, method: http.MethodPost, path: "/api/habits", body: CreateHabitRequest{Name: "run"}, wantCode: http.StatusOK},
+		{name: "tokens cannot list tokens", token: write, method: http.MethodGet, path: "/api/tokens", wantCode: http.StatusForbidden},
+		{name: "tokens cannot create tokens", token: write, method: http.MethodPost, path: "/api/tokens", body: CreateAPITokenRequest{Name: "more", Scopes: []string{"write"}}, wantCode: http.StatusForbidden},
+		{name: "tokens cannot delete the account", token: write, method: http.MethodDelete, path: "/api/account", wantCode: http.StatusForbidden},
+		{name: "tokens cannot merge accounts", token: write, method: http.MethodPost, path: "/api/auth/merge", body: MergeAnonymousRequest{AnonymousToken: "anonymous"}, wantCode: http.StatusForbidden},
+		{name: "tokens cannot list identities", token: write, method: http.MethodGet, path: "/api/auth/identities", wantCode: http.StatusForbidden},
+		{name: "expired token", token: expired, method: http.MethodGet, path: "/api/habits", wantCode: http.StatusUnauthorized},
+		{name: "unknown token", token: apiTokenPrefix + "unknown", method: http.MethodGet, path: "/api/habits", wantCode: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, message := callAPI(t, h, tt.method, tt.path, tt.token, tt.body, nil)
+			if code != tt.wantCode {
+				t.Errorf("%s %s: %d %s, want %d", tt.method, tt.path, code, message, tt.wantCode)
+			}
+		})
+	}
+
+	// the session that created the tokens can still manage them
+	var tokens []APITokenModel
+	if code, message := callAPI(t, h, http.MethodGet, "/api/tokens", session.Token, nil, &tokens); code != http.StatusOK || len(tokens) != 4 {
+		t.Errorf("list tokens: %d %s, %d tokens, want 4", code, message, len(tokens))
+	}
+}
@@ -0,0 +1,403 @@
+package tabit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-jet/jet/v2/postgres"
+	"github.com/go-jet/jet/v2/qrm"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer starts the spans of this package. It follows the provider set by SetupTracing
+var tracer = otel.Tracer("tabit-serverless/tabit")
+
+// Tracing exports the spans recorded after SetupTracing
+type Tracing interface {
+	// ForceFlush exports the spans that are still buffered, such as before Lambda freezes the instance
+	ForceFlush(ctx context.Context) error
+	// Shutdown exports the remaining spans and stops the exporter
+	Shutdown(ctx context.Context) error
+}
+
+type noTracing struct{}
+
+func (noTracing) ForceFlush(ctx context.Context) error { return nil }
+func (noTracing) Shutdown(ctx context.Context) error   { return nil }
+
+// SetupTracing installs the exporter chosen by cfg as the global tracer provider.
+// Trace context is read from and written to the W3C traceparent and baggage headers
+func SetupTracing(ctx context.Context, cfg TracingConfig) (Tracing, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "none":
+		return noTracing{}, nil
+	case "stdout":
+		exporter, err = stdouttrace.New()
+	case "otlp":
+		var options []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, options...)
+	default:
+		return nil, fmt.Errorf("unsupported trace exporter: %s", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	service, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(service),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	postgres.SetQueryLogger(traceQuery)
+	return provider, nil
+}
+
+// traceRequests continues the trace of the incoming headers, or starts one, with a span for the route
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		var route string
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		name := r.Method
+		if route != "" {
+			name += " " + route
+		}
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// TraceparentFromXRay turns the X-Amzn-Trace-Id that API Gateway and Lambda pass along,
+// such as Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1,
+// into a W3C traceparent. It is empty when the header has no parent to continue from
+func TraceparentFromXRay(header string) string {
+	var root, parent, sampled string
+	for _, field := range strings.Split(header, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "Root":
+			root = value
+		case "Parent":
+			parent = value
+		case "Sampled":
+			sampled = value
+		}
+	}
+	// the root is a version, 8 hex digits of epoch seconds and 24 random hex digits
+	parts := strings.Split(root, "-")
+	if len(parts) != 3 || parts[0] != "1" {
+		return ""
+	}
+	traceID, err := trace.TraceIDFromHex(parts[1] + parts[2])
+	if err != nil {
+		return ""
+	}
+	spanID, err := trace.SpanIDFromHex(parent)
+	if err != nil {
+		return ""
+	}
+	flags := "00"
+	if sampled == "1" {
+		flags = "01"
+	}
+	return "00-" + traceID.String() + "-" + spanID.String() + "-" + flags
+}
+
+// traceQuery records a span for every jet statement once it has run
+func traceQuery(ctx context.Context, info postgres.QueryInfo) {
+	if !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+		return // only statements that are part of a traced request
+	}
+	query, _ := info.Statement.Sql()
+	operation, _, _ := strings.Cut(strings.TrimSpace(query), " ")
+	end := time.Now()
+	_, span := tracer.Start(ctx, "SQL "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(end.Add(-info.Duration)),
+		trace.WithAttributes(
+			semconv.DBOperationName(operation),
+			semconv.DBQueryText(query), // parameters are left out, they hold user data
+			semconv.DBResponseReturnedRows(int(info.RowsProcessed)),
+		),
+	)
+	if info.Err != nil && !errors.Is(info.Err, qrm.ErrNoRows) {
+		span.RecordError(info.Err)
+		span.SetStatus(codes.Error, info.Err.Error())
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+// startStoreSpan starts the span of a DataStore method
+func startStoreSpan(ctx context.Context, method string, user_id string) (context.Context, trace.Span) {
+	attributes := []attribute.KeyValue{attribute.String("db.store.method", method)}
+	if user_id != "" {
+		attributes = append(attributes, semconv.EnduserID(user_id))
+	}
+	return tracer.Start(ctx, "DataStore."+method, trace.WithAttributes(attributes...))
+}
+
+// endSpan ends span, marking it failed for server errors. Client errors such as a 404 or 409 are expected
+func endSpan(span trace.Span, db_err *HTTPError) {
+	if db_err != nil {
+		span.SetAttributes(attribute.Int("tabit.error.code", db_err.Code))
+		if db_err.Code >= http.StatusInternalServerError {
+			span.RecordError(db_err)
+			span.SetStatus(codes.Error, db_err.Message)
+		}
+	}
+	span.End()
+}
+
+// tracedStore records a span around every call to a DataStore
+type tracedStore struct {
+	DataStore
+}
+
+func (s *tracedStore) SyncUserData(ctx context.Context, user_id string, base_version *int64, last_updated int64, data map[string]HabitData) (*UserSyncStateModel, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "SyncUserData", user_id)
+	result, db_err := s.DataStore.SyncUserData(ctx, user_id, base_version, last_updated, data)
+	endSpan(span, db_err)
+	return result, db_err
+}
+
+func (s *tracedStore) SyncChanges(ctx context.Context, user_id string, base_version *int64, cursor int64, last_updated int64, changes map[string]HabitData) (*SyncChangesModel, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "SyncChanges", user_id)
+	result, db_err := s.DataStore.SyncChanges(ctx, user_id, base_version, cursor, last_updated, changes)
+	endSpan(span, db_err)
+	return result, db_err
+}
+
+func (s *tracedStore) CreateUser(ctx context.Context, user_id string) *HTTPError {
+	ctx, span := startStoreSpan(ctx, "CreateUser", user_id)
+	db_err := s.DataStore.CreateUser(ctx, user_id)
+	endSpan(span, db_err)
+	return db_err
+}
+
+func (s *tracedStore) DeleteUser(ctx context.Context, user_id string) *HTTPError {
+	ctx, span := startStoreSpan(ctx, "DeleteUser", user_id)
+	db_err := s.DataStore.DeleteUser(ctx, user_id)
+	endSpan(span, db_err)
+	return db_err
+}
+
+func (s *tracedStore) CreatePasswordUser(ctx context.Context, user_id string, email string, password_hash string) (*UserModel, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "CreatePasswordUser", user_id)
+	result, db_err := s.DataStore.CreatePasswordUser(ctx, user_id, email, password_hash)
+	endSpan(span, db_err)
+	return result, db_err
+}
+
+func (s *tracedStore) CreateAnonymousUser(ctx context.Context, user_id string) (*UserModel, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "CreateAnonymousUser", user_id)
+	result, db_err := s.DataStore.CreateAnonymousUser(ctx, user_id)
+	endSpan(span, db_err)
+	return result, db_err
+}
+
+func (s *tracedStore) MergeAnonymousUser(ctx context.Context, anonymous_id string, user_id string) *HTTPError {
+	ctx, span := startStoreSpan(ctx, "MergeAnonymousUser", user_id)
+	db_err := s.DataStore.MergeAnonymousUser(ctx, anonymous_id, user_id)
+	endSpan(span, db_err)
+	return db_err
+}
+
+func (s *tracedStore) GetUserByEmail(ctx context.Context, email string) (*UserModel, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "GetUserByEmail", "")
+	result, db_err := s.DataStore.GetUserByEmail(ctx, email)
+	endSpan(span, db_err)
+	return result, db_err
+}
+
+func (s *tracedStore) GetUser(ctx context.Context, user_id string) (*UserModel, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "GetUser", user_id)
+	result, db_err := s.DataStore.GetUser(ctx, user_id)
+	endSpan(span, db_err)
+	return result, db_err
+}
+
+func (s *tracedStore) UserFromIdentity(ctx context.Context, identity ExternalIdentity, new_user_id string) (*UserModel, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "UserFromIdentity", "")
+	result, db_err := s.DataStore.UserFromIdentity(ctx, identity, new_user_id)
+	endSpan(span, db_err)
+	return result, db_err
+}
+
+func (s *tracedStore) LinkIdentity(ctx context.Context, user_id string, identity ExternalIdentity) *HTTPError {
+	ctx, span := startStoreSpan(ctx, "LinkIdentity", user_id)
+	db_err := s.DataStore.LinkIdentity(ctx, user_id, identity)
+	endSpan(span, db_err)
+	return db_err
+}
+
+func (s *tracedStore) GetIdentities(ctx context.Context, user_id string) ([]IdentityModel, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "GetIdentities", user_id)
+	result, db_err := s.DataStore.GetIdentities(ctx, user_id)
+	endSpan(span, db_err)
+	return result, db_err
+}
+
+func (s *tracedStore) DeleteIdentity(ctx context.Context, user_id string, provider string, subject string) *HTTPError {
+	ctx, span := startStoreSpan(ctx, "DeleteIdentity", user_id)
+	db_err := s.DataStore.DeleteIdentity(ctx, user_id, provider, subject)
+	endSpan(span, db_err)
+	return db_err
+}
+
+func (s *tracedStore) CreateAuthToken(ctx context.Context, user_id string, purpose TokenPurpose, hash string, expires_at time.Time, max_per_hour int) *HTTPError {
+	ctx, span := startStoreSpan(ctx, "CreateAuthToken", user_id)
+	db_err := s.DataStore.CreateAuthToken(ctx, user_id, purpose, hash, expires_at, max_per_hour)
+	endSpan(span, db_err)
+	return db_err
+}
+
+func (s *tracedStore) ResetPassword(ctx context.Context, hash string, password_hash string) (*UserModel, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "ResetPassword", "")
+	result, db_err := s.DataStore.ResetPassword(ctx, hash, password_hash)
+	endSpan(span, db_err)
+	return result, db_err
+}
+
+func (s *tracedStore) VerifyEmail(ctx context.Context, hash string) (*UserModel, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "VerifyEmail", "")
+	result, db_err := s.DataStore.VerifyEmail(ctx, hash)
+	endSpan(span, db_err)
+	return result, db_err
+}
+
+func (s *tracedStore) ProjectSyncState(ctx context.Context, user_id string) *HTTPError {
+	ctx, span := startStoreSpan(ctx, "ProjectSyncState", user_id)
+	db_err := s.DataStore.ProjectSyncState(ctx, user_id)
+	endSpan(span, db_err)
+	return db_err
+}
+
+func (s *tracedStore) SyncedUsers(ctx context.Context) ([]string, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "SyncedUsers", "")
+	result, db_err := s.DataStore.SyncedUsers(ctx)
+	endSpan(span, db_err)
+	return result, db_err
+}
+
+func (s *tracedStore) ExportUser(ctx context.Context, user_id string, export HabitExport) *HTTPError {
+	ctx, span := startStoreSpan(ctx, "ExportUser", user_id)
+	db_err := s.DataStore.ExportUser(ctx, user_id, export)
+	endSpan(span, db_err)
+	return db_err
+}
+
+func (s *tracedStore) CreateHabit(ctx context.Context, user_id string, req CreateHabitRequest) (*HabitModel, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "CreateHabit", user_id)
+	result, db_err := s.DataStore.CreateHabit(ctx, user_id, req)
+	endSpan(span, db_err)
+	return result, db_err
+}
+
+func (s *tracedStore) GetHabits(ctx context.Context, user_id string) ([]HabitModel, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "GetHabits", user_id)
+	result, db_err := s.DataStore.GetHabits(ctx, user_id)
+	endSpan(span, db_err)
+	return result, db_err
+}
+
+func (s *tracedStore) GetHabit(ctx context.Context, user_id string, habit_id int64) (*HabitModel, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "GetHabit", user_id)
+	result, db_err := s.DataStore.GetHabit(ctx, user_id, habit_id)
+	endSpan(span, db_err)
+	return result, db_err
+}
+
+func (s *tracedStore) UpdateHabit(ctx context.Context, user_id string, habit_id int64, req UpdateHabitRequest) (*HabitModel, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "UpdateHabit", user_id)
+	result, db_err := s.DataStore.UpdateHabit(ctx, user_id, habit_id, req)
+	endSpan(span, db_err)
+	return result, db_err
+}
+
+func (s *tracedStore) DeleteHabit(ctx context.Context, user_id string, habit_id int64) *HTTPError {
+	ctx, span := startStoreSpan(ctx, "DeleteHabit", user_id)
+	db_err := s.DataStore.DeleteHabit(ctx, user_id, habit_id)
+	endSpan(span, db_err)
+	return db_err
+}
+
+func (s *tracedStore) LogHabit(ctx context.Context, user_id string, habit_id int64, req LogHabitRequest) (*HabitLogModel, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "LogHabit", user_id)
+	result, db_err := s.DataStore.LogHabit(ctx, user_id, habit_id, req)
+	endSpan(span, db_err)
+	return result, db_err
+}
+
+func (s *tracedStore) CreateAPIToken(ctx context.Context, user_id string, name string, hash string, scopes []Scope, expires_at *time.Time) (*APITokenModel, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "CreateAPIToken", user_id)
+	result, db_err := s.DataStore.CreateAPIToken(ctx, user_id, name, hash, scopes, expires_at)
+	endSpan(span, db_err)
+	return result, db_err
+}
+
+func (s *tracedStore) GetAPITokens(ctx context.Context, user_id string) ([]APITokenModel, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "GetAPITokens", user_id)
+	result, db_err := s.DataStore.GetAPITokens(ctx, user_id)
+	endSpan(span, db_err)
+	return result, db_err
+}
+
+func (s *tracedStore) DeleteAPIToken(ctx context.Context, user_id string, token_id int64) *HTTPError {
+	ctx, span := startStoreSpan(ctx, "DeleteAPIToken", user_id)
+	db_err := s.DataStore.DeleteAPIToken(ctx, user_id, token_id)
+	endSpan(span, db_err)
+	return db_err
+}
+
+func (s *tracedStore) UseAPIToken(ctx context.Context, hash string) (*APITokenModel, *HTTPError) {
+	ctx, span := startStoreSpan(ctx, "UseAPIToken", "")
+	result, db_err := s.DataStore.UseAPIToken(ctx, hash)
+	endSpan(span, db_err)
+	return result, db_err
+}